@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// adminServer serves the management API:
+//
+//	/connections  live connections
+//	/dns-cache    cached DNS answers (local proxy only)
+//	/ip-db        size and version of the IP range table (local proxy only)
+//	/remotes      health of the remote proxies (local proxy only)
+//	/metrics      counters in the Prometheus text format
+//
+// local is nil on the remote proxy.
+type adminServer struct {
+	local   *localProxy
+	tracker *connTracker
+}
+
+func newAdminServer(local *localProxy) http.Handler {
+	a := &adminServer{local: local, tracker: connStats}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", a.connections)
+	mux.HandleFunc("/metrics", a.metrics)
+	if local != nil {
+		mux.HandleFunc("/dns-cache", a.dnsCache)
+		mux.HandleFunc("/ip-db", a.ipDB)
+		mux.HandleFunc("/remotes", a.remotes)
+	}
+	return mux
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func (a *adminServer) connections(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, a.tracker.list())
+}
+
+func (a *adminServer) metrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(rw, a.tracker, a.local)
+}
+
+type dnsCacheEntry struct {
+	Host      string    `json:"host"`
+	IPs       []string  `json:"ips"`
+	ExpiredAt time.Time `json:"expired_at"`
+}
+
+func (a *adminServer) dnsCache(rw http.ResponseWriter, req *http.Request) {
+	entries := []dnsCacheEntry{}
+	a.local.Lock()
+	a.local.dnsCache.each(func(host string, answer *answerCache) {
+		ips := make([]string, len(answer.ips))
+		for i, ip := range answer.ips {
+			ips[i] = ip.String()
+		}
+		entries = append(entries, dnsCacheEntry{
+			Host:      host,
+			IPs:       ips,
+			ExpiredAt: answer.expiredAt,
+		})
+	})
+	a.local.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Host < entries[j].Host
+	})
+	writeJSON(rw, entries)
+}
+
+func (a *adminServer) ipDB(rw http.ResponseWriter, req *http.Request) {
+	a.local.RLock()
+	countries := a.local.directCountries
+	a.local.RUnlock()
+	if countries == nil {
+		countries = map[string]bool{defaultDirectCountries: true}
+	}
+
+	sources := a.local.ipRangeStatuses()
+
+	db := a.local.ipRangeDB
+	db.RLock()
+	defer db.RUnlock()
+
+	status := struct {
+		Ranges    int                   `json:"ranges"`
+		Countries []string              `json:"countries"`
+		Version   string                `json:"version"`
+		UpdatedAt *time.Time            `json:"updated_at,omitempty"`
+		Sources   []ipRangeSourceStatus `json:"sources"`
+	}{
+		Ranges:    len(db.db),
+		Countries: sortedCountries(countries),
+		Version:   db.version,
+		Sources:   sources,
+	}
+	if status.Version == "" {
+		status.Version = "builtin"
+	}
+	if !db.updatedAt.IsZero() {
+		status.UpdatedAt = &db.updatedAt
+	}
+	writeJSON(rw, status)
+}
+
+func (a *adminServer) remotes(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, a.local.remoteStatuses())
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminConnectionsAndMetrics(t *testing.T) {
+	echo := startTestEcho(t)
+	defer echo.Close()
+
+	local := &localProxy{
+		ipRangeDB:         newChinaIPRangeDB(),
+		dnsCache:          newHostCache(10),
+		autoCrossFirewall: true,
+		remotes:           newRemoteSet(policyLatency, "", time.Minute),
+	}
+	local.dnsCache.Add("example.com", &answerCache{ips: []net.IP{net.ParseIP("1.2.3.4")}, expiredAt: time.Now()})
+	proxy := httptest.NewServer(local)
+	defer proxy.Close()
+	admin := httptest.NewServer(newAdminServer(local))
+	defer admin.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", echo.Addr().String())
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(reader, buf)
+	require.Nil(t, err)
+
+	get := func(path string) string {
+		res, err := http.Get(admin.URL + path)
+		require.Nil(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.Nil(t, err)
+		return string(body)
+	}
+
+	var conns []connStatus
+	require.Nil(t, json.Unmarshal([]byte(get("/connections")), &conns))
+	var found *connStatus
+	for i := range conns {
+		if conns[i].Host == echo.Addr().String() {
+			found = &conns[i]
+		}
+	}
+	require.NotNil(t, found)
+	require.Equal(t, routeDirect, found.Route)
+	require.Equal(t, "127.0.0.1", found.IP)
+	require.EqualValues(t, 4, found.Sent)
+	require.EqualValues(t, 4, found.Received)
+
+	metrics := get("/metrics")
+	require.Contains(t, metrics, `sandwich_connections_active{route="direct"} `)
+	require.Contains(t, metrics, "sandwich_dns_cache_entries 1\n")
+	require.Contains(t, get("/dns-cache"), `"host": "example.com"`)
+	require.Contains(t, get("/ip-db"), `"version": "builtin"`)
+	require.Contains(t, get("/ip-db"), `"CN"`)
+
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return !strings.Contains(get("/connections"), echo.Addr().String())
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestWriteMetricsDuringReplace(t *testing.T) {
+	local := &localProxy{
+		ipRangeDB: newChinaIPRangeDB(),
+		dnsCache:  newHostCache(10),
+		remotes:   newRemoteSet(policyLatency, "", time.Minute),
+	}
+	tracker := newConnTracker()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					local.ipRangeDB.replace(nil, "test", time.Now())
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					writeMetrics(ioutil.Discard, tracker, local)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeMetrics and replace deadlocked")
+	}
+}
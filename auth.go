@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerToken = "Misha-Token"
+)
+
+const (
+	defaultTokenSkew = 2 * time.Minute
+	maxNonces        = 1 << 18
+	nonceSize        = 16
+)
+
+// authenticator issues and verifies the token the local proxy sends to the
+// remote proxy. A token is "<unix time>.<nonce>.<mac>" where mac is the
+// HMAC-SHA256, keyed by the secret key, of the time, the nonce and the host
+// the request is for. The remote accepts a token once, and only within skew
+// of its own clock.
+//
+// Every nonce seen is kept until its token falls out of the skew window. When
+// maxNonces are kept, new tokens are refused until some of them expire, no
+// nonce is forgotten early.
+type authenticator struct {
+	sync.Mutex
+	secretKey   string
+	skew        time.Duration
+	legacyUntil time.Time
+	nonces      map[string]time.Time
+	maxNonces   int
+	nextExpiry  time.Time
+}
+
+// newAuthenticator returns an authenticator. Until legacyUntil, requests that
+// carry the secret key itself in the Misha-Secret header are accepted too.
+func newAuthenticator(secretKey string, skew time.Duration, legacyUntil time.Time) *authenticator {
+	return &authenticator{
+		secretKey:   secretKey,
+		skew:        skew,
+		legacyUntil: legacyUntil,
+		nonces:      make(map[string]time.Time),
+		maxNonces:   maxNonces,
+	}
+}
+
+// update changes the settings of a, the nonces already seen stay remembered
+// so a reload doesn't reopen the replay window.
+func (a *authenticator) update(secretKey string, skew time.Duration, legacyUntil time.Time) {
+	a.Lock()
+	defer a.Unlock()
+	a.secretKey = secretKey
+	a.skew = skew
+	a.legacyUntil = legacyUntil
+	a.nextExpiry = time.Time{}
+}
+
+func (a *authenticator) settings() (secretKey string, skew time.Duration, legacyUntil time.Time) {
+	a.Lock()
+	defer a.Unlock()
+	return a.secretKey, a.skew, a.legacyUntil
+}
+
+// token returns a fresh token for a request for host.
+func (a *authenticator) token(host string) string {
+	nonce := make([]byte, nonceSize)
+	rand.Read(nonce)
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	n := hex.EncodeToString(nonce)
+	secretKey, _, _ := a.settings()
+	return ts + "." + n + "." + hex.EncodeToString(mac(secretKey, ts, n, host))
+}
+
+func mac(secretKey, ts, nonce, host string) []byte {
+	h := hmac.New(sha256.New, []byte(secretKey))
+	h.Write([]byte(ts + "." + nonce + "." + host))
+	return h.Sum(nil)
+}
+
+// verify reports whether req carries a valid token, or, during the migration
+// period, the legacy secret header.
+func (a *authenticator) verify(req *http.Request) bool {
+	if token := req.Header.Get(headerToken); token != "" {
+		return a.verifyToken(token, tokenHost(req), time.Now())
+	}
+
+	secretKey, _, legacyUntil := a.settings()
+	if time.Now().Before(legacyUntil) {
+		secret := req.Header.Get(headerSecret)
+		return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(secretKey)) == 1
+	}
+	return false
+}
+
+func (a *authenticator) verifyToken(token, host string, now time.Time) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	ts, nonce, sum := parts[0], parts[1], parts[2]
+	secretKey, skew, _ := a.settings()
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	issuedAt := time.Unix(sec, 0)
+	if issuedAt.Before(now.Add(-skew)) || issuedAt.After(now.Add(skew)) {
+		return false
+	}
+
+	got, err := hex.DecodeString(sum)
+	if err != nil || !hmac.Equal(got, mac(secretKey, ts, nonce, host)) {
+		return false
+	}
+
+	// a nonce is remembered until its token can no longer pass the time
+	// check, so a replayed token is refused either way.
+	a.Lock()
+	defer a.Unlock()
+	if _, ok := a.nonces[nonce]; ok {
+		return false
+	}
+	if len(a.nonces) >= a.maxNonces {
+		a.expireNonces(now)
+		if len(a.nonces) >= a.maxNonces {
+			return false
+		}
+	}
+	a.nonces[nonce] = issuedAt
+	return true
+}
+
+// expireNonces forgets the nonces whose tokens are out of the skew window at
+// now. It sweeps only once the earliest of them expired.
+func (a *authenticator) expireNonces(now time.Time) {
+	if now.Before(a.nextExpiry) {
+		return
+	}
+	a.nextExpiry = time.Time{}
+	for nonce, issuedAt := range a.nonces {
+		expiry := issuedAt.Add(a.skew)
+		if expiry.Before(now) {
+			delete(a.nonces, nonce)
+		} else if a.nextExpiry.IsZero() || expiry.Before(a.nextExpiry) {
+			a.nextExpiry = expiry
+		}
+	}
+}
+
+// tokenHost returns the host a token for req is bound to, as the remote
+// proxy sees it.
+func tokenHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticatorToken(t *testing.T) {
+	local := newAuthenticator("secret", defaultTokenSkew, time.Time{})
+	remote := newAuthenticator("secret", defaultTokenSkew, time.Time{})
+	now := time.Now()
+
+	token := local.token("www.google.com:443")
+	require.True(t, remote.verifyToken(token, "www.google.com:443", now))
+
+	// replayed.
+	require.False(t, remote.verifyToken(token, "www.google.com:443", now))
+
+	// bound to the host.
+	token = local.token("www.google.com:443")
+	require.False(t, remote.verifyToken(token, "www.youtube.com:443", now))
+
+	// outside the clock skew window.
+	require.False(t, remote.verifyToken(local.token("www.google.com:443"), "www.google.com:443", now.Add(3*time.Minute)))
+	require.False(t, remote.verifyToken(local.token("www.google.com:443"), "www.google.com:443", now.Add(-3*time.Minute)))
+
+	// signed with another key.
+	other := newAuthenticator("other", defaultTokenSkew, time.Time{})
+	require.False(t, remote.verifyToken(other.token("www.google.com:443"), "www.google.com:443", now))
+
+	// malformed.
+	parts := strings.Split(local.token("www.google.com:443"), ".")
+	require.False(t, remote.verifyToken(parts[0]+"."+parts[1], "www.google.com:443", now))
+	require.False(t, remote.verifyToken(parts[0]+"."+parts[1]+".zz", "www.google.com:443", now))
+}
+
+func TestAuthenticatorNonceExpiry(t *testing.T) {
+	remote := newAuthenticator("secret", defaultTokenSkew, time.Time{})
+	remote.maxNonces = 2
+	tokenAt := func(at time.Time, nonce string) string {
+		ts := strconv.FormatInt(at.Unix(), 10)
+		return ts + "." + nonce + "." + hex.EncodeToString(mac("secret", ts, nonce, "example.com:443"))
+	}
+
+	now := time.Now()
+	require.True(t, remote.verifyToken(tokenAt(now, "a"), "example.com:443", now))
+	require.True(t, remote.verifyToken(tokenAt(now.Add(time.Minute), "b"), "example.com:443", now.Add(time.Minute)))
+
+	// full, and no nonce is out of the window yet: refused, nothing evicted.
+	later := now.Add(defaultTokenSkew - time.Second)
+	require.False(t, remote.verifyToken(tokenAt(later, "c"), "example.com:443", later))
+	require.False(t, remote.verifyToken(tokenAt(now, "a"), "example.com:443", later))
+
+	// once the first token is out of the window its nonce is forgotten.
+	later = now.Add(defaultTokenSkew + time.Second)
+	require.True(t, remote.verifyToken(tokenAt(later, "c"), "example.com:443", later))
+	require.False(t, remote.verifyToken(tokenAt(now.Add(time.Minute), "b"), "example.com:443", later))
+}
+
+func TestAuthenticatorLegacySecret(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodConnect, "", nil)
+	req.Host = "www.google.com:443"
+	req.Header.Set(headerSecret, "secret")
+
+	require.False(t, newAuthenticator("secret", defaultTokenSkew, time.Time{}).verify(req))
+
+	migrating := newAuthenticator("secret", defaultTokenSkew, time.Now().Add(time.Hour))
+	require.True(t, migrating.verify(req))
+
+	req.Header.Set(headerSecret, "wrong")
+	require.False(t, migrating.verify(req))
+
+	req.Header.Set(headerToken, migrating.token(req.Host))
+	require.True(t, migrating.verify(req))
+}
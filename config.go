@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	envSecretKey = "SANDWICH_SECRET_KEY"
+)
+
+// fileConfig is the content of the config file. Top level keys are named
+// after the command line flags and take the same values, a list where a flag
+// takes a comma separated list. Flags given on the command line win over the
+// config file.
+//
+//	remote-proxy-addr:
+//	  - https://a.example.com:443
+//	  - https://b.example.com:443
+//	secret-key-file: /etc/sandwich/secret
+//	rules:
+//	  - DOMAIN-SUFFIX,qq.com,direct
+//	ip-ranges:
+//	  - url: http://ftp.apnic.net/apnic/stats/apnic/delegated-apnic-latest
+//	    format: delegated-stats
+//	  - url: /etc/sandwich/office.txt
+//	    format: cidr
+//	dns:
+//	  resolvers: [hosts, dot, doh, system]
+//	  strategy: race
+//	  prefer: dot
+//	  grace: 50ms
+//	  timeout: 3s
+//	  servers: [223.5.5.5, 119.29.29.29]
+//	  client-subnet: auto
+//	  hosts:
+//	    router.lan: 192.168.1.1
+//	    "*.dev.example.com": [10.0.0.2, "fd00::2"]
+//	  dot:
+//	    - addr: 1.1.1.1:853
+//	      server-name: cloudflare-dns.com
+//	  doh:
+//	    - url: https://dns.alidns.com/dns-query
+//	    - url: https://rubyfish.cn/dns-query
+//	      format: json
+type fileConfig struct {
+	Flags    map[string]interface{} `yaml:",inline"`
+	Rules    []string               `yaml:"rules"`
+	DNS      dnsConfig              `yaml:"dns"`
+	IPRanges []ipRangeSource        `yaml:"ip-ranges"`
+}
+
+// dnsConfig sets the resolvers the local proxy uses: "hosts", "doh", "dot"
+// and "system". Strategy "order" (the default) tries them in the order of
+// Resolvers, "race" asks them all at once; see smartDNS. Timeout bounds each
+// resolver. Servers are the plain DNS servers "system" asks, those of
+// /etc/resolv.conf by default. ClientSubnet is the EDNS Client Subnet sent
+// to the DoH and DoT servers, "auto" for the /24 of the public address;
+// see localProxy.subnetFor for the hosts it is sent for. Hosts are static
+// mappings answered before any resolver is asked. DoHURL is the key of
+// earlier versions, a single DoH server of the JSON format.
+type dnsConfig struct {
+	Resolvers    []string             `yaml:"resolvers"`
+	Strategy     string               `yaml:"strategy"`
+	Prefer       string               `yaml:"prefer"`
+	Grace        time.Duration        `yaml:"grace"`
+	Timeout      time.Duration        `yaml:"timeout"`
+	Servers      []string             `yaml:"servers"`
+	ClientSubnet string               `yaml:"client-subnet"`
+	Hosts        map[string]hostAddrs `yaml:"hosts"`
+	DoH          []dohProvider        `yaml:"doh"`
+	DoHURL       string               `yaml:"doh-url"`
+	DoT          []dotProvider        `yaml:"dot"`
+}
+
+func (c dnsConfig) resolvers() []string {
+	if len(c.Resolvers) > 0 {
+		return c.Resolvers
+	}
+	if len(c.DoT) > 0 {
+		return []string{resolverHosts, resolverDoH, resolverDoT, resolverSystem}
+	}
+	return []string{resolverHosts, resolverDoH, resolverSystem}
+}
+
+func (c dnsConfig) validate() error {
+	for _, name := range c.Resolvers {
+		switch name {
+		case resolverHosts, resolverDoH, resolverSystem:
+		case resolverDoT:
+			if len(c.DoT) == 0 {
+				return errors.New("dns: dot resolver without dot servers")
+			}
+		default:
+			return fmt.Errorf("dns: unknown resolver %q", name)
+		}
+	}
+	switch c.Strategy {
+	case "", dnsStrategyOrder, dnsStrategyRace:
+	default:
+		return fmt.Errorf("dns: unknown strategy %q", c.Strategy)
+	}
+	if c.Prefer != "" {
+		if c.Strategy != dnsStrategyRace {
+			return errors.New("dns: prefer needs the race strategy")
+		}
+		found := false
+		for _, name := range c.resolvers() {
+			found = found || name == c.Prefer
+		}
+		if !found {
+			return fmt.Errorf("dns: preferred resolver %q is not used", c.Prefer)
+		}
+	}
+	for _, server := range c.Servers {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			host = server
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("dns: bad server %q", server)
+		}
+	}
+	if c.ClientSubnet != "" && c.ClientSubnet != clientSubnetAuto {
+		if _, err := parseClientSubnet(c.ClientSubnet); err != nil {
+			return fmt.Errorf("dns: %s", err.Error())
+		}
+	}
+	if _, err := newStaticHosts(c.Hosts); err != nil {
+		return fmt.Errorf("dns: %s", err.Error())
+	}
+	if c.Grace < 0 || c.Timeout < 0 {
+		return errors.New("dns: negative grace or timeout")
+	}
+	for _, p := range c.DoH {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	for _, p := range c.DoT {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func defaultConfigFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".sandwich", "config.yml")
+}
+
+func readConfig(path string) (*fileConfig, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &fileConfig{}
+	if err = yaml.UnmarshalStrict(buf, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if cfg.DNS.DoHURL != "" {
+		if len(cfg.DNS.DoH) > 0 {
+			return nil, fmt.Errorf("%s: dns: both doh-url and doh are set", path)
+		}
+		cfg.DNS.DoH = []dohProvider{{URL: cfg.DNS.DoHURL, Format: dohFormatJSON}}
+		cfg.DNS.DoHURL = ""
+	}
+	return cfg, nil
+}
+
+// loadOptions parses args with fs and merges the config file in. The secret
+// key comes, by priority, from the -secret-key flag, the SANDWICH_SECRET_KEY
+// environment variable, the secret key file, and the config file.
+func loadOptions(fs *flag.FlagSet, args []string) (options, *fileConfig, error) {
+	var o options
+	registerFlags(fs, &o)
+	if err := fs.Parse(args); err != nil {
+		return o, nil, err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	cfg, err := readConfig(o.configFile)
+	if os.IsNotExist(err) && !explicit["config"] {
+		cfg, err = &fileConfig{}, nil
+	}
+	if err != nil {
+		return o, nil, err
+	}
+
+	if err = cfg.DNS.validate(); err != nil {
+		return o, nil, fmt.Errorf("%s: %s", o.configFile, err.Error())
+	}
+	for _, s := range cfg.IPRanges {
+		if err = s.validate(); err != nil {
+			return o, nil, fmt.Errorf("%s: %s", o.configFile, err.Error())
+		}
+	}
+
+	for name, value := range cfg.Flags {
+		if fs.Lookup(name) == nil || name == "config" {
+			return o, nil, fmt.Errorf("%s: unknown option %q", o.configFile, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		if err = fs.Set(name, configValue(value)); err != nil {
+			return o, nil, fmt.Errorf("%s: %s: %s", o.configFile, name, err.Error())
+		}
+	}
+
+	if !explicit["secret-key"] {
+		if secretKey := os.Getenv(envSecretKey); secretKey != "" {
+			o.secretKey = secretKey
+		} else if o.secretKeyFile != "" {
+			buf, err := ioutil.ReadFile(o.secretKeyFile)
+			if err != nil {
+				return o, nil, err
+			}
+			o.secretKey = strings.TrimSpace(string(buf))
+		}
+	}
+
+	return o, cfg, nil
+}
+
+func configValue(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		values := make([]string, len(list))
+		for i, v := range list {
+			values[i] = fmt.Sprint(v)
+		}
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	secretFile := writeTestFile(t, dir, "secret", "s3cret\n")
+	configFile := writeTestFile(t, dir, "config.yml", `
+remote-proxy-addr:
+  - https://a.example.com
+  - https://b.example.com
+remote-policy: hash
+health-check-interval: 30s
+secret-key-file: `+secretFile+`
+listen-addr: 127.0.0.1:1080
+rules:
+  - DOMAIN-SUFFIX,example.com,reject
+dns:
+  strategy: race
+  prefer: doh
+  grace: 50ms
+  timeout: 3s
+  client-subnet: 1.2.3.0/24
+  hosts:
+    router.lan: 192.168.1.1
+    "*.dev.example.com": [10.0.0.2, "fd00::2"]
+  doh:
+    - url: https://dns.example.com/dns-query
+      method: post
+    - url: https://json.example.com/resolve
+      format: json
+ip-ranges:
+  - url: http://ftp.apnic.net/apnic/stats/apnic/delegated-apnic-latest
+    format: delegated-stats
+  - url: /etc/sandwich/office.txt
+    format: cidr
+`)
+
+	o, cfg, err := loadOptions(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+		"-config", configFile,
+		"-listen-addr", "127.0.0.1:2286",
+	})
+	require.Nil(t, err)
+	require.Equal(t, "https://a.example.com,https://b.example.com", o.remoteProxyAddr)
+	require.Equal(t, policyHash, o.remotePolicy)
+	require.Equal(t, 30*time.Second, o.healthCheckInterval)
+	require.Equal(t, "s3cret", o.secretKey)
+	require.Equal(t, "127.0.0.1:2286", o.listenAddr)
+	require.Equal(t, []string{"DOMAIN-SUFFIX,example.com,reject"}, cfg.Rules)
+	require.Equal(t, []dohProvider{
+		{URL: "https://dns.example.com/dns-query", Method: "post"},
+		{URL: "https://json.example.com/resolve", Format: dohFormatJSON},
+	}, cfg.DNS.DoH)
+	require.Equal(t, dnsStrategyRace, cfg.DNS.Strategy)
+	require.Equal(t, 50*time.Millisecond, cfg.DNS.Grace)
+	require.Equal(t, 3*time.Second, cfg.DNS.Timeout)
+	require.Equal(t, "1.2.3.0/24", cfg.DNS.ClientSubnet)
+	require.Equal(t, map[string]hostAddrs{
+		"router.lan":        {"192.168.1.1"},
+		"*.dev.example.com": {"10.0.0.2", "fd00::2"},
+	}, cfg.DNS.Hosts)
+	require.Equal(t, []ipRangeSource{
+		{URL: "http://ftp.apnic.net/apnic/stats/apnic/delegated-apnic-latest", Format: ipRangeFormatDelegatedStats},
+		{URL: "/etc/sandwich/office.txt", Format: ipRangeFormatCIDR},
+	}, cfg.IPRanges)
+
+	os.Setenv(envSecretKey, "from-env")
+	defer os.Unsetenv(envSecretKey)
+	o, _, err = loadOptions(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", configFile})
+	require.Nil(t, err)
+	require.Equal(t, "from-env", o.secretKey)
+
+	o, _, err = loadOptions(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", configFile, "-secret-key", "from-flag"})
+	require.Nil(t, err)
+	require.Equal(t, "from-flag", o.secretKey)
+}
+
+func TestLoadOptionsDoHURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	configFile := writeTestFile(t, dir, "config.yml", "dns:\n  doh-url: https://rubyfish.cn/dns-query\n")
+	_, cfg, err := loadOptions(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", configFile})
+	require.Nil(t, err)
+	require.Equal(t, []dohProvider{{URL: "https://rubyfish.cn/dns-query", Format: dohFormatJSON}}, cfg.DNS.DoH)
+}
+
+func TestLoadOptionsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, _, err = loadOptions(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", filepath.Join(dir, "missing.yml")})
+	require.NotNil(t, err)
+
+	for _, content := range []string{
+		"no-such-flag: true\n",
+		"health-check-interval: soon\n",
+		"dns:\n  no-such-key: 1\n",
+		"dns:\n  doh:\n    - url: https://dns.example.com/dns-query\n      format: xml\n",
+		"dns:\n  doh-url: https://a.example.com/dns-query\n  doh:\n    - url: https://b.example.com/dns-query\n",
+		"dns:\n  resolvers: [hosts, dot]\n",
+		"dns:\n  resolvers: [hosts, bind]\n",
+		"dns:\n  strategy: fastest\n",
+		"dns:\n  prefer: doh\n",
+		"dns:\n  strategy: race\n  prefer: dot\n",
+		"dns:\n  timeout: soon\n",
+		"dns:\n  servers: [dns.example.com]\n",
+		"dns:\n  dot:\n    - addr: 1.1.1.1\n      via: proxy\n",
+		"dns:\n  client-subnet: nowhere\n",
+		"dns:\n  hosts:\n    router.lan: router\n",
+		"dns:\n  hosts:\n    router.lan: []\n",
+		"dns:\n  hosts:\n    a.*.example.com: 10.0.0.1\n",
+		"ip-ranges:\n  - url: /etc/sandwich/office.txt\n",
+		"ip-ranges:\n  - format: cidr\n",
+		"ip-ranges:\n  - url: country.mmdb\n    format: mmdb\n    country: CN\n",
+		"ip-ranges:\n  - url: office.txt\n    format: cidr\n    country: China\n",
+		"ip-ranges:\n  - url: office.txt\n    format: cidr\n    country: CN,HK\n",
+	} {
+		configFile := writeTestFile(t, dir, "config.yml", content)
+		_, _, err = loadOptions(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", configFile})
+		require.NotNil(t, err, content)
+	}
+}
+
+func TestLocalProxyUpdate(t *testing.T) {
+	local := &localProxy{
+		ipRangeDB: newChinaIPRangeDB(),
+		dnsCache:  newHostCache(8),
+		remotes:   newRemoteSet(policyLatency, "", time.Minute),
+	}
+	local.dnsCache.Add("example.com", &answerCache{})
+
+	rules, err := newRules(options{}, &fileConfig{Rules: []string{"DOMAIN,example.com,reject"}})
+	require.Nil(t, err)
+	old := local.remotes
+	remotes := newRemoteSet(policyHash, "", time.Minute)
+	dnsCfg := dnsConfig{DoH: []dohProvider{{URL: "https://1.1.1.1/dns-query"}}}
+	require.True(t, old == local.update(remotes, rules, newSmartDNS(), dnsCfg, true))
+	require.Equal(t, 0, local.dnsCache.Len())
+
+	// the cache is kept while the resolvers stay the same.
+	local.dnsCache.Add("example.com", &answerCache{})
+	local.update(remotes, rules, newSmartDNS(), dnsConfig{DoH: []dohProvider{{URL: "https://1.1.1.1/dns-query"}}}, true)
+	require.Equal(t, 1, local.dnsCache.Len())
+
+	_, action, err := local.route(context.Background(), "example.com", "443")
+	require.Nil(t, err)
+	require.Equal(t, actionReject, action)
+}
@@ -2,74 +2,478 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+)
 
-	_ "unsafe"
+const (
+	defaultTTL        = 24 * time.Hour
+	defaultDNSTimeout = 5 * time.Second
+	defaultDNSGrace   = 100 * time.Millisecond
+)
+
+const (
+	resolverHosts  = "hosts"
+	resolverDoH    = "doh"
+	resolverDoT    = "dot"
+	resolverSystem = "system"
 )
 
 const (
-	defaultTTL = 24 * time.Hour
+	dnsStrategyOrder = "order"
+	dnsStrategyRace  = "race"
 )
 
+// dns resolves a host to all its addresses, A records first, along with how
+// long they may be cached. A *negativeAnswer error tells the host has none.
 type dns interface {
-	lookup(host string) (ip net.IP, expriedAt time.Time)
+	lookup(ctx context.Context, host string) ([]dnsRecord, error)
+}
+
+// negativeAnswer is the answer of a server telling a host has no address,
+// and how long that may be cached, RFC 2308. nameError is set when the host
+// doesn't exist at all, NXDOMAIN.
+type negativeAnswer struct {
+	ttl       time.Duration
+	nameError bool
+}
+
+func (e *negativeAnswer) Error() string {
+	return "dns: no such host"
 }
 
-type dnsOverHostsFile struct {
+func isNegative(err error) bool {
+	_, ok := err.(*negativeAnswer)
+	return ok
 }
 
-func (d *dnsOverHostsFile) lookup(host string) (ip net.IP, expriedAt time.Time) {
-	res := goLookupIPFiles(host)
-	if len(res) == 0 {
-		return nil, time.Now()
+// dnsResolver is a named stage of smartDNS.
+type dnsResolver struct {
+	name   string
+	lookup func(ctx context.Context, host string) ([]dnsRecord, error)
+}
+
+// smartDNS answers from its static hosts first, then asks its resolvers,
+// each given at most timeout. With the order strategy they are asked one
+// after another until one has addresses. With the race strategy they are
+// asked at once and the first addresses win, unless prefer names a resolver:
+// its answer is then waited for up to grace after the first one came. When
+// none has addresses, a negative answer is returned if any resolver gave one.
+type smartDNS struct {
+	static    *staticHosts
+	resolvers []dnsResolver
+	strategy  string
+	prefer    string
+	grace     time.Duration
+	timeout   time.Duration
+	calls     lookupGroup
+}
+
+func newSmartDNS(resolvers ...dnsResolver) *smartDNS {
+	d := &smartDNS{
+		strategy: dnsStrategyOrder,
+		grace:    defaultDNSGrace,
+		timeout:  defaultDNSTimeout,
 	}
-	return res[0].IP, time.Now()
+	d.resolvers = append(d.resolvers, resolvers...)
+	return d
 }
 
-type dnsOverUDP struct {
+// lookup resolves host. Concurrent lookups of the same host share one
+// resolution, which goes on even when ctx is done so the others get it.
+func (d *smartDNS) lookup(ctx context.Context, host string) ([]dnsRecord, error) {
+	if records := d.static.lookup(host); len(records) > 0 {
+		return records, nil
+	}
+	return d.calls.do(ctx, host, func() ([]dnsRecord, error) {
+		if d.strategy == dnsStrategyRace {
+			return d.race(host)
+		}
+		return d.inOrder(host)
+	})
 }
 
-func (d *dnsOverUDP) lookup(host string) (ip net.IP, expriedAt time.Time) {
-	answers, err := net.LookupIP(host)
-	if err != nil {
-		return nil, time.Now()
+// lookupHosts returns the addresses of host in the static hosts and, when
+// it is one of the resolvers, the hosts file.
+func (d *smartDNS) lookupHosts(ctx context.Context, host string) []dnsRecord {
+	if records := d.static.lookup(host); len(records) > 0 {
+		return records
+	}
+	for _, r := range d.resolvers {
+		if r.name != resolverHosts {
+			continue
+		}
+		if records, _ := r.lookup(ctx, host); len(records) > 0 {
+			return records
+		}
 	}
+	return nil
+}
 
-	return answers[0], time.Now().Add(defaultTTL)
+func (d *smartDNS) inOrder(host string) ([]dnsRecord, error) {
+	var err error
+	for _, r := range d.resolvers {
+		records, rerr := d.ask(r, host)
+		if len(records) > 0 {
+			return records, nil
+		}
+		err = worseDNSError(err, rerr)
+	}
+	return nil, err
 }
 
-type smartDNS struct {
-	lookups []func(host string) (net.IP, time.Time)
+// worseDNSError returns the error to report when two resolvers had no
+// address: a negative answer before a failure, the first one of a kind.
+func worseDNSError(err, next error) error {
+	if err == nil || (isNegative(next) && !isNegative(err)) {
+		return next
+	}
+	return err
 }
 
-func newSmartDNS(lookups ...func(host string) (net.IP, time.Time)) *smartDNS {
-	d := &smartDNS{}
-	d.lookups = append(d.lookups, lookups...)
-	return d
+type dnsAnswer struct {
+	name    string
+	records []dnsRecord
+	err     error
 }
 
-func (d *smartDNS) lookup(host string) (ip net.IP, expriedAt time.Time) {
-	for _, lookup := range d.lookups {
-		ip, expriedAt = lookup(host)
-		if ip != nil {
-			break
+func (d *smartDNS) race(host string) ([]dnsRecord, error) {
+	answers := make(chan dnsAnswer, len(d.resolvers))
+	waitPreferred := false
+	for _, r := range d.resolvers {
+		waitPreferred = waitPreferred || r.name == d.prefer
+		go func(r dnsResolver) {
+			records, err := d.ask(r, host)
+			answers <- dnsAnswer{name: r.name, records: records, err: err}
+		}(r)
+	}
+
+	var first []dnsRecord
+	var grace <-chan time.Time
+	var err error
+	for pending := len(d.resolvers); pending > 0; {
+		select {
+		case a := <-answers:
+			pending--
+			if a.name == d.prefer {
+				waitPreferred = false
+			}
+			if len(a.records) == 0 {
+				err = worseDNSError(err, a.err)
+				if !waitPreferred && first != nil {
+					return first, nil
+				}
+				continue
+			}
+			if !waitPreferred {
+				return a.records, nil
+			}
+			if first == nil {
+				first = a.records
+				grace = time.After(d.grace)
+			}
+		case <-grace:
+			return first, nil
 		}
 	}
-	return
+	if first != nil {
+		return first, nil
+	}
+	return nil, err
+}
+
+func (d *smartDNS) ask(r dnsResolver, host string) ([]dnsRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	return r.lookup(ctx, host)
 }
 
+// lookupGroup coalesces concurrent lookups of the same host.
+type lookupGroup struct {
+	sync.Mutex
+	calls map[string]*lookupCall
+}
+
+type lookupCall struct {
+	done    chan struct{}
+	records []dnsRecord
+	err     error
+}
+
+// do returns the result of lookup, or of the lookup of host already going on.
+// It returns early when ctx is done.
+func (g *lookupGroup) do(ctx context.Context, host string, lookup func() ([]dnsRecord, error)) ([]dnsRecord, error) {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*lookupCall)
+	}
+	c, ok := g.calls[host]
+	if !ok {
+		c = &lookupCall{done: make(chan struct{})}
+		g.calls[host] = c
+		go func() {
+			c.records, c.err = lookup()
+			g.Lock()
+			delete(g.calls, host)
+			g.Unlock()
+			close(c.done)
+		}()
+	}
+	g.Unlock()
+
+	select {
+	case <-c.done:
+		return c.records, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+const (
+	dohFormatMessage = "message"
+	dohFormatJSON    = "json"
+)
+
+const (
+	dohMediaType   = "application/dns-message"
+	maxDoHBodySize = 65535
+)
+
+// dohProvider is a DNS-over-HTTPS endpoint. Format is "message" for RFC 8484
+// (the default) or "json" for the JSON API of Google and others, method is
+// GET (the default) or POST, which only applies to the message format.
+type dohProvider struct {
+	URL    string `yaml:"url"`
+	Format string `yaml:"format"`
+	Method string `yaml:"method"`
+}
+
+func (p dohProvider) validate() error {
+	if u, err := url.Parse(p.URL); err != nil || u.Scheme != "https" {
+		return fmt.Errorf("doh: bad url %q", p.URL)
+	}
+	switch p.Format {
+	case "", dohFormatMessage, dohFormatJSON:
+	default:
+		return fmt.Errorf("doh: %s: unknown format %q", p.URL, p.Format)
+	}
+	switch strings.ToUpper(p.Method) {
+	case "", http.MethodGet, http.MethodPost:
+	default:
+		return fmt.Errorf("doh: %s: unknown method %q", p.URL, p.Method)
+	}
+	return nil
+}
+
+var defaultDoHProviders = []dohProvider{
+	{URL: "https://rubyfish.cn/dns-query", Format: dohFormatJSON},
+}
+
+// dnsOverHTTPS resolves names with the first of its providers that answers.
+// Queries carry the EDNS Client Subnet clientSubnet returns.
 type dnsOverHTTPS struct {
-	client *http.Client
+	client       *http.Client
+	providers    []dohProvider
+	clientSubnet subnetFunc
+}
+
+func (d *dnsOverHTTPS) lookup(ctx context.Context, host string) ([]dnsRecord, error) {
+	return d.resolve(ctx, host)
 }
 
-func (d *dnsOverHTTPS) lookup(host string) (ip net.IP, expriedAt time.Time) {
-	provider := fmt.Sprintf("https://rubyfish.cn/dns-query?name=%s", host)
-	req, _ := http.NewRequest(http.MethodGet, provider, nil)
+// resolve returns the A and AAAA records of host, A records first.
+func (d *dnsOverHTTPS) resolve(ctx context.Context, host string) ([]dnsRecord, error) {
+	providers := d.providers
+	if len(providers) == 0 {
+		providers = defaultDoHProviders
+	}
+
+	var err error
+	for _, p := range providers {
+		var records []dnsRecord
+		if records, err = d.resolveWith(ctx, p, host); err == nil || isNegative(err) {
+			return records, err
+		}
+	}
+	return nil, err
+}
+
+func (d *dnsOverHTTPS) resolveWith(ctx context.Context, p dohProvider, host string) ([]dnsRecord, error) {
+	return d.clientSubnet.resolve(host, func(subnet *net.IPNet) ([]dnsRecord, error) {
+		return resolveAddrs(host, func(host string, qtype uint16) ([]dnsRecord, error) {
+			return d.query(ctx, p, host, qtype, subnet)
+		})
+	})
+}
+
+// resolveAddrs queries the A and AAAA records of host at once, and returns
+// them A records first. It fails only when both queries fail, with a negative
+// answer when both had one, the shorter lived.
+func resolveAddrs(host string, query func(host string, qtype uint16) ([]dnsRecord, error)) ([]dnsRecord, error) {
+	var aaaa []dnsRecord
+	var aaaaErr error
+	done := make(chan struct{})
+	go func() {
+		aaaa, aaaaErr = query(host, typeIPv6)
+		close(done)
+	}()
+	a, err := query(host, typeIPv4)
+	<-done
+
+	if err != nil && aaaaErr != nil {
+		neg, ok := err.(*negativeAnswer)
+		neg6, ok6 := aaaaErr.(*negativeAnswer)
+		switch {
+		case ok && ok6:
+			combined := *neg
+			if neg6.ttl < combined.ttl {
+				combined.ttl = neg6.ttl
+			}
+			combined.nameError = neg.nameError || neg6.nameError
+			return nil, &combined
+		case ok && !ok6:
+			return nil, aaaaErr
+		}
+		return nil, err
+	}
+	return append(a, aaaa...), nil
+}
+
+func (d *dnsOverHTTPS) query(ctx context.Context, p dohProvider, host string, qtype uint16, subnet *net.IPNet) ([]dnsRecord, error) {
+	if p.Format == dohFormatJSON {
+		return d.queryJSON(ctx, p, host, qtype, subnet)
+	}
+	return d.queryMessage(ctx, p, host, qtype, subnet)
+}
+
+func (d *dnsOverHTTPS) queryMessage(ctx context.Context, p dohProvider, host string, qtype uint16, subnet *net.IPNet) ([]dnsRecord, error) {
+	query := newDNSQuery(host, qtype).withClientSubnet(subnet)
+	answer, err := d.exchangeWith(ctx, p, query)
+	if err != nil {
+		return nil, err
+	}
+	return answerRecords(answer)
+}
+
+// exchange sends query as it is to the first provider speaking the message
+// format that answers.
+func (d *dnsOverHTTPS) exchange(ctx context.Context, query *dnsMessage) (*dnsMessage, error) {
+	providers := d.providers
+	if len(providers) == 0 {
+		providers = defaultDoHProviders
+	}
+
+	err := errors.New("doh: no provider speaks the message format")
+	for _, p := range providers {
+		if p.Format == dohFormatJSON {
+			continue
+		}
+		var answer *dnsMessage
+		if answer, err = d.exchangeWith(ctx, p, query); err == nil {
+			return answer, nil
+		}
+	}
+	return nil, err
+}
+
+// exchangeWith sends an RFC 8484 query. The id sent is 0 so that HTTP caches
+// can serve GET queries, the answer gets the id of query back.
+func (d *dnsOverHTTPS) exchangeWith(ctx context.Context, p dohProvider, query *dnsMessage) (*dnsMessage, error) {
+	id := query.id
+	query.id = 0
+	msg, err := query.pack()
+	query.id = id
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if strings.ToUpper(p.Method) == http.MethodPost {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(msg))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	} else {
+		sep := "?"
+		if strings.Contains(p.URL, "?") {
+			sep = "&"
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, p.URL+sep+"dns="+base64.RawURLEncoding.EncodeToString(msg), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: %s: %s", p.URL, res.Status)
+	}
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, dohMediaType) {
+		return nil, fmt.Errorf("doh: %s: unexpected content type %q", p.URL, ct)
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(res.Body, maxDoHBodySize))
+	if err != nil {
+		return nil, err
+	}
+	answer, err := unpackDNSMessage(buf)
+	if err != nil {
+		return nil, err
+	}
+	if answer.id != 0 {
+		return nil, errDNSIDMismatch
+	}
+	answer.id = id
+	return answer, nil
+}
+
+// answerRecords returns the addresses of a response. A name that doesn't
+// exist, or has no address of the type asked, is an answer too: a negative
+// one when the server tells how long to cache it or the name doesn't exist,
+// one without addresses otherwise.
+func answerRecords(m *dnsMessage) ([]dnsRecord, error) {
+	switch m.rcode() {
+	case rcodeSuccess, rcodeNameError:
+		records := m.records()
+		if len(records) == 0 {
+			ttl, ok := m.negativeTTL()
+			if ok || m.rcode() == rcodeNameError {
+				return nil, &negativeAnswer{ttl: ttl, nameError: m.rcode() == rcodeNameError}
+			}
+		}
+		return records, nil
+	}
+	return nil, fmt.Errorf("dns: rcode %d", m.rcode())
+}
+
+func (d *dnsOverHTTPS) queryJSON(ctx context.Context, p dohProvider, host string, qtype uint16, subnet *net.IPNet) ([]dnsRecord, error) {
+	sep := "?"
+	if strings.Contains(p.URL, "?") {
+		sep = "&"
+	}
+	provider := fmt.Sprintf("%s%sname=%s&type=%d", p.URL, sep, url.QueryEscape(host), qtype)
+	if subnet != nil {
+		provider += "&edns_client_subnet=" + url.QueryEscape(subnet.String())
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, provider, nil)
 	req.Header.Set("Accept", "application/dns-json")
 
 	res, err := d.client.Do(req)
@@ -77,38 +481,74 @@ func (d *dnsOverHTTPS) lookup(host string) (ip net.IP, expriedAt time.Time) {
 		defer res.Body.Close()
 	}
 	if err != nil {
-		return nil, time.Now()
+		return nil, err
 	}
 
 	buf, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, time.Now()
+		return nil, err
 	}
 
 	rr := &response{}
-	json.NewDecoder(bytes.NewBuffer(buf)).Decode(rr)
-	if rr.Status != 0 {
-		return nil, time.Now()
+	if err = json.NewDecoder(bytes.NewBuffer(buf)).Decode(rr); err != nil {
+		return nil, err
 	}
-	if len(rr.Answer) == 0 {
-		return nil, time.Now()
+	if rr.Status != rcodeSuccess && rr.Status != rcodeNameError {
+		return nil, fmt.Errorf("dns: rcode %d", rr.Status)
 	}
 
-	var answer *answer
+	var records []dnsRecord
 	for _, a := range rr.Answer {
-		if a.Type == typeIPv4 || a.Type == typeIPv6 {
-			answer = &a
-			break
+		if a.Type != int(qtype) {
+			continue
+		}
+		ip := net.ParseIP(a.Data)
+		if qtype == typeIPv4 {
+			ip = ip.To4()
+		}
+		if ip != nil {
+			records = append(records, dnsRecord{
+				ip:  ip,
+				ttl: time.Duration(a.TTL) * time.Second,
+			})
 		}
 	}
-
-	if answer != nil {
-		ip = net.ParseIP(answer.Data)
-		expriedAt = time.Now().Add(time.Duration(answer.TTL) * time.Second)
+	if len(records) == 0 {
+		ttl, ok := rr.negativeTTL()
+		if ok || rr.Status == rcodeNameError {
+			return nil, &negativeAnswer{ttl: ttl, nameError: rr.Status == rcodeNameError}
+		}
 	}
+	return records, nil
+}
 
-	return ip, expriedAt
+// negativeTTL is dnsMessage.negativeTTL for the JSON format, where the data
+// of SOA records is their fields separated by spaces.
+func (r *response) negativeTTL() (time.Duration, bool) {
+	for _, a := range r.Authority {
+		fields := strings.Fields(a.Data)
+		if a.Type != typeSOA || len(fields) != 7 {
+			continue
+		}
+		ttl, err := strconv.Atoi(fields[6])
+		if err != nil {
+			continue
+		}
+		if a.TTL < ttl {
+			ttl = a.TTL
+		}
+		return time.Duration(ttl) * time.Second, true
+	}
+	return 0, false
 }
 
-//go:linkname goLookupIPFiles net.goLookupIPFiles
-func goLookupIPFiles(name string) (addrs []net.IPAddr)
+// minTTL returns the lowest TTL of records.
+func minTTL(records []dnsRecord) time.Duration {
+	ttl := records[0].ttl
+	for _, r := range records[1:] {
+		if r.ttl < ttl {
+			ttl = r.ttl
+		}
+	}
+	return ttl
+}
@@ -1,27 +1,199 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
 )
-import _ "unsafe"
 
-func TestLookupStaticHost(t *testing.T) {
-	t.Log(goLookupIPFiles("youtube.com"))
+// newTestDoHServer answers every A query with 1.2.3.4 and every AAAA query
+// with 2001:db8::1, in both the message and the JSON format.
+func newTestDoHServer(t *testing.T) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/resolve" {
+			typ := typeIPv4
+			data := "1.2.3.4"
+			if req.URL.Query().Get("type") == "28" {
+				typ, data = typeIPv6, "2001:db8::1"
+			}
+			json.NewEncoder(rw).Encode(&response{
+				Answer: []answer{{Type: typ, TTL: 60, Data: data}},
+			})
+			return
+		}
+
+		if req.URL.Path != "/dns-query" {
+			http.NotFound(rw, req)
+			return
+		}
+
+		var msg []byte
+		var err error
+		if req.Method == http.MethodPost {
+			require.Equal(t, dohMediaType, req.Header.Get("Content-Type"))
+			msg, err = ioutil.ReadAll(req.Body)
+		} else {
+			msg, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		}
+		require.Nil(t, err)
+		query, err := unpackDNSMessage(msg)
+		require.Nil(t, err)
+		require.Equal(t, uint16(0), query.id)
+
+		q := query.questions[0]
+		res := &dnsMessage{id: query.id, flags: dnsFlagResponse, questions: query.questions}
+		if q.name == "example.com." {
+			data := net.ParseIP("1.2.3.4").To4()
+			if q.qtype == typeIPv6 {
+				data = net.ParseIP("2001:db8::1")
+			}
+			res.answers = []dnsResource{{name: q.name, rtype: q.qtype, class: classINET, ttl: 60, data: data}}
+		} else {
+			res.flags |= rcodeNameError
+		}
+		b, err := res.pack()
+		require.Nil(t, err)
+		rw.Header().Set("Content-Type", dohMediaType)
+		rw.Write(b)
+	}))
 }
 
-func TestSmartDNSLookUP(t *testing.T) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: nil,
-		},
+func TestDNSOverHTTPSProviders(t *testing.T) {
+	server := newTestDoHServer(t)
+	defer server.Close()
+
+	want := []dnsRecord{
+		{ip: net.ParseIP("1.2.3.4").To4(), ttl: time.Minute},
+		{ip: net.ParseIP("2001:db8::1"), ttl: time.Minute},
+	}
+	for _, p := range []dohProvider{
+		{URL: server.URL + "/dns-query"},
+		{URL: server.URL + "/dns-query", Method: "post"},
+	} {
+		d := &dnsOverHTTPS{client: server.Client(), providers: []dohProvider{p}}
+		records, err := d.resolve(context.Background(), "example.com")
+		require.Nil(t, err)
+		require.Equal(t, want, records)
+
+		// NXDOMAIN without an SOA isn't cached, but still tells the name
+		// doesn't exist.
+		records, err = d.resolve(context.Background(), "nonexistent.example.com")
+		require.Equal(t, &negativeAnswer{nameError: true}, err)
+		require.Empty(t, records)
 	}
-	dns := newSmartDNS(
-		(&dnsOverHostsFile{}).lookup,
-		(&dnsOverHTTPS{client: client}).lookup,
-		(&dnsOverUDP{}).lookup,
+
+	d := &dnsOverHTTPS{client: server.Client(), providers: []dohProvider{
+		{URL: server.URL + "/unreachable", Format: dohFormatMessage},
+		{URL: server.URL + "/resolve", Format: dohFormatJSON},
+	}}
+	records, err := d.resolve(context.Background(), "example.com")
+	require.Nil(t, err)
+	require.Equal(t, want, records)
+
+	records, err = d.lookup(context.Background(), "example.com")
+	require.Nil(t, err)
+	require.Equal(t, want, records)
+}
+
+func testResolver(name, ip string, delay time.Duration, calls *int32) dnsResolver {
+	return dnsResolver{name: name, lookup: func(ctx context.Context, host string) ([]dnsRecord, error) {
+		if calls != nil {
+			atomic.AddInt32(calls, 1)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if ip == "" {
+			return nil, nil
+		}
+		return []dnsRecord{{ip: net.ParseIP(ip), ttl: time.Minute}}, nil
+	}}
+}
+
+func TestSmartDNSOrder(t *testing.T) {
+	d := newSmartDNS(
+		testResolver("hung", "1.1.1.1", time.Hour, nil),
+		testResolver("empty", "", 0, nil),
+		testResolver("system", "2.2.2.2", 0, nil),
 	)
-	t.Log(dns.lookup("youtube.com"))
-	t.Log(dns.lookup("localhost"))
-	t.Log(dns.lookup("www.google.com"))
+	d.timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	records, _ := d.lookup(context.Background(), "example.com")
+	require.Equal(t, "2.2.2.2", records[0].ip.String())
+	require.True(t, time.Since(start) < time.Second)
+
+	// a negative answer wins over failures.
+	negative := dnsResolver{name: "doh", lookup: func(ctx context.Context, host string) ([]dnsRecord, error) {
+		return nil, &negativeAnswer{ttl: time.Minute}
+	}}
+	d = newSmartDNS(testResolver("hung", "1.1.1.1", time.Hour, nil), negative, testResolver("empty", "", 0, nil))
+	d.timeout = 50 * time.Millisecond
+	_, err := d.lookup(context.Background(), "example.com")
+	require.Equal(t, &negativeAnswer{ttl: time.Minute}, err)
+}
+
+func TestSmartDNSRace(t *testing.T) {
+	d := newSmartDNS(
+		testResolver("system", "1.1.1.1", 0, nil),
+		testResolver("dot", "2.2.2.2", 50*time.Millisecond, nil),
+		testResolver("doh", "3.3.3.3", 20*time.Millisecond, nil),
+	)
+	d.strategy = dnsStrategyRace
+
+	records, _ := d.lookup(context.Background(), "example.com")
+	require.Equal(t, "1.1.1.1", records[0].ip.String())
+
+	d.prefer = "dot"
+	d.grace = time.Second
+	records, _ = d.lookup(context.Background(), "example.com")
+	require.Equal(t, "2.2.2.2", records[0].ip.String())
+
+	// the preferred resolver is too slow.
+	d.grace = 10 * time.Millisecond
+	records, _ = d.lookup(context.Background(), "example.com")
+	require.Equal(t, "1.1.1.1", records[0].ip.String())
+
+	d = newSmartDNS(testResolver("doh", "", 0, nil), testResolver("dot", "", 0, nil))
+	d.strategy = dnsStrategyRace
+	d.prefer = "dot"
+	records, _ = d.lookup(context.Background(), "example.com")
+	require.Empty(t, records)
+}
+
+func TestSmartDNSCoalesce(t *testing.T) {
+	var calls int32
+	d := newSmartDNS(testResolver("doh", "1.1.1.1", 50*time.Millisecond, &calls))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			records, _ := d.lookup(context.Background(), "example.com")
+			require.Equal(t, "1.1.1.1", records[0].ip.String())
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// a caller giving up doesn't cancel the lookup the others wait for.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	records, _ := d.lookup(ctx, "example.com")
+	require.Empty(t, records)
+	records, _ = d.lookup(context.Background(), "example.com")
+	require.Equal(t, "1.1.1.1", records[0].ip.String())
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// entries hit in the last tenth of their TTL are refreshed before they
+	// expire, so hot names never miss.
+	dnsPrefetchRatio = 10
+	// expired entries are served for up to maxDNSStaleAge while they can't
+	// be refreshed, with dnsStaleTTL as RFC 8767 recommends.
+	maxDNSStaleAge    = 24 * time.Hour
+	dnsStaleTTL       = 30 * time.Second
+	dnsRefreshTimeout = 30 * time.Second
+)
+
+var errDNSNoAnswer = errors.New("dns: no answer")
+
+type resolveFunc func(ctx context.Context, host string) ([]dnsRecord, error)
+
+func dnsCacheFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".sandwich", "dns-cache.json")
+}
+
+// resolveCached returns the addresses of host and how long they stay valid,
+// from the cache when it has them, or a *negativeAnswer error when host has
+// none. Entries about to expire are refreshed in the background, expired ones
+// are served stale while they are.
+func (l *localProxy) resolveCached(ctx context.Context, host string, resolve resolveFunc) ([]net.IP, time.Duration, error) {
+	now := time.Now()
+	l.Lock()
+	if v, ok := l.dnsCache.Get(host); ok {
+		r := v.(*answerCache)
+		ttl := r.expiredAt.Sub(now)
+		switch {
+		case ttl > 0:
+			if ttl < r.ttl/dnsPrefetchRatio {
+				l.refresh(host, r, resolve)
+			}
+			l.Unlock()
+			return r.answer(ttl)
+		case -ttl < maxDNSStaleAge:
+			l.refresh(host, r, resolve)
+			l.Unlock()
+			return r.answer(dnsStaleTTL)
+		}
+		l.dnsCache.Remove(host)
+	}
+	l.Unlock()
+
+	return l.resolveAndCache(ctx, host, resolve)
+}
+
+// refresh resolves host again in the background, unless it is already being
+// refreshed. r is left as it is when that fails. l must be locked.
+func (l *localProxy) refresh(host string, r *answerCache, resolve resolveFunc) {
+	if r.refreshing {
+		return
+	}
+	r.refreshing = true
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsRefreshTimeout)
+		defer cancel()
+		if _, _, err := l.resolveAndCache(ctx, host, resolve); err != nil {
+			l.Lock()
+			r.refreshing = false
+			l.Unlock()
+		}
+	}()
+}
+
+// resolveAndCache resolves host and caches its addresses. Negative answers
+// are cached as entries without addresses, RFC 2308. A host that turned out
+// not to exist otherwise is dropped from the cache, as is a host whose
+// addresses have no TTL.
+func (l *localProxy) resolveAndCache(ctx context.Context, host string, resolve resolveFunc) ([]net.IP, time.Duration, error) {
+	records, err := resolve(ctx, host)
+	var ips []net.IP
+	var ttl time.Duration
+	var nameError bool
+	switch {
+	case isNegative(err):
+		ttl = err.(*negativeAnswer).ttl
+		nameError = err.(*negativeAnswer).nameError
+	case err != nil:
+		return nil, 0, err
+	case len(records) == 0:
+		l.Lock()
+		l.dnsCache.Remove(host)
+		l.Unlock()
+		return nil, 0, nil
+	default:
+		ips = make([]net.IP, len(records))
+		for i, r := range records {
+			ips[i] = r.ip
+		}
+		ttl = minTTL(records)
+	}
+
+	l.Lock()
+	if ttl > 0 {
+		l.dnsCache.Add(host, &answerCache{
+			ips:       ips,
+			ttl:       ttl,
+			expiredAt: time.Now().Add(ttl),
+			nameError: nameError,
+		})
+	} else {
+		// the entry it would replace isn't served stale any longer.
+		l.dnsCache.Remove(host)
+	}
+	l.Unlock()
+	return ips, ttl, err
+}
+
+type savedAnswer struct {
+	Host      string        `json:"host"`
+	IPs       []net.IP      `json:"ips"`
+	TTL       time.Duration `json:"ttl"`
+	ExpiredAt time.Time     `json:"expired_at"`
+}
+
+// writeFileAtomic writes data to path through a temporary file renamed over
+// it, so that a crash doesn't leave half of it.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// saveDNSCache writes the DNS cache to path.
+func (l *localProxy) saveDNSCache(path string) error {
+	var answers []savedAnswer
+	l.Lock()
+	l.dnsCache.each(func(host string, answer *answerCache) {
+		answers = append(answers, savedAnswer{
+			Host:      host,
+			IPs:       answer.ips,
+			TTL:       answer.ttl,
+			ExpiredAt: answer.expiredAt,
+		})
+	})
+	l.Unlock()
+
+	buf, err := json.Marshal(answers)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf)
+}
+
+// loadDNSCache fills the DNS cache from path, skipping the entries too old to
+// be served stale.
+func (l *localProxy) loadDNSCache(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var answers []savedAnswer
+	if err = json.Unmarshal(buf, &answers); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	for _, a := range answers {
+		if len(a.IPs) == 0 || now.Sub(a.ExpiredAt) >= maxDNSStaleAge {
+			continue
+		}
+		for i, ip := range a.IPs {
+			if ip4 := ip.To4(); ip4 != nil {
+				a.IPs[i] = ip4
+			}
+		}
+		l.dnsCache.Add(a.Host, &answerCache{
+			ips:       a.IPs,
+			ttl:       a.TTL,
+			expiredAt: a.ExpiredAt,
+		})
+	}
+	return nil
+}
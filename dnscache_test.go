@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSCacheStaleAndPrefetch(t *testing.T) {
+	local := &localProxy{dnsCache: newHostCache(8)}
+	var calls, failing int32
+	var answer atomic.Value
+	answer.Store("1.1.1.1")
+	resolve := func(ctx context.Context, host string) ([]dnsRecord, error) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, errDNSTimeout
+		}
+		return []dnsRecord{{ip: net.ParseIP(answer.Load().(string)).To4(), ttl: 100 * time.Second}}, nil
+	}
+	setExpiredAt := func(expiredAt time.Time) {
+		local.Lock()
+		cachedAnswer(local, "example.com").expiredAt = expiredAt
+		local.Unlock()
+	}
+	resolved := func() (string, time.Duration) {
+		ips, ttl, err := local.resolveCached(context.Background(), "example.com", resolve)
+		require.Nil(t, err)
+		return ips[0].String(), ttl
+	}
+
+	ip, ttl := resolved()
+	require.Equal(t, "1.1.1.1", ip)
+	require.InDelta(t, 100*time.Second, ttl, float64(time.Second))
+	resolved()
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// expired entries are served stale while they are refreshed.
+	answer.Store("2.2.2.2")
+	setExpiredAt(time.Now().Add(-time.Hour))
+	ip, ttl = resolved()
+	require.Equal(t, "1.1.1.1", ip)
+	require.Equal(t, dnsStaleTTL, ttl)
+	require.Eventually(t, func() bool {
+		ip, _ := resolved()
+		return ip == "2.2.2.2"
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// and kept when the refresh fails.
+	atomic.StoreInt32(&failing, 1)
+	setExpiredAt(time.Now().Add(-time.Hour))
+	ip, _ = resolved()
+	require.Equal(t, "2.2.2.2", ip)
+	require.Eventually(t, func() bool {
+		local.Lock()
+		defer local.Unlock()
+		return !cachedAnswer(local, "example.com").refreshing
+	}, time.Second, 10*time.Millisecond)
+	ip, _ = resolved()
+	require.Equal(t, "2.2.2.2", ip)
+	require.Eventually(t, func() bool {
+		local.Lock()
+		defer local.Unlock()
+		return !cachedAnswer(local, "example.com").refreshing
+	}, time.Second, 10*time.Millisecond)
+
+	// too old to be served.
+	setExpiredAt(time.Now().Add(-maxDNSStaleAge))
+	_, _, err := local.resolveCached(context.Background(), "example.com", resolve)
+	require.Equal(t, errDNSTimeout, err)
+
+	// entries hit close to their expiry are refreshed before it.
+	atomic.StoreInt32(&failing, 0)
+	answer.Store("3.3.3.3")
+	resolved()
+	answer.Store("4.4.4.4")
+	setExpiredAt(time.Now().Add(5 * time.Second))
+	ip, _ = resolved()
+	require.Equal(t, "3.3.3.3", ip)
+	require.Eventually(t, func() bool {
+		ip, _ := resolved()
+		return ip == "4.4.4.4"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDNSCacheRefreshWithoutTTL(t *testing.T) {
+	local := &localProxy{dnsCache: newHostCache(8)}
+	ttl := int64(100 * time.Second)
+	var answer atomic.Value
+	answer.Store("1.1.1.1")
+	resolve := func(ctx context.Context, host string) ([]dnsRecord, error) {
+		return []dnsRecord{{ip: net.ParseIP(answer.Load().(string)).To4(), ttl: time.Duration(atomic.LoadInt64(&ttl))}}, nil
+	}
+	resolved := func() string {
+		ips, _, err := local.resolveCached(context.Background(), "example.com", resolve)
+		require.Nil(t, err)
+		return ips[0].String()
+	}
+
+	require.Equal(t, "1.1.1.1", resolved())
+
+	// e.g. the host was added to the hosts file.
+	atomic.StoreInt64(&ttl, 0)
+	answer.Store("2.2.2.2")
+	local.Lock()
+	cachedAnswer(local, "example.com").expiredAt = time.Now().Add(-time.Hour)
+	local.Unlock()
+	require.Equal(t, "1.1.1.1", resolved())
+	require.Eventually(t, func() bool {
+		local.Lock()
+		defer local.Unlock()
+		_, ok := local.dnsCache.Get("example.com")
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, "2.2.2.2", resolved())
+}
+
+func cachedAnswer(local *localProxy, host string) *answerCache {
+	v, _ := local.dnsCache.Get(host)
+	return v.(*answerCache)
+}
+
+func TestDNSCachePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dns-cache.json")
+
+	local := &localProxy{dnsCache: newHostCache(8)}
+	expiredAt := time.Now().Add(time.Minute).Round(time.Second)
+	local.dnsCache.Add("example.com", &answerCache{
+		ips:       []net.IP{net.ParseIP("1.2.3.4").To4(), net.ParseIP("2001:db8::1")},
+		ttl:       time.Minute,
+		expiredAt: expiredAt,
+	})
+	local.dnsCache.Add("old.example.com", &answerCache{
+		ips:       []net.IP{net.ParseIP("1.2.3.4").To4()},
+		expiredAt: time.Now().Add(-2 * maxDNSStaleAge),
+	})
+	require.Nil(t, local.saveDNSCache(path))
+
+	loaded := &localProxy{dnsCache: newHostCache(8)}
+	require.Nil(t, loaded.loadDNSCache(path))
+	require.Equal(t, 1, loaded.dnsCache.Len())
+	r := cachedAnswer(loaded, "example.com")
+	require.Equal(t, []net.IP{net.ParseIP("1.2.3.4").To4(), net.ParseIP("2001:db8::1")}, r.ips)
+	require.Equal(t, time.Minute, r.ttl)
+	require.True(t, expiredAt.Equal(r.expiredAt))
+
+	require.True(t, os.IsNotExist(loaded.loadDNSCache(filepath.Join(dir, "missing.json"))))
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	local := &localProxy{dnsCache: newHostCache(8)}
+	var calls int32
+	resolve := func(ctx context.Context, host string) ([]dnsRecord, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, &negativeAnswer{ttl: time.Minute, nameError: true}
+	}
+
+	for i := 0; i < 3; i++ {
+		ips, ttl, err := local.resolveCached(context.Background(), "typo.example.com", resolve)
+		require.True(t, isNegative(err))
+		require.True(t, err.(*negativeAnswer).nameError)
+		require.Empty(t, ips)
+		require.InDelta(t, time.Minute, ttl, float64(time.Second))
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	defaultDNSPort   = "53"
+	resolvConfFile   = "/etc/resolv.conf"
+	dnsUDPBufferSize = 1232
+)
+
+var errDNSMismatch = errors.New("dns: answer doesn't match the query")
+
+// dnsOverUDP asks plain DNS servers over UDP, and over TCP when an answer
+// doesn't fit. Without servers, the nameservers of /etc/resolv.conf are
+// asked, and the system resolver when there are none.
+type dnsOverUDP struct {
+	servers []string
+}
+
+func (d *dnsOverUDP) lookup(ctx context.Context, host string) ([]dnsRecord, error) {
+	return d.resolve(ctx, host)
+}
+
+// resolve returns the addresses of host, A records first, trying the servers
+// in turn until one answers.
+func (d *dnsOverUDP) resolve(ctx context.Context, host string) ([]dnsRecord, error) {
+	servers := d.servers
+	if len(servers) == 0 {
+		servers = readResolvConf(resolvConfFile)
+	}
+	if len(servers) == 0 {
+		return resolveSystem(ctx, host)
+	}
+
+	var err error
+	for _, server := range servers {
+		server = dnsServerAddr(server)
+		var records []dnsRecord
+		records, err = resolveAddrs(host, func(host string, qtype uint16) ([]dnsRecord, error) {
+			answer, err := exchangeDNS(ctx, server, newDNSQuery(host, qtype))
+			if err != nil {
+				return nil, err
+			}
+			return answerRecords(answer)
+		})
+		if err == nil || isNegative(err) {
+			return records, err
+		}
+	}
+	return nil, err
+}
+
+// exchange sends query as it is to the servers in turn until one answers.
+func (d *dnsOverUDP) exchange(ctx context.Context, query *dnsMessage) (*dnsMessage, error) {
+	servers := d.servers
+	if len(servers) == 0 {
+		servers = readResolvConf(resolvConfFile)
+	}
+
+	err := errors.New("dns: no servers")
+	for _, server := range servers {
+		var answer *dnsMessage
+		if answer, err = exchangeDNS(ctx, dnsServerAddr(server), query); err == nil {
+			return answer, nil
+		}
+	}
+	return nil, err
+}
+
+// resolveSystem asks the resolver of the system, which doesn't tell TTLs:
+// every record gets defaultTTL.
+func resolveSystem(ctx context.Context, host string) ([]dnsRecord, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var v4, v6 []dnsRecord
+	for _, addr := range addrs {
+		ip := addr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, dnsRecord{ip: ip4, ttl: defaultTTL})
+		} else {
+			v6 = append(v6, dnsRecord{ip: ip, ttl: defaultTTL})
+		}
+	}
+	return append(v4, v6...), nil
+}
+
+func dnsServerAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, defaultDNSPort)
+	}
+	return server
+}
+
+// readResolvConf returns the nameservers of a resolv.conf file.
+func readResolvConf(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		// link local addresses may carry a zone.
+		addr := strings.SplitN(fields[1], "%", 2)[0]
+		if net.ParseIP(addr) != nil {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// exchangeDNS sends query to server over UDP, and again over TCP when the
+// answer is truncated. Answers not matching query are ignored, they may be
+// spoofed.
+func exchangeDNS(ctx context.Context, server string, query *dnsMessage) (*dnsMessage, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultDNSTimeout)
+		defer cancel()
+	}
+
+	msg, err := query.pack()
+	if err != nil {
+		return nil, err
+	}
+	answer, err := exchangeDNSUDP(ctx, server, query, msg)
+	if err != nil || answer.flags&dnsFlagTruncated == 0 {
+		return answer, err
+	}
+	return exchangeDNSTCP(ctx, server, query, msg)
+}
+
+func exchangeDNSUDP(ctx context.Context, server string, query *dnsMessage, msg []byte) (*dnsMessage, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsUDPBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		answer, err := unpackDNSMessage(buf[:n])
+		if err == nil && isAnswerTo(answer, query) {
+			return answer, nil
+		}
+	}
+}
+
+func exchangeDNSTCP(ctx context.Context, server string, query *dnsMessage, msg []byte) (*dnsMessage, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err = conn.Write(append(appendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err = io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	answer, err := unpackDNSMessage(buf)
+	if err != nil {
+		return nil, err
+	}
+	if !isAnswerTo(answer, query) {
+		return nil, errDNSMismatch
+	}
+	return answer, nil
+}
+
+func isAnswerTo(answer, query *dnsMessage) bool {
+	if answer.id != query.id || answer.flags&dnsFlagResponse == 0 || len(answer.questions) != 1 {
+		return false
+	}
+	q, a := query.questions[0], answer.questions[0]
+	return q.qtype == a.qtype && q.qclass == a.qclass && strings.EqualFold(q.name, a.name)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testDNSAnswer answers example.com with TTLs of 300s for A and 60s for AAAA,
+// big.example.com with more addresses than fit in 512 bytes, and anything else
+// with NXDOMAIN and an SOA record.
+func testDNSAnswer(query *dnsMessage) *dnsMessage {
+	q := query.questions[0]
+	res := &dnsMessage{id: query.id, flags: dnsFlagResponse | dnsFlagRecursionAvailable, questions: query.questions}
+	switch q.name {
+	case "example.com.":
+		if q.qtype == typeIPv4 {
+			res.answers = []dnsResource{{name: q.name, rtype: typeIPv4, class: classINET, ttl: 300, data: net.ParseIP("1.2.3.4").To4()}}
+		} else {
+			res.answers = []dnsResource{{name: q.name, rtype: typeIPv6, class: classINET, ttl: 60, data: net.ParseIP("2001:db8::1")}}
+		}
+	case "big.example.com.":
+		if q.qtype == typeIPv4 {
+			for i := 0; i < 40; i++ {
+				res.answers = append(res.answers, dnsResource{name: q.name, rtype: typeIPv4, class: classINET, ttl: 300, data: net.IPv4(10, 0, 0, byte(i)).To4()})
+			}
+		}
+	default:
+		res.flags |= rcodeNameError
+		res.authorities = []dnsResource{{
+			name:  "example.com.",
+			rtype: typeSOA,
+			class: classINET,
+			ttl:   3600,
+			soa:   &dnsSOA{mname: "ns.example.com.", rname: "admin.example.com.", serial: 1, refresh: 7200, retry: 900, expire: 86400, minimum: 30},
+		}}
+	}
+	return res
+}
+
+// newTestUDPDNSServer serves testDNSAnswer over UDP and TCP on the same port.
+// Over UDP every answer is preceded by a spoofed one, and answers over 512
+// bytes are truncated.
+func newTestUDPDNSServer(t *testing.T) (string, func()) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	require.Nil(t, err)
+
+	go func() {
+		buf := make([]byte, maxDNSMessageSize)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := unpackDNSMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			res := testDNSAnswer(query)
+			b, _ := res.pack()
+			if len(b) > maxUDPDNSSize {
+				res = &dnsMessage{id: query.id, flags: dnsFlagResponse | dnsFlagTruncated, questions: query.questions}
+				b, _ = res.pack()
+			}
+			spoofed := append([]byte(nil), b...)
+			spoofed[0]++
+			packetConn.WriteTo(spoofed, addr)
+			packetConn.WriteTo(b, addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, msg); err != nil {
+					return
+				}
+				query, err := unpackDNSMessage(msg)
+				if err != nil {
+					return
+				}
+				b, _ := testDNSAnswer(query).pack()
+				conn.Write(append(appendUint16(nil, uint16(len(b))), b...))
+			}()
+		}
+	}()
+	return packetConn.LocalAddr().String(), func() {
+		packetConn.Close()
+		listener.Close()
+	}
+}
+
+func TestDNSOverUDP(t *testing.T) {
+	addr, closer := newTestUDPDNSServer(t)
+	defer closer()
+
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	closed.Close()
+
+	d := &dnsOverUDP{servers: []string{closed.LocalAddr().String(), addr}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	records, err := d.resolve(ctx, "example.com")
+	require.Nil(t, err)
+	require.Equal(t, []dnsRecord{
+		{ip: net.ParseIP("1.2.3.4").To4(), ttl: 300 * time.Second},
+		{ip: net.ParseIP("2001:db8::1"), ttl: time.Minute},
+	}, records)
+
+	// truncated answers are asked again over TCP.
+	records, err = d.resolve(ctx, "big.example.com")
+	require.Nil(t, err)
+	require.Len(t, records, 40)
+
+	// NXDOMAIN is cached for the lower of the SOA TTL and minimum.
+	_, err = d.resolve(ctx, "nonexistent.example.com")
+	require.Equal(t, &negativeAnswer{ttl: 30 * time.Second, nameError: true}, err)
+}
+
+func TestReadResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeTestFile(t, dir, "resolv.conf", `# generated
+search example.com
+nameserver 192.168.1.1
+nameserver fe80::1%eth0
+nameserver bogus
+options ndots:1
+`)
+	require.Equal(t, []string{"192.168.1.1", "fe80::1%eth0"}, readResolvConf(path))
+	require.Nil(t, readResolvConf(filepath.Join(dir, "missing")))
+	require.Equal(t, "192.168.1.1:53", dnsServerAddr("192.168.1.1"))
+	require.Equal(t, "[fe80::1%eth0]:53", dnsServerAddr("fe80::1%eth0"))
+	require.Equal(t, "192.168.1.1:5353", dnsServerAddr("192.168.1.1:5353"))
+}
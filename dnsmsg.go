@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	typeNS    = 2
+	typeCNAME = 5
+	typeSOA   = 6
+	typeOPT   = 41
+)
+
+const (
+	classINET = 1
+)
+
+const (
+	ednsOptionClientSubnet = 8
+)
+
+const (
+	rcodeSuccess       = 0
+	rcodeFormatError   = 1
+	rcodeServerFailure = 2
+	rcodeNameError     = 3
+	rcodeRefused       = 5
+)
+
+const (
+	dnsFlagResponse           = 1 << 15
+	dnsFlagAuthoritative      = 1 << 10
+	dnsFlagTruncated          = 1 << 9
+	dnsFlagRecursionDesired   = 1 << 8
+	dnsFlagRecursionAvailable = 1 << 7
+)
+
+const (
+	dnsHeaderSize     = 12
+	maxDNSPointers    = 16
+	maxDNSMessageSize = 65535
+)
+
+var (
+	errDNSShortMessage = errors.New("dns: short message")
+	errDNSBadName      = errors.New("dns: bad name")
+	errDNSIDMismatch   = errors.New("dns: id mismatch")
+	errDNSTimeout      = errors.New("dns: timeout")
+)
+
+// dnsRecord is an address a name resolved to and how long it may be cached.
+type dnsRecord struct {
+	ip  net.IP
+	ttl time.Duration
+}
+
+// dnsMessage is a DNS message as defined in RFC 1035. Only what sandwich
+// needs is decoded: names of CNAME and NS records go to target, SOA records
+// to soa, the data of every other type is kept as it is on the wire.
+type dnsMessage struct {
+	id          uint16
+	flags       uint16
+	questions   []dnsQuestion
+	answers     []dnsResource
+	authorities []dnsResource
+	additionals []dnsResource
+}
+
+type dnsQuestion struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type dnsResource struct {
+	name   string
+	rtype  uint16
+	class  uint16
+	ttl    uint32
+	data   []byte
+	target string
+	soa    *dnsSOA
+}
+
+type dnsSOA struct {
+	mname   string
+	rname   string
+	serial  uint32
+	refresh uint32
+	retry   uint32
+	expire  uint32
+	minimum uint32
+}
+
+// newDNSQuery returns a recursive query for the records of type qtype of
+// host, with a random id.
+func newDNSQuery(host string, qtype uint16) *dnsMessage {
+	var id [2]byte
+	rand.Read(id[:])
+	return &dnsMessage{
+		id:    binary.BigEndian.Uint16(id[:]),
+		flags: dnsFlagRecursionDesired,
+		questions: []dnsQuestion{
+			{name: canonicalName(host), qtype: qtype, qclass: classINET},
+		},
+	}
+}
+
+// withClientSubnet adds an OPT record carrying subnet as the EDNS Client
+// Subnet option of RFC 7871 to m, and returns m. A nil subnet adds nothing.
+func (m *dnsMessage) withClientSubnet(subnet *net.IPNet) *dnsMessage {
+	if subnet == nil {
+		return m
+	}
+	family, ip := uint16(1), subnet.IP.To4()
+	if ip == nil {
+		family, ip = 2, subnet.IP.To16()
+	}
+	ones, _ := subnet.Mask.Size()
+	// the address is truncated to the bytes the prefix covers.
+	addr := ip.Mask(subnet.Mask)[:(ones+7)/8]
+
+	data := appendUint16(nil, ednsOptionClientSubnet)
+	data = appendUint16(data, uint16(4+len(addr)))
+	data = appendUint16(data, family)
+	data = append(data, byte(ones), 0)
+	data = append(data, addr...)
+	m.additionals = append(m.additionals, dnsResource{
+		name:  ".",
+		rtype: typeOPT,
+		class: dnsUDPBufferSize,
+		data:  data,
+	})
+	return m
+}
+
+// canonicalName returns host lowercased and fully qualified.
+func canonicalName(host string) string {
+	host = strings.ToLower(host)
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	return host
+}
+
+func (m *dnsMessage) rcode() int {
+	return int(m.flags & 0xf)
+}
+
+// records returns the addresses in the answer section, whatever name they
+// are for, since the other names are the CNAME chain of the question.
+func (m *dnsMessage) records() []dnsRecord {
+	var records []dnsRecord
+	for _, rr := range m.answers {
+		if rr.class != classINET {
+			continue
+		}
+		if (rr.rtype == typeIPv4 && len(rr.data) == net.IPv4len) || (rr.rtype == typeIPv6 && len(rr.data) == net.IPv6len) {
+			records = append(records, dnsRecord{
+				ip:  net.IP(append([]byte(nil), rr.data...)),
+				ttl: time.Duration(rr.ttl) * time.Second,
+			})
+		}
+	}
+	return records
+}
+
+// negativeTTL returns how long the absence of the records asked in m may be
+// cached, RFC 2308 section 5: the lower of the TTL and the minimum field of
+// the SOA record in the authority section. Without one it isn't cached.
+func (m *dnsMessage) negativeTTL() (time.Duration, bool) {
+	for _, rr := range m.authorities {
+		if rr.rtype != typeSOA || rr.soa == nil {
+			continue
+		}
+		ttl := rr.ttl
+		if rr.soa.minimum < ttl {
+			ttl = rr.soa.minimum
+		}
+		return time.Duration(ttl) * time.Second, true
+	}
+	return 0, false
+}
+
+func (m *dnsMessage) pack() ([]byte, error) {
+	b := make([]byte, dnsHeaderSize, 512)
+	binary.BigEndian.PutUint16(b[0:], m.id)
+	binary.BigEndian.PutUint16(b[2:], m.flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.answers)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(m.authorities)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.additionals)))
+
+	var err error
+	for _, q := range m.questions {
+		if b, err = appendDNSName(b, q.name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, q.qtype)
+		b = appendUint16(b, q.qclass)
+	}
+	for _, section := range [][]dnsResource{m.answers, m.authorities, m.additionals} {
+		for _, rr := range section {
+			if b, err = rr.pack(b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(b) > maxDNSMessageSize {
+		return nil, errors.New("dns: message too large")
+	}
+	return b, nil
+}
+
+func (rr *dnsResource) pack(b []byte) ([]byte, error) {
+	var err error
+	if b, err = appendDNSName(b, rr.name); err != nil {
+		return nil, err
+	}
+	b = appendUint16(b, rr.rtype)
+	b = appendUint16(b, rr.class)
+	b = appendUint32(b, rr.ttl)
+
+	lengthAt := len(b)
+	b = appendUint16(b, 0)
+	switch {
+	case rr.rtype == typeCNAME || rr.rtype == typeNS:
+		b, err = appendDNSName(b, rr.target)
+	case rr.rtype == typeSOA && rr.soa != nil:
+		if b, err = appendDNSName(b, rr.soa.mname); err == nil {
+			b, err = appendDNSName(b, rr.soa.rname)
+		}
+		for _, v := range []uint32{rr.soa.serial, rr.soa.refresh, rr.soa.retry, rr.soa.expire, rr.soa.minimum} {
+			b = appendUint32(b, v)
+		}
+	default:
+		b = append(b, rr.data...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(b[lengthAt:], uint16(len(b)-lengthAt-2))
+	return b, nil
+}
+
+func unpackDNSMessage(msg []byte) (*dnsMessage, error) {
+	if len(msg) < dnsHeaderSize {
+		return nil, errDNSShortMessage
+	}
+	m := &dnsMessage{
+		id:    binary.BigEndian.Uint16(msg[0:]),
+		flags: binary.BigEndian.Uint16(msg[2:]),
+	}
+	counts := []int{
+		int(binary.BigEndian.Uint16(msg[4:])),
+		int(binary.BigEndian.Uint16(msg[6:])),
+		int(binary.BigEndian.Uint16(msg[8:])),
+		int(binary.BigEndian.Uint16(msg[10:])),
+	}
+
+	off := dnsHeaderSize
+	var err error
+	for i := 0; i < counts[0]; i++ {
+		q := dnsQuestion{}
+		if q.name, off, err = unpackDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+4 > len(msg) {
+			return nil, errDNSShortMessage
+		}
+		q.qtype = binary.BigEndian.Uint16(msg[off:])
+		q.qclass = binary.BigEndian.Uint16(msg[off+2:])
+		off += 4
+		m.questions = append(m.questions, q)
+	}
+
+	for i, section := range []*[]dnsResource{&m.answers, &m.authorities, &m.additionals} {
+		for j := 0; j < counts[i+1]; j++ {
+			var rr dnsResource
+			if rr, off, err = unpackDNSResource(msg, off); err != nil {
+				return nil, err
+			}
+			*section = append(*section, rr)
+		}
+	}
+	return m, nil
+}
+
+func unpackDNSResource(msg []byte, off int) (dnsResource, int, error) {
+	rr := dnsResource{}
+	var err error
+	if rr.name, off, err = unpackDNSName(msg, off); err != nil {
+		return rr, 0, err
+	}
+	if off+10 > len(msg) {
+		return rr, 0, errDNSShortMessage
+	}
+	rr.rtype = binary.BigEndian.Uint16(msg[off:])
+	rr.class = binary.BigEndian.Uint16(msg[off+2:])
+	rr.ttl = binary.BigEndian.Uint32(msg[off+4:])
+	length := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	end := off + length
+	if end > len(msg) {
+		return rr, 0, errDNSShortMessage
+	}
+	rr.data = msg[off:end:end]
+
+	switch rr.rtype {
+	case typeCNAME, typeNS:
+		if rr.target, _, err = unpackDNSName(msg, off); err != nil {
+			return rr, 0, err
+		}
+	case typeSOA:
+		soa := &dnsSOA{}
+		n := off
+		if soa.mname, n, err = unpackDNSName(msg, n); err != nil {
+			return rr, 0, err
+		}
+		if soa.rname, n, err = unpackDNSName(msg, n); err != nil {
+			return rr, 0, err
+		}
+		if n+20 > end {
+			return rr, 0, errDNSShortMessage
+		}
+		soa.serial = binary.BigEndian.Uint32(msg[n:])
+		soa.refresh = binary.BigEndian.Uint32(msg[n+4:])
+		soa.retry = binary.BigEndian.Uint32(msg[n+8:])
+		soa.expire = binary.BigEndian.Uint32(msg[n+12:])
+		soa.minimum = binary.BigEndian.Uint32(msg[n+16:])
+		rr.soa = soa
+	}
+	return rr, end, nil
+}
+
+// unpackDNSName reads the possibly compressed name at off, and returns it
+// along with the offset following it.
+func unpackDNSName(msg []byte, off int) (string, int, error) {
+	var name []byte
+	next := -1
+	for pointers := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSShortMessage
+		}
+		c := int(msg[off])
+		switch c & 0xc0 {
+		case 0x00:
+			if c == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				if len(name) == 0 {
+					name = append(name, '.')
+				}
+				if len(name) > 255 {
+					return "", 0, errDNSBadName
+				}
+				return string(name), next, nil
+			}
+			if off+1+c > len(msg) {
+				return "", 0, errDNSShortMessage
+			}
+			name = append(name, msg[off+1:off+1+c]...)
+			name = append(name, '.')
+			off += 1 + c
+		case 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSShortMessage
+			}
+			if pointers++; pointers > maxDNSPointers {
+				return "", 0, errDNSBadName
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = (c&0x3f)<<8 | int(msg[off+1])
+		default:
+			return "", 0, errDNSBadName
+		}
+	}
+}
+
+func appendDNSName(b []byte, name string) ([]byte, error) {
+	if name == "." || name == "" {
+		return append(b, 0), nil
+	}
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, errDNSBadName
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errDNSBadName
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSMessagePackUnpack(t *testing.T) {
+	m := &dnsMessage{
+		id:        0x1234,
+		flags:     dnsFlagResponse | dnsFlagRecursionDesired | dnsFlagRecursionAvailable,
+		questions: []dnsQuestion{{name: "www.example.com.", qtype: typeIPv4, qclass: classINET}},
+		answers: []dnsResource{
+			{name: "www.example.com.", rtype: typeCNAME, class: classINET, ttl: 300, target: "example.com."},
+			{name: "example.com.", rtype: typeIPv4, class: classINET, ttl: 60, data: net.ParseIP("1.2.3.4").To4()},
+			{name: "example.com.", rtype: typeIPv6, class: classINET, ttl: 30, data: net.ParseIP("2001:db8::1")},
+		},
+		authorities: []dnsResource{
+			{name: "example.com.", rtype: typeSOA, class: classINET, ttl: 3600, soa: &dnsSOA{
+				mname: "ns.example.com.", rname: "admin.example.com.", serial: 1, minimum: 600,
+			}},
+		},
+	}
+	b, err := m.pack()
+	require.Nil(t, err)
+
+	got, err := unpackDNSMessage(b)
+	require.Nil(t, err)
+	require.Equal(t, m.id, got.id)
+	require.Equal(t, m.questions, got.questions)
+	require.Equal(t, "example.com.", got.answers[0].target)
+	require.Equal(t, uint32(600), got.authorities[0].soa.minimum)
+	require.Equal(t, []dnsRecord{
+		{ip: net.ParseIP("1.2.3.4").To4(), ttl: 60 * time.Second},
+		{ip: net.ParseIP("2001:db8::1"), ttl: 30 * time.Second},
+	}, got.records())
+}
+
+func TestUnpackDNSNameCompression(t *testing.T) {
+	msg := make([]byte, dnsHeaderSize)
+	msg = append(msg, 3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0)
+	msg = append(msg, 3, 'f', 'o', 'o', 0xc0, dnsHeaderSize+4)
+
+	name, off, err := unpackDNSName(msg, dnsHeaderSize+17)
+	require.Nil(t, err)
+	require.Equal(t, "foo.example.com.", name)
+	require.Equal(t, len(msg), off)
+
+	// a pointer to itself must not loop forever.
+	loop := append(make([]byte, dnsHeaderSize), 0xc0, dnsHeaderSize)
+	_, _, err = unpackDNSName(loop, dnsHeaderSize)
+	require.Equal(t, errDNSBadName, err)
+
+	_, _, err = unpackDNSName(msg[:dnsHeaderSize+5], dnsHeaderSize)
+	require.Equal(t, errDNSShortMessage, err)
+}
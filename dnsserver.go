@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	maxUDPDNSSize    = 512
+	maxDNSServerTTL  = 10 * time.Minute
+	dnsServerTimeout = 10 * time.Second
+	dnsTCPIdleTime   = 30 * time.Second
+	maxUDPDNSQueries = 256
+)
+
+// dnsServer answers the DNS queries of the LAN, so devices that ignore
+// proxies don't ask polluted resolvers. Like chinadns, every name is asked
+// of both the domestic resolver and the DoH providers, tunnelled through the
+// remote proxy, and the domestic answer is kept only when it points into the
+// direct IP ranges. Answers go into the DNS cache of the local proxy, so both
+// agree on where a name is. The domestic resolver asks the servers of
+// dns.servers, those of /etc/resolv.conf by default; exchange asks them
+// queries the DoH providers can't answer.
+type dnsServer struct {
+	sync.RWMutex
+	local    *localProxy
+	domestic resolveFunc
+	exchange exchangeFunc
+	foreign  *dnsOverHTTPS
+}
+
+type exchangeFunc func(ctx context.Context, query *dnsMessage) (*dnsMessage, error)
+
+func newDNSServer(local *localProxy, domestic resolveFunc, exchange exchangeFunc, foreign *dnsOverHTTPS) *dnsServer {
+	return &dnsServer{
+		local:    local,
+		domestic: domestic,
+		exchange: exchange,
+		foreign:  foreign,
+	}
+}
+
+func (s *dnsServer) setResolvers(domestic resolveFunc, exchange exchangeFunc, foreign *dnsOverHTTPS) {
+	s.Lock()
+	s.domestic = domestic
+	s.exchange = exchange
+	s.foreign = foreign
+	s.Unlock()
+}
+
+// serveUDP answers at most maxUDPDNSQueries queries at once, datagrams wait
+// in the socket buffer meanwhile.
+func (s *dnsServer) serveUDP(conn net.PacketConn) error {
+	sem := make(chan struct{}, maxUDPDNSQueries)
+	buf := make([]byte, maxDNSMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		msg := append([]byte(nil), buf[:n]...)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			if res := s.handle(msg, true); res != nil {
+				conn.WriteTo(res, addr)
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn answers the length prefixed queries of conn one after another.
+func (s *dnsServer) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPIdleTime))
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+
+		res := s.handle(msg, false)
+		if res == nil {
+			return
+		}
+		if _, err := conn.Write(append(appendUint16(nil, uint16(len(res))), res...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the packed answer to msg, or nil when msg is not a query.
+// Answers over UDP that don't fit are truncated so the client retries over
+// TCP.
+func (s *dnsServer) handle(msg []byte, udp bool) []byte {
+	query, err := unpackDNSMessage(msg)
+	if err != nil || query.flags&dnsFlagResponse != 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsServerTimeout)
+	defer cancel()
+	res := s.answer(ctx, query)
+	b, err := res.pack()
+	if err != nil {
+		res = replyTo(query, rcodeServerFailure)
+		b, _ = res.pack()
+	}
+	if udp && len(b) > udpSize(query) {
+		res = replyTo(query, rcodeSuccess)
+		res.flags |= dnsFlagTruncated
+		b, _ = res.pack()
+	}
+	return b
+}
+
+// udpSize is the largest UDP answer the client of query accepts.
+func udpSize(query *dnsMessage) int {
+	for _, rr := range query.additionals {
+		if rr.rtype == typeOPT && int(rr.class) > maxUDPDNSSize {
+			return int(rr.class)
+		}
+	}
+	return maxUDPDNSSize
+}
+
+// replyTo returns an empty answer to query.
+func replyTo(query *dnsMessage, rcode int) *dnsMessage {
+	return &dnsMessage{
+		id:        query.id,
+		flags:     dnsFlagResponse | dnsFlagRecursionAvailable | query.flags&dnsFlagRecursionDesired | uint16(rcode),
+		questions: query.questions,
+	}
+}
+
+func (s *dnsServer) answer(ctx context.Context, query *dnsMessage) *dnsMessage {
+	if len(query.questions) != 1 {
+		return replyTo(query, rcodeFormatError)
+	}
+	q := query.questions[0]
+
+	if q.qclass != classINET || (q.qtype != typeIPv4 && q.qtype != typeIPv6) {
+		// only addresses decide routes, everything else is asked of the DoH
+		// providers as it is, or of the domestic servers when none of them
+		// speaks the message format, as the default one doesn't.
+		s.RLock()
+		exchange, foreign := s.exchange, s.foreign
+		s.RUnlock()
+		res, err := foreign.exchange(ctx, query)
+		if err != nil {
+			res, err = exchange(ctx, query)
+		}
+		if err != nil {
+			log.Printf("dns server: %s: %s", q.name, err.Error())
+			return replyTo(query, rcodeServerFailure)
+		}
+		res.id = query.id
+		return res
+	}
+
+	ips, ttl, err := s.resolve(ctx, q.name)
+	rcode := rcodeSuccess
+	switch {
+	case isNegative(err):
+		if err.(*negativeAnswer).nameError {
+			rcode = rcodeNameError
+		}
+	case err != nil:
+		log.Printf("dns server: %s: %s", q.name, err.Error())
+		return replyTo(query, rcodeServerFailure)
+	}
+	if ttl > maxDNSServerTTL {
+		ttl = maxDNSServerTTL
+	}
+
+	res := replyTo(query, rcode)
+	for _, ip := range ips {
+		data := ip.To4()
+		if q.qtype == typeIPv6 {
+			if data != nil {
+				continue
+			}
+			data = ip.To16()
+		}
+		if data == nil {
+			continue
+		}
+		res.answers = append(res.answers, dnsResource{
+			name:  q.name,
+			rtype: q.qtype,
+			class: classINET,
+			ttl:   uint32(ttl / time.Second),
+			data:  data,
+		})
+	}
+	if len(res.answers) == 0 {
+		// RFC 2308: the SOA tells the client how long to cache the absence.
+		res.authorities = []dnsResource{{
+			name:  q.name,
+			rtype: typeSOA,
+			class: classINET,
+			ttl:   uint32(ttl / time.Second),
+			soa:   &dnsSOA{mname: ".", rname: ".", minimum: uint32(ttl / time.Second)},
+		}}
+	}
+	return res
+}
+
+// resolve returns the addresses of name and how long they stay valid, from
+// the cache when it has them, or a *negativeAnswer error when it has none.
+func (s *dnsServer) resolve(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	host := name
+	if len(host) > 1 && host[len(host)-1] == '.' {
+		host = host[:len(host)-1]
+	}
+	return s.local.resolveCached(ctx, host, s.resolveSplit)
+}
+
+// resolveSplit asks both sides at once and keeps the domestic answer when it
+// has a direct address, the foreign one otherwise. Whichever side fails, the
+// other one is used.
+func (s *dnsServer) resolveSplit(ctx context.Context, host string) ([]dnsRecord, error) {
+	s.RLock()
+	domestic, foreign := s.domestic, s.foreign
+	s.RUnlock()
+
+	type result struct {
+		records []dnsRecord
+		err     error
+	}
+	foreignResult := make(chan result, 1)
+	go func() {
+		records, err := foreign.resolve(ctx, host)
+		foreignResult <- result{records, err}
+	}()
+
+	domesticRecords, domesticErr := domestic(ctx, host)
+	if domesticErr == nil && s.isDirect(domesticRecords) {
+		return domesticRecords, nil
+	}
+
+	var r result
+	select {
+	case r = <-foreignResult:
+	case <-ctx.Done():
+		r.err = errDNSTimeout
+	}
+	if r.err != nil && !isNegative(r.err) {
+		return domesticRecords, domesticErr
+	}
+	return r.records, r.err
+}
+
+func (s *dnsServer) isDirect(records []dnsRecord) bool {
+	for _, r := range records {
+		if s.local.isDirect(r.ip) {
+			return true
+		}
+	}
+	return false
+}
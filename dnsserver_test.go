@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDNSServer(t *testing.T) (*dnsServer, *localProxy, func()) {
+	doh := newTestDoHServer(t)
+	local := &localProxy{
+		ipRangeDB: newChinaIPRangeDB(),
+		dnsCache:  newHostCache(10),
+		dns:       newSmartDNS(),
+	}
+	domestic := func(ctx context.Context, host string) ([]dnsRecord, error) {
+		switch host {
+		case "example.com":
+			// polluted
+			return []dnsRecord{{ip: net.ParseIP("203.0.113.1").To4(), ttl: time.Hour}}, nil
+		case "domestic.example.com":
+			return []dnsRecord{{ip: net.ParseIP("1.0.1.1").To4(), ttl: time.Hour}}, nil
+		}
+		return nil, nil
+	}
+	exchange := func(ctx context.Context, query *dnsMessage) (*dnsMessage, error) {
+		return nil, errDNSTimeout
+	}
+	foreign := &dnsOverHTTPS{client: doh.Client(), providers: []dohProvider{{URL: doh.URL + "/dns-query"}}}
+	return newDNSServer(local, domestic, exchange, foreign), local, doh.Close
+}
+
+func exchangeTestDNS(t *testing.T, conn net.Conn, tcp bool, host string, qtype uint16) *dnsMessage {
+	msg, err := newDNSQuery(host, qtype).pack()
+	require.Nil(t, err)
+	if tcp {
+		msg = append(appendUint16(nil, uint16(len(msg))), msg...)
+	}
+	_, err = conn.Write(msg)
+	require.Nil(t, err)
+
+	buf := make([]byte, maxDNSMessageSize)
+	var n int
+	if tcp {
+		_, err = io.ReadFull(conn, buf[:2])
+		require.Nil(t, err)
+		n, err = io.ReadFull(conn, buf[:binary.BigEndian.Uint16(buf)])
+	} else {
+		n, err = conn.Read(buf)
+	}
+	require.Nil(t, err)
+	res, err := unpackDNSMessage(buf[:n])
+	require.Nil(t, err)
+	return res
+}
+
+func TestDNSServerSplitHorizon(t *testing.T) {
+	s, local, closeDoH := newTestDNSServer(t)
+	defer closeDoH()
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer packetConn.Close()
+	go s.serveUDP(packetConn)
+
+	conn, err := net.Dial("udp", packetConn.LocalAddr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	res := exchangeTestDNS(t, conn, false, "domestic.example.com", typeIPv4)
+	require.Equal(t, rcodeSuccess, res.rcode())
+	require.Equal(t, "1.0.1.1", res.records()[0].ip.String())
+	require.Equal(t, uint32(maxDNSServerTTL/time.Second), res.answers[0].ttl)
+
+	res = exchangeTestDNS(t, conn, false, "example.com", typeIPv4)
+	require.Len(t, res.records(), 1)
+	require.Equal(t, "1.2.3.4", res.records()[0].ip.String())
+
+	res = exchangeTestDNS(t, conn, false, "example.com", typeIPv6)
+	require.Len(t, res.records(), 1)
+	require.Equal(t, "2001:db8::1", res.records()[0].ip.String())
+
+	// the proxy sees what the LAN was told.
+	require.Equal(t, "1.2.3.4", local.lookup(context.Background(), "example.com")[0].String())
+}
+
+func TestDNSServerTCP(t *testing.T) {
+	s, local, closeDoH := newTestDNSServer(t)
+	defer closeDoH()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go s.serveTCP(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		res := exchangeTestDNS(t, conn, true, "example.com", typeIPv4)
+		require.Equal(t, "1.2.3.4", res.records()[0].ip.String())
+	}
+
+	res := exchangeTestDNS(t, conn, true, "nonexistent.example.com", typeIPv4)
+	require.Equal(t, rcodeNameError, res.rcode())
+	require.Empty(t, res.answers)
+
+	// cached negative answers keep their rcode and TTL.
+	local.dnsCache.Add("typo.example.com", &answerCache{ttl: time.Minute, expiredAt: time.Now().Add(time.Minute), nameError: true})
+	res = exchangeTestDNS(t, conn, true, "typo.example.com", typeIPv4)
+	require.Equal(t, rcodeNameError, res.rcode())
+	ttl, ok := res.negativeTTL()
+	require.True(t, ok)
+	require.InDelta(t, time.Minute, ttl, float64(time.Second))
+
+	local.dnsCache.Add("nodata.example.com", &answerCache{ttl: time.Minute, expiredAt: time.Now().Add(time.Minute)})
+	res = exchangeTestDNS(t, conn, true, "nodata.example.com", typeIPv4)
+	require.Equal(t, rcodeSuccess, res.rcode())
+	require.Empty(t, res.answers)
+}
+
+func TestDNSServerOtherTypes(t *testing.T) {
+	const typeMX = 15
+	addr, closer := newTestUDPDNSServer(t)
+	defer closer()
+	domestic := &dnsOverUDP{servers: []string{addr}}
+	local := &localProxy{ipRangeDB: newChinaIPRangeDB(), dnsCache: newHostCache(10)}
+
+	// the default DoH provider only speaks JSON.
+	s := newDNSServer(local, domestic.resolve, domestic.exchange, &dnsOverHTTPS{client: http.DefaultClient})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	query := newDNSQuery("nonexistent.example.com", typeMX)
+	res := s.answer(ctx, query)
+	require.Equal(t, query.id, res.id)
+	require.Equal(t, rcodeNameError, res.rcode())
+	require.Len(t, res.authorities, 1)
+}
+
+func TestDNSServerSplitTimeout(t *testing.T) {
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		http.Error(rw, "slow", http.StatusServiceUnavailable)
+	}))
+	defer doh.Close()
+	local := &localProxy{ipRangeDB: newChinaIPRangeDB(), dnsCache: newHostCache(10)}
+	polluted := []dnsRecord{{ip: net.ParseIP("203.0.113.1").To4(), ttl: time.Hour}}
+	domestic := func(ctx context.Context, host string) ([]dnsRecord, error) {
+		return polluted, nil
+	}
+	s := newDNSServer(local, domestic, nil, &dnsOverHTTPS{client: doh.Client(), providers: []dohProvider{{URL: doh.URL}}})
+
+	// the foreign side is given up on, the domestic answer is all there is.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	records, err := s.resolveSplit(ctx, "example.com")
+	require.Nil(t, err)
+	require.Equal(t, polluted, records)
+}
+
+func TestDNSServerTruncatesUDP(t *testing.T) {
+	query := newDNSQuery("example.com", typeIPv4)
+	require.Equal(t, maxUDPDNSSize, udpSize(query))
+
+	query.additionals = []dnsResource{{name: ".", rtype: typeOPT, class: 4096}}
+	require.Equal(t, 4096, udpSize(query))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// domainList is a set of domains matched with their subdomains, like the
+// domestic domains resolved locally when the remote proxy resolves the
+// others.
+type domainList struct {
+	domains map[string]struct{}
+}
+
+// contains reports whether host is one of the domains or a subdomain of one.
+func (d *domainList) contains(host string) bool {
+	if d == nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for {
+		if _, ok := d.domains[host]; ok {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+func readDomainList(path string) (*domainList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d, err := parseDomainList(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return d, nil
+}
+
+// parseDomainList reads one domain per line, blank lines and lines starting
+// with # are ignored. dnsmasq lines like "server=/qq.com/114.114.114.114",
+// the format of the popular lists of domestic domains, are accepted too.
+func parseDomainList(reader io.Reader) (*domainList, error) {
+	d := &domainList{domains: make(map[string]struct{})}
+	scanner := bufio.NewScanner(reader)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(line, "server=/") {
+			fields := strings.Split(line, "/")
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("line %d: invalid dnsmasq line %q", n, line)
+			}
+			line = fields[1]
+		}
+		domain := strings.ToLower(strings.Trim(line, "."))
+		if domain == "" || strings.ContainsAny(domain, " \t/,") {
+			return nil, fmt.Errorf("line %d: invalid domain %q", n, line)
+		}
+		d.domains[domain] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDomainList(t *testing.T) {
+	d, err := parseDomainList(strings.NewReader(`
+# domestic domains
+qq.com
+.Baidu.com.
+server=/taobao.com/114.114.114.114
+`))
+	require.Nil(t, err)
+	require.Len(t, d.domains, 3)
+
+	require.True(t, d.contains("qq.com"))
+	require.True(t, d.contains("www.QQ.com."))
+	require.True(t, d.contains("map.baidu.com"))
+	require.True(t, d.contains("item.taobao.com"))
+	require.False(t, d.contains("fakeqq.com"))
+	require.False(t, d.contains("com"))
+	require.False(t, (*domainList)(nil).contains("qq.com"))
+
+	_, err = parseDomainList(strings.NewReader("qq.com,direct"))
+	require.NotNil(t, err)
+	_, err = parseDomainList(strings.NewReader("server=/"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	dotViaRemote = "remote"
+	dotViaDirect = "direct"
+)
+
+const (
+	defaultDoTPort = "853"
+	dotTimeout     = 5 * time.Second
+)
+
+var (
+	errDoTClosed      = errors.New("dot: connection closed")
+	errDoTPinMismatch = errors.New("dot: no certificate matches the pinned keys")
+)
+
+// dotProvider is a DNS-over-TLS server. SPKI holds the base64 SHA-256
+// digests of the public keys the server may present, RFC 7858 section 4.2;
+// when set, they are checked instead of the certificate chain. Via tells
+// whether the server is reached through the remote proxy (the default) or
+// directly.
+type dotProvider struct {
+	Addr       string   `yaml:"addr"`
+	ServerName string   `yaml:"server-name"`
+	SPKI       []string `yaml:"spki"`
+	Via        string   `yaml:"via"`
+}
+
+func (p dotProvider) validate() error {
+	if p.Addr == "" {
+		return errors.New("dot: missing addr")
+	}
+	switch p.Via {
+	case "", dotViaRemote, dotViaDirect:
+	default:
+		return fmt.Errorf("dot: %s: unknown via %q", p.Addr, p.Via)
+	}
+	for _, pin := range p.SPKI {
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("dot: %s: bad spki pin %q", p.Addr, pin)
+		}
+	}
+	return nil
+}
+
+func (p dotProvider) addr() string {
+	if _, _, err := net.SplitHostPort(p.Addr); err != nil {
+		return net.JoinHostPort(p.Addr, defaultDoTPort)
+	}
+	return p.Addr
+}
+
+type dialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+// dnsOverTLS resolves names with the first of its servers that answers.
+// Queries carry the EDNS Client Subnet clientSubnet returns.
+type dnsOverTLS struct {
+	clients      []*dotClient
+	clientSubnet subnetFunc
+}
+
+// newDNSOverTLS returns a resolver for providers. dialRemote opens a tunnel
+// through the remote proxy.
+func newDNSOverTLS(providers []dotProvider, dialRemote dialFunc) *dnsOverTLS {
+	d := &dnsOverTLS{}
+	for _, p := range providers {
+		dial := dialRemote
+		if p.Via == dotViaDirect {
+			dial = func(ctx context.Context, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+			}
+		}
+		d.clients = append(d.clients, newDoTClient(p, dial))
+	}
+	return d
+}
+
+func (d *dnsOverTLS) lookup(ctx context.Context, host string) ([]dnsRecord, error) {
+	return d.resolve(ctx, host)
+}
+
+// resolve returns the A and AAAA records of host, A records first. Both
+// queries are pipelined on the same connection.
+func (d *dnsOverTLS) resolve(ctx context.Context, host string) ([]dnsRecord, error) {
+	err := errors.New("dot: no server configured")
+	for _, c := range d.clients {
+		var records []dnsRecord
+		records, err = d.clientSubnet.resolve(host, func(subnet *net.IPNet) ([]dnsRecord, error) {
+			return resolveAddrs(host, func(host string, qtype uint16) ([]dnsRecord, error) {
+				answer, err := c.exchange(ctx, newDNSQuery(host, qtype).withClientSubnet(subnet))
+				if err != nil {
+					return nil, err
+				}
+				return answerRecords(answer)
+			})
+		})
+		if err == nil || isNegative(err) {
+			return records, err
+		}
+	}
+	return nil, err
+}
+
+// close closes the connections to the servers.
+func (d *dnsOverTLS) close() {
+	for _, c := range d.clients {
+		c.close()
+	}
+}
+
+// dotClient sends queries to one server over a single reused connection.
+// Queries don't wait for each other, answers are matched by id.
+type dotClient struct {
+	sync.Mutex
+	addr      string
+	dial      dialFunc
+	tlsConfig *tls.Config
+	conn      *dotConn
+	closed    bool
+}
+
+func newDoTClient(p dotProvider, dial dialFunc) *dotClient {
+	addr := p.addr()
+	serverName := p.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+
+	config := &tls.Config{
+		ServerName:         serverName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+	if len(p.SPKI) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range p.SPKI {
+			pins[pin] = true
+		}
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifySPKI(state.PeerCertificates, pins)
+		}
+	}
+
+	return &dotClient{
+		addr:      addr,
+		dial:      dial,
+		tlsConfig: config,
+	}
+}
+
+func verifySPKI(certs []*x509.Certificate, pins map[string]bool) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+	return errDoTPinMismatch
+}
+
+// exchange sends query and waits for its answer. A query that fails on a
+// connection that was already open is retried once on a new one, the server
+// may have closed it while idle.
+func (c *dotClient) exchange(ctx context.Context, query *dnsMessage) (*dnsMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, dotTimeout)
+	defer cancel()
+
+	conn, reused, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := conn.exchange(ctx, query)
+	if err != nil && reused && ctx.Err() == nil {
+		c.drop(conn)
+		if conn, _, err = c.connect(ctx); err != nil {
+			return nil, err
+		}
+		answer, err = conn.exchange(ctx, query)
+	}
+	if err != nil && ctx.Err() == nil {
+		// the connection failed, not just this query running out of time;
+		// the other queries on it are answered still.
+		c.drop(conn)
+	}
+	return answer, err
+}
+
+func (c *dotClient) connect(ctx context.Context) (*dotConn, bool, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil, false, errDoTClosed
+	}
+	if c.conn != nil && !c.conn.isClosed() {
+		return c.conn, true, nil
+	}
+
+	raw, err := c.dial(ctx, c.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	tlsConn := tls.Client(raw, c.tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, false, err
+	}
+	c.conn = newDoTConn(tlsConn)
+	return c.conn, false, nil
+}
+
+func (c *dotClient) drop(conn *dotConn) {
+	c.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.Unlock()
+	conn.close(errDoTClosed)
+}
+
+func (c *dotClient) close() {
+	c.Lock()
+	c.closed = true
+	conn := c.conn
+	c.conn = nil
+	c.Unlock()
+	if conn != nil {
+		conn.close(errDoTClosed)
+	}
+}
+
+// dotConn is a connection to a DoT server with the queries waiting for an
+// answer on it.
+type dotConn struct {
+	sync.Mutex
+	conn    net.Conn
+	writeMu sync.Mutex
+	pending map[uint16]chan *dnsMessage
+	err     error
+}
+
+func newDoTConn(conn net.Conn) *dotConn {
+	c := &dotConn{
+		conn:    conn,
+		pending: make(map[uint16]chan *dnsMessage),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *dotConn) isClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.err != nil
+}
+
+func (c *dotConn) exchange(ctx context.Context, query *dnsMessage) (*dnsMessage, error) {
+	ch := make(chan *dnsMessage, 1)
+	c.Lock()
+	if err := c.err; err != nil {
+		c.Unlock()
+		return nil, err
+	}
+	// a new id for every query on the connection, the caller's is restored
+	// in the answer.
+	id := query.id
+	for _, ok := c.pending[id]; ok; _, ok = c.pending[id] {
+		id++
+	}
+	c.pending[id] = ch
+	c.Unlock()
+
+	defer func() {
+		c.Lock()
+		delete(c.pending, id)
+		c.Unlock()
+	}()
+
+	callerID := query.id
+	query.id = id
+	msg, err := query.pack()
+	query.id = callerID
+	if err != nil {
+		return nil, err
+	}
+
+	c.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	_, err = c.conn.Write(append(appendUint16(nil, uint16(len(msg))), msg...))
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	select {
+	case answer, ok := <-ch:
+		if !ok {
+			return nil, errDoTClosed
+		}
+		answer.id = callerID
+		return answer, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *dotConn) readLoop() {
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(c.conn, length[:]); err != nil {
+			c.close(err)
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(c.conn, msg); err != nil {
+			c.close(err)
+			return
+		}
+
+		answer, err := unpackDNSMessage(msg)
+		if err != nil {
+			continue
+		}
+		c.Lock()
+		if ch, ok := c.pending[answer.id]; ok {
+			delete(c.pending, answer.id)
+			ch <- answer
+		}
+		c.Unlock()
+	}
+}
+
+// close fails every pending query.
+func (c *dotConn) close(err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
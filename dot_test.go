@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDoTServer answers example.com like newTestDoHServer. Queries are
+// read two at a time and answered in reverse order, so only a client matching
+// answers by id gets them right. It returns the pin of its key and the number
+// of connections accepted.
+func newTestDoTServer(t *testing.T) (net.Listener, string, *int32) {
+	cert := httptest.NewUnstartedServer(http.NotFoundHandler())
+	cert.StartTLS()
+	config := cert.TLS.Clone()
+	sum := sha256.Sum256(cert.Certificate().RawSubjectPublicKeyInfo)
+	cert.Close()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.Nil(t, err)
+
+	var accepted int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go serveTestDoTConn(conn)
+		}
+	}()
+	return listener, base64.StdEncoding.EncodeToString(sum[:]), &accepted
+}
+
+func serveTestDoTConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var answers [][]byte
+		for i := 0; i < 2; i++ {
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, msg); err != nil {
+				return
+			}
+			query, err := unpackDNSMessage(msg)
+			if err != nil {
+				return
+			}
+
+			q := query.questions[0]
+			res := &dnsMessage{id: query.id, flags: dnsFlagResponse, questions: query.questions}
+			if q.name == "example.com." {
+				data := net.ParseIP("1.2.3.4").To4()
+				if q.qtype == typeIPv6 {
+					data = net.ParseIP("2001:db8::1")
+				}
+				res.answers = []dnsResource{{name: q.name, rtype: q.qtype, class: classINET, ttl: 60, data: data}}
+			} else {
+				res.flags |= rcodeNameError
+			}
+			b, _ := res.pack()
+			answers = append(answers, append(appendUint16(nil, uint16(len(b))), b...))
+		}
+		for i := len(answers) - 1; i >= 0; i-- {
+			if _, err := conn.Write(answers[i]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	listener, pin, accepted := newTestDoTServer(t)
+	defer listener.Close()
+
+	var tunnelled int32
+	dialRemote := func(ctx context.Context, addr string) (net.Conn, error) {
+		atomic.AddInt32(&tunnelled, 1)
+		return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	d := newDNSOverTLS([]dotProvider{{Addr: listener.Addr().String(), SPKI: []string{pin}}}, dialRemote)
+	defer d.close()
+
+	want := []dnsRecord{
+		{ip: net.ParseIP("1.2.3.4").To4(), ttl: time.Minute},
+		{ip: net.ParseIP("2001:db8::1"), ttl: time.Minute},
+	}
+	for i := 0; i < 3; i++ {
+		records, err := d.resolve(context.Background(), "example.com")
+		require.Nil(t, err)
+		require.Equal(t, want, records)
+	}
+	records, err := d.resolve(context.Background(), "nonexistent.example")
+	require.Equal(t, &negativeAnswer{nameError: true}, err)
+	require.Empty(t, records)
+
+	records, _ = d.lookup(context.Background(), "example.com")
+	require.Equal(t, "1.2.3.4", records[0].ip.String())
+
+	require.Equal(t, int32(1), atomic.LoadInt32(accepted))
+	require.Equal(t, int32(1), atomic.LoadInt32(&tunnelled))
+}
+
+func TestDoTClientQueryTimeout(t *testing.T) {
+	listener, pin, accepted := newTestDoTServer(t)
+	defer listener.Close()
+
+	d := newDNSOverTLS([]dotProvider{{Addr: listener.Addr().String(), SPKI: []string{pin}, Via: dotViaDirect}}, nil)
+	defer d.close()
+	c := d.clients[0]
+
+	// the server waits for a second query before answering the first.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := c.exchange(ctx, newDNSQuery("example.com", typeIPv4))
+	require.NotNil(t, err)
+
+	answer, err := c.exchange(context.Background(), newDNSQuery("example.com", typeIPv6))
+	require.Nil(t, err)
+	require.Equal(t, "2001:db8::1", answer.records()[0].ip.String())
+	require.Equal(t, int32(1), atomic.LoadInt32(accepted))
+}
+
+func TestDNSOverTLSDirect(t *testing.T) {
+	listener, pin, _ := newTestDoTServer(t)
+	defer listener.Close()
+
+	dialRemote := func(ctx context.Context, addr string) (net.Conn, error) {
+		t.Fatal("direct server dialled through the remote proxy")
+		return nil, nil
+	}
+	d := newDNSOverTLS([]dotProvider{{Addr: listener.Addr().String(), SPKI: []string{pin}, Via: dotViaDirect}}, dialRemote)
+	defer d.close()
+
+	records, _ := d.lookup(context.Background(), "example.com")
+	require.Equal(t, "1.2.3.4", records[0].ip.String())
+}
+
+func TestDNSOverTLSPinMismatch(t *testing.T) {
+	listener, pin, _ := newTestDoTServer(t)
+	defer listener.Close()
+
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	sum := sha256.Sum256([]byte(pin))
+	d := newDNSOverTLS([]dotProvider{{
+		Addr: listener.Addr().String(),
+		SPKI: []string{base64.StdEncoding.EncodeToString(sum[:])},
+	}}, dial)
+	defer d.close()
+
+	_, err := d.resolve(context.Background(), "example.com")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), errDoTPinMismatch.Error())
+
+	// without pins the chain is verified, and the test certificate isn't
+	// trusted.
+	d = newDNSOverTLS([]dotProvider{{Addr: listener.Addr().String()}}, dial)
+	defer d.close()
+	_, err = d.resolve(context.Background(), "example.com")
+	require.NotNil(t, err)
+}
+
+func TestDoTProviderValidate(t *testing.T) {
+	require.Nil(t, dotProvider{Addr: "1.1.1.1"}.validate())
+	require.Equal(t, "1.1.1.1:853", dotProvider{Addr: "1.1.1.1"}.addr())
+	require.NotNil(t, dotProvider{}.validate())
+	require.NotNil(t, dotProvider{Addr: "1.1.1.1", Via: "proxy"}.validate())
+	require.NotNil(t, dotProvider{Addr: "1.1.1.1", SPKI: []string{"abc"}}.validate())
+}
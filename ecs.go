@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	clientSubnetAuto = "auto"
+	// publicIPURL answers with the public IPv4 address of the client, as
+	// plain text.
+	publicIPURL = "https://4.ipw.cn"
+	// auto-detected subnets are as wide as RFC 7871 section 11.1 recommends.
+	clientSubnetIPv4Bits = 24
+	clientSubnetIPv6Bits = 56
+	publicIPTimeout      = 10 * time.Second
+)
+
+// subnetFunc returns the client subnet to send along with the queries for
+// host, nil for none. When direct isn't nil, the answer is kept only if
+// direct reports it is reached directly.
+type subnetFunc func(host string) (subnet *net.IPNet, direct func(records []dnsRecord) bool)
+
+// resolve resolves host with the client subnet f returns for it. An answer
+// not reached directly after all is dropped and host is resolved again
+// without the subnet, for the remote proxy that reaches it.
+func (f subnetFunc) resolve(host string, resolve func(subnet *net.IPNet) ([]dnsRecord, error)) ([]dnsRecord, error) {
+	if f == nil {
+		return resolve(nil)
+	}
+	subnet, direct := f(host)
+	records, err := resolve(subnet)
+	if subnet != nil && direct != nil && err == nil && !direct(records) {
+		return resolve(nil)
+	}
+	return records, err
+}
+
+// parseClientSubnet parses a subnet in CIDR notation, or a single address
+// standing for its /24 or /56.
+func parseClientSubnet(s string) (*net.IPNet, error) {
+	if _, subnet, err := net.ParseCIDR(s); err == nil {
+		return subnet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("bad client subnet %q", s)
+	}
+	return publicSubnet(ip), nil
+}
+
+// publicSubnet returns the subnet of ip sent when the subnet is detected.
+func publicSubnet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(clientSubnetIPv4Bits, 8*net.IPv4len)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(clientSubnetIPv6Bits, 8*net.IPv6len)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// detectClientSubnet asks url for the public address of this host, over a
+// direct connection since the remote proxy's address would be of no use.
+func detectClientSubnet(ctx context.Context, url string) (*net.IPNet, error) {
+	ctx, cancel := context.WithTimeout(ctx, publicIPTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: &http.Transport{}}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("detect public address: %s: %s", url, res.Status)
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(res.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(buf)))
+	if ip == nil {
+		return nil, fmt.Errorf("detect public address: %s: unexpected answer %q", url, buf)
+	}
+	return publicSubnet(ip), nil
+}
+
+// setClientSubnet applies the client-subnet setting of the config file: a
+// subnet, "auto" to detect it with refreshClientSubnet, or "" for none.
+func (l *localProxy) setClientSubnet(setting string) error {
+	var subnet *net.IPNet
+	if setting != "" && setting != clientSubnetAuto {
+		var err error
+		if subnet, err = parseClientSubnet(setting); err != nil {
+			return err
+		}
+	}
+	l.Lock()
+	defer l.Unlock()
+	if setting != l.clientSubnetSetting || setting != clientSubnetAuto {
+		l.clientSubnet = subnet
+	}
+	l.clientSubnetSetting = setting
+	return nil
+}
+
+// refreshClientSubnet detects the subnet of the public address again when
+// it is set to "auto". The subnet last detected is kept when that fails.
+func (l *localProxy) refreshClientSubnet(ctx context.Context) error {
+	l.RLock()
+	setting := l.clientSubnetSetting
+	l.RUnlock()
+	if setting != clientSubnetAuto {
+		return nil
+	}
+
+	subnet, err := detectClientSubnet(ctx, publicIPURL)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	if l.clientSubnetSetting == clientSubnetAuto {
+		l.clientSubnet = subnet
+	}
+	l.Unlock()
+	return nil
+}
+
+// subnetFor returns the client subnet to send along with the queries for
+// host. It is sent for hosts known to be reached directly, those of a direct
+// rule and the domestic domains, and for hosts whose route depends on their
+// addresses, with a check that the answer is reached directly. Hosts known
+// to go through the remote proxy get no subnet, their answers had better be
+// close to it.
+func (l *localProxy) subnetFor(host string) (*net.IPNet, func(records []dnsRecord) bool) {
+	l.RLock()
+	subnet, rules, autoCrossFirewall := l.clientSubnet, l.rules, l.autoCrossFirewall
+	domesticDomains := l.domesticDomains
+	l.RUnlock()
+	if subnet == nil {
+		return nil, nil
+	}
+
+	needsIPs := false
+	action, ok := rules.match(host, "", func() []net.IP {
+		needsIPs = true
+		return nil
+	})
+	switch {
+	case ok && !needsIPs:
+		if action == actionDirect {
+			return subnet, nil
+		}
+		return nil, nil
+	case autoCrossFirewall && domesticDomains.contains(host):
+		return subnet, nil
+	case needsIPs || autoCrossFirewall:
+		return subnet, func(records []dnsRecord) bool {
+			return l.routesDirect(host, records, rules, autoCrossFirewall)
+		}
+	}
+	return nil, nil
+}
+
+// routesDirect reports whether host is reached directly when it resolves to
+// records, as route decides it.
+func (l *localProxy) routesDirect(host string, records []dnsRecord, rules *ruleSet, autoCrossFirewall bool) bool {
+	ips := make([]net.IP, len(records))
+	for i, r := range records {
+		ips[i] = r.ip
+	}
+	if action, ok := rules.match(host, "", func() []net.IP { return ips }); ok {
+		return action == actionDirect
+	}
+	if !autoCrossFirewall {
+		return false
+	}
+	for _, ip := range ips {
+		if l.isDirect(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithClientSubnet(t *testing.T) {
+	for _, c := range []struct {
+		subnet string
+		data   []byte
+	}{
+		{"1.2.3.0/24", []byte{0, 8, 0, 7, 0, 1, 24, 0, 1, 2, 3}},
+		{"1.2.3.128/25", []byte{0, 8, 0, 8, 0, 1, 25, 0, 1, 2, 3, 128}},
+		{"2001:db8:1:100::/56", []byte{0, 8, 0, 11, 0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 1, 1}},
+	} {
+		_, subnet, _ := net.ParseCIDR(c.subnet)
+		msg, err := newDNSQuery("example.com", typeIPv4).withClientSubnet(subnet).pack()
+		require.Nil(t, err)
+		query, err := unpackDNSMessage(msg)
+		require.Nil(t, err)
+		require.Len(t, query.additionals, 1)
+		opt := query.additionals[0]
+		require.Equal(t, uint16(typeOPT), opt.rtype)
+		require.Equal(t, uint16(dnsUDPBufferSize), opt.class)
+		require.Equal(t, c.data, opt.data)
+	}
+
+	require.Empty(t, newDNSQuery("example.com", typeIPv4).withClientSubnet(nil).additionals)
+}
+
+func TestParseClientSubnet(t *testing.T) {
+	for s, want := range map[string]string{
+		"1.2.3.4":       "1.2.3.0/24",
+		"1.2.3.128/25":  "1.2.3.128/25",
+		"2001:db8::1":   "2001:db8::/56",
+		"2001:db8::/48": "2001:db8::/48",
+	} {
+		subnet, err := parseClientSubnet(s)
+		require.Nil(t, err)
+		require.Equal(t, want, subnet.String())
+	}
+	_, err := parseClientSubnet("auto")
+	require.NotNil(t, err)
+}
+
+func TestDetectClientSubnet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("203.0.113.7\n"))
+	}))
+	defer server.Close()
+
+	subnet, err := detectClientSubnet(context.Background(), server.URL)
+	require.Nil(t, err)
+	require.Equal(t, "203.0.113.0/24", subnet.String())
+
+	server.Config.Handler = http.NotFoundHandler()
+	_, err = detectClientSubnet(context.Background(), server.URL)
+	require.NotNil(t, err)
+}
+
+func TestSubnetFor(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(strings.Join([]string{
+		"DOMAIN-SUFFIX,google.com,remote",
+		"DOMAIN-SUFFIX,qq.com,direct",
+		"IP-CIDR,17.0.0.0/8,remote",
+		"DOMAIN,cdn.example.org,remote",
+	}, "\n")))
+	require.Nil(t, err)
+	domestic, _ := parseDomainList(strings.NewReader("example.cn"))
+	local := &localProxy{rules: rules, autoCrossFirewall: true, ipRangeDB: newChinaIPRangeDB()}
+	require.Nil(t, local.setClientSubnet("1.2.3.4"))
+	records := func(ip string) []dnsRecord {
+		return []dnsRecord{{ip: net.ParseIP(ip).To4(), ttl: time.Minute}}
+	}
+
+	subnet, direct := local.subnetFor("www.google.com")
+	require.Nil(t, subnet)
+	subnet, direct = local.subnetFor("www.qq.com")
+	require.Equal(t, "1.2.3.0/24", subnet.String())
+	require.Nil(t, direct)
+
+	// the route of other hosts depends on the answer, which must be direct
+	// to be kept.
+	subnet, direct = local.subnetFor("www.example.com")
+	require.NotNil(t, subnet)
+	require.True(t, direct(records("1.0.1.1")))
+	require.False(t, direct(records("8.8.8.8")))
+	// IP-CIDR rules are reached before cdn.example.org would match.
+	subnet, direct = local.subnetFor("cdn.example.org")
+	require.NotNil(t, subnet)
+	require.False(t, direct(records("1.0.1.1")))
+	require.False(t, direct(records("17.0.0.1")))
+
+	local.setRemoteDNS(remoteDNSList, domestic)
+	subnet, direct = local.subnetFor("www.example.cn")
+	require.NotNil(t, subnet)
+	require.Nil(t, direct)
+
+	// without auto-cross-firewall only rules send hosts direct.
+	local.setRemoteDNS("", nil)
+	local.rules = nil
+	local.autoCrossFirewall = false
+	subnet, _ = local.subnetFor("www.example.com")
+	require.Nil(t, subnet)
+
+	local.autoCrossFirewall = true
+	require.Nil(t, local.setClientSubnet(""))
+	subnet, _ = local.subnetFor("www.example.com")
+	require.Nil(t, subnet)
+	require.Nil(t, local.setClientSubnet(clientSubnetAuto))
+	subnet, _ = local.subnetFor("www.example.com")
+	require.Nil(t, subnet)
+	require.NotNil(t, local.setClientSubnet("bad"))
+}
+
+func TestDNSOverHTTPSClientSubnet(t *testing.T) {
+	var mu sync.Mutex
+	var subnets []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/resolve" {
+			mu.Lock()
+			subnets = append(subnets, req.URL.Query().Get("edns_client_subnet"))
+			mu.Unlock()
+			json.NewEncoder(rw).Encode(&response{})
+			return
+		}
+		msg, _ := base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		query, err := unpackDNSMessage(msg)
+		require.Nil(t, err)
+		subnet := ""
+		if len(query.additionals) > 0 {
+			subnet = base64.StdEncoding.EncodeToString(query.additionals[0].data)
+		}
+		mu.Lock()
+		subnets = append(subnets, subnet)
+		mu.Unlock()
+		res := &dnsMessage{flags: dnsFlagResponse, questions: query.questions}
+		b, _ := res.pack()
+		rw.Header().Set("Content-Type", dohMediaType)
+		rw.Write(b)
+	}))
+	defer server.Close()
+
+	_, subnet, _ := net.ParseCIDR("1.2.3.0/24")
+	d := &dnsOverHTTPS{client: server.Client()}
+	for _, p := range []dohProvider{
+		{URL: server.URL + "/dns-query"},
+		{URL: server.URL + "/resolve", Format: dohFormatJSON},
+	} {
+		subnets = nil
+		d.query(context.Background(), p, "example.com", typeIPv4, subnet)
+		d.query(context.Background(), p, "example.com", typeIPv4, nil)
+		require.Len(t, subnets, 2)
+		require.NotEmpty(t, subnets[0])
+		require.Empty(t, subnets[1])
+	}
+	require.Equal(t, "1.2.3.0/24", subnets[0])
+
+	// answers not reached directly are asked again without the subnet.
+	for _, direct := range []bool{true, false} {
+		direct := direct
+		d.clientSubnet = func(host string) (*net.IPNet, func([]dnsRecord) bool) {
+			return subnet, func([]dnsRecord) bool { return direct }
+		}
+		subnets = nil
+		d.resolveWith(context.Background(), dohProvider{URL: server.URL + "/resolve", Format: dohFormatJSON}, "example.com")
+		if direct {
+			require.Equal(t, []string{"1.2.3.0/24", "1.2.3.0/24"}, subnets)
+		} else {
+			require.Equal(t, []string{"1.2.3.0/24", "1.2.3.0/24", "", ""}, subnets)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDirectCountries = "CN"
+	defaultRIRs            = "apnic"
+)
+
+// rirStats are the delegated-stats files of the regional internet
+// registries, each listing the address blocks it gave out and their country.
+var rirStats = map[string]string{
+	"apnic":   "http://ftp.apnic.net/apnic/stats/apnic/delegated-apnic-latest",
+	"arin":    "https://ftp.arin.net/pub/stats/arin/delegated-arin-extended-latest",
+	"ripencc": "https://ftp.ripe.net/pub/stats/ripencc/delegated-ripencc-latest",
+	"lacnic":  "https://ftp.lacnic.net/pub/stats/lacnic/delegated-lacnic-latest",
+	"afrinic": "https://ftp.afrinic.net/pub/stats/afrinic/delegated-afrinic-latest",
+}
+
+// parseCountries parses a comma separated list of ISO 3166 country codes.
+func parseCountries(s string) (map[string]bool, error) {
+	countries := make(map[string]bool)
+	for _, code := range strings.Split(s, ",") {
+		code, err := parseCountry(strings.TrimSpace(code))
+		if err != nil {
+			return nil, err
+		}
+		countries[code] = true
+	}
+	return countries, nil
+}
+
+// parseCountry parses an ISO 3166 country code.
+func parseCountry(s string) (string, error) {
+	code := strings.ToUpper(s)
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+		return "", fmt.Errorf("bad country code %q", code)
+	}
+	return code, nil
+}
+
+// parseRIRs parses a comma separated list of registries of rirStats.
+func parseRIRs(s string) ([]string, error) {
+	var rirs []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := rirStats[name]; !ok {
+			return nil, fmt.Errorf("unknown registry %q", name)
+		}
+		rirs = append(rirs, name)
+	}
+	return rirs, nil
+}
+
+// sortedCountries returns the codes of countries in order.
+func sortedCountries(countries map[string]bool) []string {
+	var codes []string
+	for code := range countries {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// parseDelegatedStats reads an RIR delegated-stats file and returns the IPv4
+// and IPv6 blocks of the countries given, along with the version of the
+// file: its registry and serial. A file having fewer records than its
+// header tells was cut short and is an error.
+func parseDelegatedStats(ctx context.Context, r io.Reader, countries map[string]bool) ([]*ipRange, string, error) {
+	reader := bufio.NewReader(r)
+	var line []byte
+	var err error
+	var db []*ipRange
+	var version string
+	declared, records := -1, 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		default:
+		}
+
+		if line, _, err = reader.ReadLine(); err != nil && err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		// records are "registry|cc|type|start|value|date|status", extended
+		// files add fields after them.
+		parts := strings.Split(string(line), "|")
+		if len(parts) < 7 {
+			continue
+		}
+
+		// the header is "version|registry|serial|records|startdate|enddate|UTCoffset",
+		// its version is a number like 2 or 2.3.
+		if _, err := strconv.ParseFloat(parts[0], 64); err == nil && version == "" {
+			version = parts[1] + "-" + parts[2]
+			if n, err := strconv.Atoi(parts[3]); err == nil {
+				declared = n
+			}
+			continue
+		}
+		records++
+
+		cc, typ, start, value, status := parts[1], parts[2], parts[3], parts[4], parts[6]
+		if !(countries[cc] && (typ == "ipv4" || typ == "ipv6")) {
+			continue
+		}
+		if status != "allocated" && status != "assigned" {
+			continue
+		}
+		ip := net.ParseIP(start)
+		if ip == nil {
+			return nil, "", fmt.Errorf("bad start address %q", start)
+		}
+
+		// the value of an ipv4 record is its count of addresses, which needn't
+		// be a power of two, that of an ipv6 one its prefix length.
+		var r string
+		if typ == "ipv4" {
+			if r, err = ipv4Block(ip, value); err != nil {
+				return nil, "", err
+			}
+		} else {
+			prefixLength, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, "", err
+			}
+			r = fmt.Sprintf("%s/%d", start, prefixLength)
+		}
+
+		db = append(db, &ipRange{value: r, country: cc})
+	}
+	if records < declared {
+		return nil, "", fmt.Errorf("truncated: %d of %d records", records, declared)
+	}
+	return db, version, nil
+}
+
+// ipv4Block returns the block of count addresses from start: a CIDR when
+// they make one, an interval "start-end" otherwise.
+func ipv4Block(start net.IP, count string) (string, error) {
+	ip := start.To4()
+	if ip == nil {
+		return "", fmt.Errorf("bad ipv4 start address %q", start)
+	}
+	n, err := strconv.ParseUint(count, 10, 64)
+	if err != nil || n == 0 {
+		return "", fmt.Errorf("bad count of addresses %q", count)
+	}
+	first := uint64(binary.BigEndian.Uint32(ip))
+	if first+n-1 > math.MaxUint32 {
+		return "", fmt.Errorf("%s plus %d addresses is out of range", ip, n)
+	}
+
+	if n&(n-1) == 0 && first&(n-1) == 0 {
+		return fmt.Sprintf("%s/%d", ip, 32-bits.TrailingZeros64(n)), nil
+	}
+	last := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(last, uint32(first+n-1))
+	return fmt.Sprintf("%s-%s", ip, last), nil
+}
+
+// setIPRangeSources sets the sources of the IP ranges and which countries
+// are reached directly. It reports whether that changed, the ranges then
+// need to be pulled again.
+func (l *localProxy) setIPRangeSources(countries map[string]bool, sources []ipRangeSource) bool {
+	l.Lock()
+	changed := strings.Join(sortedCountries(countries), ",") != strings.Join(sortedCountries(l.directCountries), ",") ||
+		fmt.Sprint(sources) != fmt.Sprint(l.ipRangeSources)
+	l.directCountries = countries
+	l.ipRangeSources = sources
+	pac := l.pac
+	l.Unlock()
+	if changed && pac != nil {
+		pac.invalidate()
+	}
+	return changed
+}
+
+// ipRangeSettings returns the direct countries and the sources of the IP
+// ranges, the defaults when they aren't set.
+func (l *localProxy) ipRangeSettings() (map[string]bool, []ipRangeSource) {
+	l.RLock()
+	countries, sources := l.directCountries, l.ipRangeSources
+	l.RUnlock()
+	if countries == nil {
+		countries = map[string]bool{defaultDirectCountries: true}
+	}
+	if len(sources) == 0 {
+		sources = defaultIPRangeSources([]string{defaultRIRs}, "")
+	}
+	return countries, sources
+}
+
+// isDirect reports whether ip is reached directly: it is private or in one
+// of the direct countries.
+func (l *localProxy) isDirect(ip net.IP) bool {
+	if privateIPRange.contains(ip) {
+		return true
+	}
+	country, ok := l.ipRangeDB.lookup(ip)
+	return ok && l.isDirectCountry(country)
+}
+
+// isDirectCountry reports whether addresses in country are reached directly.
+func (l *localProxy) isDirectCountry(country string) bool {
+	l.RLock()
+	countries := l.directCountries
+	l.RUnlock()
+	if country == "" {
+		// the private ranges, and cidr lists without a country.
+		return true
+	}
+	if countries == nil {
+		return country == defaultDirectCountries
+	}
+	return countries[country]
+}
+
+// pullLatestIPRange replaces the IP ranges with those of every source merged,
+// later sources winning where they overlap. A source that fails keeps the
+// ranges it last had, the ranges are left as they are when it never had any.
+// Ranges are cached in ipRangeCacheFile, and downloaded again only when they
+// changed.
+func (l *localProxy) pullLatestIPRange(ctx context.Context) error {
+	countries, sources := l.ipRangeSettings()
+	l.RLock()
+	cache, cacheFile := l.ipRangeCache, l.ipRangeCacheFile
+	l.RUnlock()
+	if !cache.matches(countries) {
+		cache = nil
+	}
+
+	next := &ipRangeCache{Format: ipRangeCacheFormat, Countries: sortedCountries(countries), Sources: make(map[string]*cachedIPRanges)}
+	statuses := make(map[string]*ipRangeSourceStatus)
+	var db []*ipRange
+	var versions, errs []string
+	missing := false
+	for _, s := range sources {
+		var cached *cachedIPRanges
+		if cache != nil {
+			cached = cache.Sources[s.cacheKey()]
+		}
+		fetched, err := l.fetchIPRanges(ctx, s, countries, cached)
+		if err != nil {
+			errs = append(errs, err.Error())
+			statuses[s.URL] = newIPRangeSourceStatus(s, cached, err)
+			if cached == nil {
+				missing = true
+				continue
+			}
+			fetched = cached
+		} else {
+			statuses[s.URL] = newIPRangeSourceStatus(s, fetched, nil)
+		}
+		next.Sources[s.cacheKey()] = fetched
+		db = append(db, fetched.ipRanges()...)
+		if fetched.Version != "" {
+			versions = append(versions, fetched.Version)
+		}
+	}
+
+	l.Lock()
+	l.ipRangeStatus = statuses
+	l.Unlock()
+	if missing {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	if len(db) == 0 {
+		return errors.New("empty ip range db")
+	}
+
+	l.ipRangeDB.replace(db, strings.Join(versions, ","), time.Now())
+
+	l.Lock()
+	pac := l.pac
+	l.ipRangeCache = next
+	l.Unlock()
+	if pac != nil {
+		pac.invalidate()
+	}
+	if cacheFile != "" {
+		if err := saveIPRangeCache(cacheFile, next); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDelegatedStats(t *testing.T) {
+	stats := `# comment
+2|apnic|20200901|7|19830613|20200831|+1000
+apnic|*|asn|*|9876|summary
+apnic|*|ipv4|*|45678|summary
+apnic|CN|ipv4|1.0.1.0|256|20110414|allocated
+apnic|CN|ipv4|1.0.2.0|512|20110414|allocated
+apnic|HK|ipv4|1.1.0.0|65536|20110414|assigned
+apnic|JP|ipv4|1.0.16.0|4096|20110412|allocated
+apnic|CN|asn|4134|1|20020801|allocated
+apnic|CN|ipv6|2001:da8::|32|20020531|allocated|A9184C2D|e-stats
+apnic|CN|ipv4|1.2.0.0|256|20110414|reserved
+`
+	ranges, version, err := parseDelegatedStats(context.Background(), strings.NewReader(stats), map[string]bool{"CN": true, "HK": true})
+	require.Nil(t, err)
+	require.Equal(t, "apnic-20200901", version)
+	require.Equal(t, []*ipRange{
+		{value: "1.0.1.0/24", country: "CN"},
+		{value: "1.0.2.0/23", country: "CN"},
+		{value: "1.1.0.0/16", country: "HK"},
+		{value: "2001:da8::/32", country: "CN"},
+	}, ranges)
+
+	_, _, err = parseDelegatedStats(context.Background(), strings.NewReader("apnic|CN|ipv4|1.0.x.0|256|20110414|allocated\n"), map[string]bool{"CN": true})
+	require.NotNil(t, err)
+
+	_, _, err = parseDelegatedStats(context.Background(), strings.NewReader(strings.Replace(stats, "|7|", "|8|", 1)), map[string]bool{"CN": true})
+	require.NotNil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = parseDelegatedStats(ctx, strings.NewReader(stats), map[string]bool{"CN": true})
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestParseCountries(t *testing.T) {
+	countries, err := parseCountries("cn, HK,mo")
+	require.Nil(t, err)
+	require.Equal(t, map[string]bool{"CN": true, "HK": true, "MO": true}, countries)
+	require.Equal(t, []string{"CN", "HK", "MO"}, sortedCountries(countries))
+
+	for _, s := range []string{"", "CHN", "C1", "CN,"} {
+		_, err = parseCountries(s)
+		require.NotNil(t, err, s)
+	}
+
+	rirs, err := parseRIRs("apnic, RIPENCC")
+	require.Nil(t, err)
+	require.Equal(t, []string{"apnic", "ripencc"}, rirs)
+	_, err = parseRIRs("apnic,iana")
+	require.NotNil(t, err)
+}
+
+func TestIsDirect(t *testing.T) {
+	local := &localProxy{ipRangeDB: &IPRangeDB{}}
+	local.ipRangeDB.replace([]*ipRange{
+		{value: "1.0.1.0/24", country: "CN"},
+		{value: "1.1.0.0/16", country: "HK"},
+	}, "test", time.Now())
+
+	require.True(t, local.isDirect(net.ParseIP("1.0.1.1")))
+	require.False(t, local.isDirect(net.ParseIP("1.1.1.1")))
+	require.True(t, local.isDirect(net.ParseIP("192.168.1.1")))
+	require.False(t, local.isDirect(net.ParseIP("8.8.8.8")))
+
+	sources := defaultIPRangeSources([]string{"apnic"}, "")
+	require.True(t, local.setIPRangeSources(map[string]bool{"HK": true}, sources))
+	require.False(t, local.setIPRangeSources(map[string]bool{"HK": true}, sources))
+	require.True(t, local.setIPRangeSources(map[string]bool{"HK": true}, defaultIPRangeSources([]string{"apnic", "arin"}, "")))
+	require.False(t, local.isDirect(net.ParseIP("1.0.1.1")))
+	require.True(t, local.isDirect(net.ParseIP("1.1.1.1")))
+}
+
+func TestPullIPRangeFromMMDB(t *testing.T) {
+	db := newTestMMDB(6)
+	db.insert("1.2.3.0/24", "country", "CN")
+	db.insert("5.6.0.0/16", "country", "HK")
+	db.insert("2001:da8::/32", "country", "CN")
+
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "country.mmdb")
+	require.Nil(t, ioutil.WriteFile(path, db.build(24), 0644))
+
+	local := &localProxy{ipRangeDB: &IPRangeDB{}}
+	sources := defaultIPRangeSources(nil, path)
+	local.setIPRangeSources(map[string]bool{"HK": true}, sources)
+	require.Nil(t, local.pullLatestIPRange(context.Background()))
+	require.Equal(t, 1, local.ipRangeDB.Len())
+	require.True(t, local.isDirect(net.ParseIP("5.6.7.8")))
+	require.False(t, local.isDirect(net.ParseIP("1.2.3.4")))
+
+	local.setIPRangeSources(map[string]bool{"JP": true}, sources)
+	require.NotNil(t, local.pullLatestIPRange(context.Background()))
+	require.Equal(t, 1, local.ipRangeDB.Len())
+}
+
+// TestDelegatedStatsCounts covers IPv4 records whose count of addresses
+// isn't a power of two or whose start isn't aligned on it, as legacy and
+// merged allocations are, which rounding the count to a prefix got wrong.
+func TestDelegatedStatsCounts(t *testing.T) {
+	for _, c := range []struct {
+		start, count string
+		value        string
+		in, out      []string
+	}{
+		{"1.0.1.0", "256", "1.0.1.0/24", []string{"1.0.1.0", "1.0.1.255"}, []string{"1.0.0.255", "1.0.2.0"}},
+		{"1.0.2.0", "512", "1.0.2.0/23", []string{"1.0.3.255"}, []string{"1.0.4.0"}},
+		{"1.0.2.0", "768", "1.0.2.0-1.0.4.255", []string{"1.0.4.255"}, []string{"1.0.5.0", "1.0.1.255"}},
+		{"1.0.4.0", "1280", "1.0.4.0-1.0.8.255", []string{"1.0.8.255"}, []string{"1.0.9.0"}},
+		{"1.0.8.0", "3072", "1.0.8.0-1.0.19.255", []string{"1.0.19.255"}, []string{"1.0.20.0"}},
+		{"1.0.32.0", "24576", "1.0.32.0-1.0.127.255", []string{"1.0.127.255"}, []string{"1.0.128.0"}},
+		{"1.1.1.0", "512", "1.1.1.0-1.1.2.255", []string{"1.1.1.0", "1.1.2.255"}, []string{"1.1.0.255", "1.1.3.0"}},
+		{"1.2.3.4", "1", "1.2.3.4/32", []string{"1.2.3.4"}, []string{"1.2.3.5"}},
+		{"255.255.255.0", "256", "255.255.255.0/24", []string{"255.255.255.255"}, []string{"255.255.254.255"}},
+		{"0.0.0.0", "4294967296", "0.0.0.0/0", []string{"255.255.255.255"}, nil},
+	} {
+		line := "apnic|CN|ipv4|" + c.start + "|" + c.count + "|20110414|allocated\n"
+		ranges, _, err := parseDelegatedStats(context.Background(), strings.NewReader(line), map[string]bool{"CN": true})
+		require.Nil(t, err, line)
+		require.Equal(t, []*ipRange{{value: c.value, country: "CN"}}, ranges, line)
+
+		db := &IPRangeDB{}
+		db.replace(ranges, "test", time.Now())
+		for _, ip := range c.in {
+			require.True(t, db.contains(net.ParseIP(ip)), line+ip)
+		}
+		for _, ip := range c.out {
+			require.False(t, db.contains(net.ParseIP(ip)), line+ip)
+		}
+	}
+
+	for _, count := range []string{"0", "-256", "many", "257"} {
+		start := "1.0.1.0"
+		if count == "257" {
+			start = "255.255.255.0"
+		}
+		line := "apnic|CN|ipv4|" + start + "|" + count + "|20110414|allocated\n"
+		_, _, err := parseDelegatedStats(context.Background(), strings.NewReader(line), map[string]bool{"CN": true})
+		require.NotNil(t, err, line)
+	}
+	_, _, err := parseDelegatedStats(context.Background(), strings.NewReader("apnic|CN|ipv4|2001:db8::|256|20110414|allocated\n"), map[string]bool{"CN": true})
+	require.NotNil(t, err)
+}
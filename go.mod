@@ -10,4 +10,5 @@ require (
 	github.com/sevlyar/go-daemon v0.1.5
 	github.com/stretchr/testify v1.5.1
 	golang.org/x/sys v0.0.0-20180909124046-d0be0721c37e // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	familyIPv6 = "ipv6"
+	familyIPv4 = "ipv4"
+)
+
+const (
+	// connectionAttemptDelay is the delay between connection attempts
+	// recommended by RFC 8305 section 8.
+	connectionAttemptDelay = 250 * time.Millisecond
+)
+
+var errNoAddress = errors.New("no address to dial")
+
+// sortAddrs orders ips for connection attempts as RFC 8305 section 4 does:
+// the families alternate, the preferred one first.
+func sortAddrs(ips []net.IP, preferFamily string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	if preferFamily == familyIPv4 {
+		first, second = v4, v6
+	}
+
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// dialHappyEyeballs connects to port on the first of ips that answers. A new
+// attempt starts every delay, or as soon as the previous one failed, without
+// cancelling the ones still going on; the first connection established wins
+// and the others are closed.
+func dialHappyEyeballs(ctx context.Context, ips []net.IP, port, preferFamily string, delay time.Duration) (net.Conn, error) {
+	addrs := sortAddrs(ips, preferFamily)
+	if len(addrs) == 0 {
+		return nil, errNoAddress
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result)
+	dialer := &net.Dialer{}
+	attempt := func(ip net.IP) {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		select {
+		case results <- result{conn, err}:
+		case <-ctx.Done():
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	var firstErr error
+	var next <-chan time.Time
+	pending := 0
+	for i := 0; i < len(addrs) || pending > 0; {
+		if i < len(addrs) && next == nil {
+			go attempt(addrs[i])
+			i++
+			pending++
+			next = time.After(delay)
+		}
+
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			next = nil
+		case <-next:
+			next = nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, firstErr
+}
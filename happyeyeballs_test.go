@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortAddrs(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("1.1.1.1"),
+		net.ParseIP("1.1.1.2"),
+		net.ParseIP("1.1.1.3"),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+	}
+	sorted := func(family string) []string {
+		var s []string
+		for _, ip := range sortAddrs(ips, family) {
+			s = append(s, ip.String())
+		}
+		return s
+	}
+	require.Equal(t, []string{"2001:db8::1", "1.1.1.1", "2001:db8::2", "1.1.1.2", "1.1.1.3"}, sorted(familyIPv6))
+	require.Equal(t, []string{"1.1.1.1", "2001:db8::1", "1.1.1.2", "2001:db8::2", "1.1.1.3"}, sorted(familyIPv4))
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// the preferred IPv6 address has nothing listening, the IPv4 one is tried
+	// right after it failed.
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+	start := time.Now()
+	conn, err := dialHappyEyeballs(context.Background(), ips, port, familyIPv6, time.Hour)
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1", remoteIP(conn).String())
+	require.True(t, time.Since(start) < time.Second)
+	conn.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	_, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+	closed.Close()
+	_, err = dialHappyEyeballs(context.Background(), ips[:1], closedPort, familyIPv6, connectionAttemptDelay)
+	require.NotNil(t, err)
+
+	_, err = dialHappyEyeballs(context.Background(), nil, port, familyIPv6, connectionAttemptDelay)
+	require.Equal(t, errNoAddress, err)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the hosts file is checked for changes at most every hostsCheckInterval.
+	hostsCheckInterval = 5 * time.Second
+)
+
+func hostsFilePath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+// dnsOverHostsFile answers from a hosts file, read again when it changes.
+type dnsOverHostsFile struct {
+	sync.Mutex
+	path      string
+	modTime   time.Time
+	size      int64
+	checkedAt time.Time
+	hosts     map[string][]net.IP
+}
+
+func newDNSOverHostsFile(path string) *dnsOverHostsFile {
+	return &dnsOverHostsFile{path: path}
+}
+
+// lookup returns the addresses of host in the hosts file, A records first.
+// They have no TTL, so they aren't cached.
+func (d *dnsOverHostsFile) lookup(ctx context.Context, host string) ([]dnsRecord, error) {
+	d.Lock()
+	defer d.Unlock()
+	if now := time.Now(); now.Sub(d.checkedAt) >= hostsCheckInterval {
+		d.checkedAt = now
+		d.reload()
+	}
+	return hostRecords(d.hosts[canonicalHost(host)]), nil
+}
+
+// reload reads the hosts file again when its size or modification time
+// changed. A file that can't be read has no hosts.
+func (d *dnsOverHostsFile) reload() {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		d.hosts, d.modTime, d.size = nil, time.Time{}, 0
+		return
+	}
+	if d.hosts != nil && info.ModTime().Equal(d.modTime) && info.Size() == d.size {
+		return
+	}
+
+	f, err := os.Open(d.path)
+	if err != nil {
+		d.hosts = nil
+		return
+	}
+	defer f.Close()
+	d.hosts = parseHosts(f)
+	d.modTime, d.size = info.ModTime(), info.Size()
+}
+
+// parseHosts reads a hosts file: an address followed by its names on each
+// line, # starting a comment. Lines that don't parse are skipped, as the
+// system resolver does.
+func parseHosts(reader io.Reader) map[string][]net.IP {
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// link local addresses may carry a zone, which can't be dialled
+		// without an interface anyway.
+		ip := net.ParseIP(strings.SplitN(fields[0], "%", 2)[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = canonicalHost(name)
+			hosts[name] = appendIP(hosts[name], ip)
+		}
+	}
+	return hosts
+}
+
+// staticHosts maps names to addresses given in the config file. A name
+// starting with "*." stands for every subdomain of the rest, the most
+// specific one wins.
+type staticHosts struct {
+	exact    map[string][]net.IP
+	wildcard map[string][]net.IP
+}
+
+func newStaticHosts(mappings map[string]hostAddrs) (*staticHosts, error) {
+	if len(mappings) == 0 {
+		return nil, nil
+	}
+	s := &staticHosts{
+		exact:    make(map[string][]net.IP),
+		wildcard: make(map[string][]net.IP),
+	}
+	for name, addrs := range mappings {
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("hosts: %s: no address", name)
+		}
+		m := s.exact
+		if strings.HasPrefix(name, "*.") {
+			m, name = s.wildcard, name[2:]
+		}
+		name = canonicalHost(name)
+		if name == "" || strings.Contains(name, "*") {
+			return nil, fmt.Errorf("hosts: bad name %q", name)
+		}
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("hosts: %s: bad address %q", name, addr)
+			}
+			m[name] = appendIP(m[name], ip)
+		}
+	}
+	return s, nil
+}
+
+// lookup returns the addresses host is mapped to, A records first.
+func (s *staticHosts) lookup(host string) []dnsRecord {
+	if s == nil {
+		return nil
+	}
+	host = canonicalHost(host)
+	if ips, ok := s.exact[host]; ok {
+		return hostRecords(ips)
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if ips, ok := s.wildcard[host]; ok {
+			return hostRecords(ips)
+		}
+	}
+	return nil
+}
+
+// hostAddrs are the addresses of a static mapping, a single one or a list
+// in the config file.
+type hostAddrs []string
+
+func (a *hostAddrs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var addrs []string
+	if err := unmarshal(&addrs); err == nil {
+		*a = addrs
+		return nil
+	}
+	var addr string
+	if err := unmarshal(&addr); err != nil {
+		return err
+	}
+	*a = hostAddrs{addr}
+	return nil
+}
+
+// canonicalHost returns host lowercased and without the trailing dot.
+func canonicalHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return ips
+		}
+	}
+	return append(ips, ip)
+}
+
+func hostRecords(ips []net.IP) []dnsRecord {
+	var v4, v6 []dnsRecord
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, dnsRecord{ip: ip})
+		} else {
+			v6 = append(v6, dnsRecord{ip: ip})
+		}
+	}
+	return append(v4, v6...)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHosts(t *testing.T) {
+	hosts := parseHosts(strings.NewReader(`
+# comment
+127.0.0.1	localhost Local.Example.
+::1		localhost ip6-localhost # trailing comment
+fe80::1%lo0	link.example
+not-an-ip	broken.example
+10.0.0.1
+10.0.0.2	local.example
+10.0.0.2	local.example
+`))
+	require.Equal(t, []net.IP{net.ParseIP("127.0.0.1").To4(), net.ParseIP("::1")}, hosts["localhost"])
+	require.Equal(t, []net.IP{net.ParseIP("127.0.0.1").To4(), net.ParseIP("10.0.0.2").To4()}, hosts["local.example"])
+	require.Equal(t, []net.IP{net.ParseIP("fe80::1")}, hosts["link.example"])
+	require.NotContains(t, hosts, "broken.example")
+}
+
+func TestDNSOverHostsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	require.Nil(t, ioutil.WriteFile(path, []byte("::1 a.example\n127.0.0.1 a.example\n"), 0644))
+
+	d := newDNSOverHostsFile(path)
+	records, err := d.lookup(context.Background(), "A.example.")
+	require.Nil(t, err)
+	require.Equal(t, []dnsRecord{{ip: net.ParseIP("127.0.0.1").To4()}, {ip: net.ParseIP("::1")}}, records)
+
+	// changes are only looked for every hostsCheckInterval.
+	require.Nil(t, ioutil.WriteFile(path, []byte("10.0.0.1 b.example\n"), 0644))
+	records, _ = d.lookup(context.Background(), "b.example")
+	require.Empty(t, records)
+
+	d.checkedAt = time.Time{}
+	records, _ = d.lookup(context.Background(), "b.example")
+	require.Equal(t, []dnsRecord{{ip: net.ParseIP("10.0.0.1").To4()}}, records)
+	records, _ = d.lookup(context.Background(), "a.example")
+	require.Empty(t, records)
+
+	require.Nil(t, os.Remove(path))
+	d.checkedAt = time.Time{}
+	records, err = d.lookup(context.Background(), "b.example")
+	require.Nil(t, err)
+	require.Empty(t, records)
+}
+
+func TestStaticHosts(t *testing.T) {
+	s, err := newStaticHosts(map[string]hostAddrs{
+		"router.lan":            {"192.168.1.1"},
+		"*.example.com":         {"10.0.0.1", "fd00::1", "10.0.0.2"},
+		"*.dev.example.com":     {"10.0.0.3"},
+		"exact.dev.example.com": {"10.0.0.4"},
+	})
+	require.Nil(t, err)
+
+	records := func(host string) []string {
+		var ips []string
+		for _, r := range s.lookup(host) {
+			ips = append(ips, r.ip.String())
+		}
+		return ips
+	}
+	require.Equal(t, []string{"192.168.1.1"}, records("Router.LAN."))
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "fd00::1"}, records("www.example.com"))
+	require.Equal(t, []string{"10.0.0.3"}, records("a.b.dev.example.com"))
+	require.Equal(t, []string{"10.0.0.4"}, records("exact.dev.example.com"))
+	require.Empty(t, records("example.com"))
+	require.Empty(t, records("example.org"))
+	require.Empty(t, (*staticHosts)(nil).lookup("router.lan"))
+
+	s, err = newStaticHosts(nil)
+	require.Nil(t, err)
+	require.Nil(t, s)
+	_, err = newStaticHosts(map[string]hostAddrs{"router.lan": {"router"}})
+	require.NotNil(t, err)
+	_, err = newStaticHosts(map[string]hostAddrs{"*": {"10.0.0.1"}})
+	require.NotNil(t, err)
+}
+
+func TestSmartDNSStaticHosts(t *testing.T) {
+	var calls int32
+	d := newSmartDNS(testResolver("doh", "1.1.1.1", 0, &calls))
+	d.static, _ = newStaticHosts(map[string]hostAddrs{"*.example.com": {"10.0.0.1"}})
+
+	records, err := d.lookup(context.Background(), "www.example.com")
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.1", records[0].ip.String())
+	require.Equal(t, int32(0), calls)
+
+	records, _ = d.lookup(context.Background(), "www.example.org")
+	require.Equal(t, "1.1.1.1", records[0].ip.String())
+	require.Equal(t, int32(1), calls)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"math/bits"
 	"net"
-	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 var privateIPRange = &IPRangeDB{
@@ -23,87 +25,203 @@ var privateIPRange = &IPRangeDB{
 
 func init() {
 	privateIPRange.init()
-	sort.Sort(privateIPRange)
 }
 
+// ipRange is a CIDR block, or an interval "start-end" of addresses, and the
+// country its addresses are in, if known.
 type ipRange struct {
-	value string
-	min   net.IP
-	max   net.IP
+	value   string
+	country string
+	min     net.IP
+	max     net.IP
 }
 
 func (i *ipRange) init() {
-	ip, inet, _ := net.ParseCIDR(i.value)
-	if len(inet.Mask) == net.IPv4len {
-		ip = ip.To4()
+	if min, max, ok := parseIPInterval(i.value); ok {
+		i.min, i.max = min, max
+		return
 	}
 
-	min := ip.To4()
-	if min == nil {
-		min = ip.To16()
+	_, inet, err := net.ParseCIDR(i.value)
+	if err != nil {
+		return
 	}
+	network := canonicalNetwork(inet)
+	i.min = network.IP
+	i.max = lastIP(network)
+}
+
+// networks returns the CIDR blocks of the range, the fewest covering exactly
+// its addresses for an interval.
+func (i *ipRange) networks() []*net.IPNet {
+	if min, max, ok := parseIPInterval(i.value); ok {
+		return cidrCover(min, max)
+	}
+	if _, network, err := net.ParseCIDR(i.value); err == nil {
+		return []*net.IPNet{canonicalNetwork(network)}
+	}
+	return nil
+}
+
+// parseIPInterval parses "start-end", two addresses of the same family with
+// start not after end.
+func parseIPInterval(s string) (net.IP, net.IP, bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, nil, false
+	}
+	min, max := net.ParseIP(strings.TrimSpace(parts[0])), net.ParseIP(strings.TrimSpace(parts[1]))
+	if min == nil || max == nil {
+		return nil, nil, false
+	}
+	min, _ = ipKey(min, 0)
+	max, _ = ipKey(max, 0)
+	if len(min) != len(max) || bytes.Compare(min, max) > 0 {
+		return nil, nil, false
+	}
+	return min, max, true
+}
 
-	max := make([]byte, len(inet.Mask))
-	for i := range inet.Mask {
-		max[i] = ip[i] | ^inet.Mask[i]
+// cidrCover returns the fewest CIDR blocks holding exactly the addresses from
+// min to max, in order.
+func cidrCover(min, max net.IP) []*net.IPNet {
+	size := len(min) * 8
+	var networks []*net.IPNet
+	for {
+		// the largest block starting at min that doesn't go past max.
+		ones := size - trailingZeros(min)
+		for {
+			network := &net.IPNet{IP: min, Mask: net.CIDRMask(ones, size)}
+			if bytes.Compare(lastIP(network), max) <= 0 {
+				break
+			}
+			ones++
+		}
+		network := &net.IPNet{IP: min, Mask: net.CIDRMask(ones, size)}
+		networks = append(networks, network)
+
+		last := lastIP(network)
+		if bytes.Equal(last, max) {
+			return networks
+		}
+		min = nextIP(last)
 	}
+}
+
+// lastIP returns the last address of network.
+func lastIP(network *net.IPNet) net.IP {
+	last := make(net.IP, len(network.IP))
+	for i := range last {
+		last[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return last
+}
 
-	i.min = min
-	i.max = max
+// nextIP returns the address following ip, which isn't the last one.
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// trailingZeros returns how many bits end ip with a zero, all of them for the
+// zero address.
+func trailingZeros(ip net.IP) int {
+	n := 0
+	for i := len(ip) - 1; i >= 0; i-- {
+		if ip[i] != 0 {
+			return n + bits.TrailingZeros8(ip[i])
+		}
+		n += 8
+	}
+	return n
 }
 
+// IPRangeDB finds the range an address is in with a prefix trie, the most
+// specific one when ranges overlap. Ranges are aggregated when loaded: db
+// holds what is left of them, in address order.
 type IPRangeDB struct {
 	sync.RWMutex
-	db []*ipRange
+	db        []*ipRange
+	trie      *ipTrie
+	version   string
+	updatedAt time.Time
 }
 
+// init loads the ranges of db.
 func (db *IPRangeDB) init() {
-	for i := range db.db {
-		db.db[i].init()
+	db.db, db.trie = buildIPTrie(db.db)
+}
+
+// buildIPTrie returns the trie of ranges and the aggregated ranges it holds.
+// Ranges that don't parse are skipped.
+func buildIPTrie(ranges []*ipRange) ([]*ipRange, *ipTrie) {
+	trie := &ipTrie{}
+	for _, r := range ranges {
+		for _, network := range r.networks() {
+			trie.insert(network, r.country)
+		}
 	}
+	trie.aggregate()
+
+	aggregated := make([]*ipRange, 0, trie.size)
+	trie.walk(func(network *net.IPNet, country interface{}) {
+		r := &ipRange{value: network.String(), country: country.(string)}
+		r.init()
+		aggregated = append(aggregated, r)
+	})
+	return aggregated, trie
 }
 
 func (db *IPRangeDB) Len() int {
+	db.RLock()
+	defer db.RUnlock()
 	return len(db.db)
 }
 
-func (db *IPRangeDB) Less(i, j int) bool {
-	return bytes.Compare(db.db[i].max, db.db[j].min) == -1
-}
-
-func (db *IPRangeDB) Swap(i, j int) {
-	db.db[i], db.db[j] = db.db[j], db.db[i]
+func (db *IPRangeDB) contains(target net.IP) bool {
+	_, ok := db.lookup(target)
+	return ok
 }
 
-func (db *IPRangeDB) contains(target net.IP) bool {
+// lookup returns the country of the most specific range target is in.
+func (db *IPRangeDB) lookup(target net.IP) (country string, ok bool) {
 	db.RLock()
 	defer db.RUnlock()
-	if target == nil {
-		return false
-	}
-
-	n := target.To4()
-	if n == nil {
-		n = target.To16()
+	if target == nil || db.trie == nil {
+		return "", false
 	}
-	target = n
-
-	i := sort.Search(len(db.db), func(i int) bool {
-		return bytes.Compare(target, db.db[i].min) == -1
-	})
-
-	i -= 1
-	if i < 0 {
-		return false
+	v, ok := db.trie.lookup(target)
+	if !ok {
+		return "", false
 	}
+	return v.(string), true
+}
 
-	return bytes.Compare(target, db.db[i].min) >= 0 && bytes.Compare(target, db.db[i].max) <= 0
+// replace swaps the ranges of db for ranges, of version and pulled at
+// updatedAt.
+func (db *IPRangeDB) replace(ranges []*ipRange, version string, updatedAt time.Time) {
+	ranges, trie := buildIPTrie(ranges)
+
+	db.Lock()
+	db.db = ranges
+	db.trie = trie
+	db.version = version
+	db.updatedAt = updatedAt
+	db.Unlock()
 }
 
+// newChinaIPRangeDB returns the ranges built in, those of China.
 func newChinaIPRangeDB() *IPRangeDB {
-	chinaIPRangeDB.Lock()
-	defer chinaIPRangeDB.Unlock()
-	chinaIPRangeDB.init()
-	sort.Sort(chinaIPRangeDB)
-	return chinaIPRangeDB
+	db := &IPRangeDB{db: make([]*ipRange, len(chinaIPRangeDB.db))}
+	for i, r := range chinaIPRangeDB.db {
+		db.db[i] = &ipRange{value: r.value, country: "CN"}
+	}
+	db.init()
+	return db
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"net"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -41,3 +44,140 @@ func BenchmarkIsChinaIP(b *testing.B) {
 		china.contains(usa)
 	}
 }
+
+func TestIPRangeDBOverlapping(t *testing.T) {
+	db := &IPRangeDB{}
+	db.replace([]*ipRange{
+		{value: "10.0.0.0/8", country: "US"},
+		{value: "10.1.0.0/16", country: "CN"},
+		{value: "10.1.1.0/24", country: "CN"},
+		{value: "2001:db8::/32", country: "CN"},
+		{value: "bad"},
+	}, "test", time.Now())
+	require.Equal(t, 3, db.Len())
+
+	for ip, country := range map[string]string{
+		"10.2.0.1":        "US",
+		"10.1.1.1":        "CN",
+		"10.1.2.1":        "CN",
+		"::ffff:10.1.1.1": "CN",
+		"2001:db8::1":     "CN",
+	} {
+		c, ok := db.lookup(net.ParseIP(ip))
+		require.True(t, ok, ip)
+		require.Equal(t, country, c, ip)
+	}
+	require.False(t, db.contains(net.ParseIP("11.0.0.1")))
+	require.False(t, db.contains(nil))
+	require.False(t, (&IPRangeDB{}).contains(net.ParseIP("10.0.0.1")))
+}
+
+// sliceIPRangeDB is the sorted slice IPRangeDB used to be, searched with
+// sort.Search, to compare the trie with.
+type sliceIPRangeDB []*ipRange
+
+func newSliceIPRangeDB() sliceIPRangeDB {
+	db := sliceIPRangeDB(newChinaIPRangeDB().db)
+	sort.Slice(db, func(i, j int) bool {
+		return bytes.Compare(db[i].max, db[j].min) == -1
+	})
+	return db
+}
+
+func (db sliceIPRangeDB) contains(target net.IP) bool {
+	if n := target.To4(); n != nil {
+		target = n
+	}
+	i := sort.Search(len(db), func(i int) bool {
+		return bytes.Compare(target, db[i].min) == -1
+	}) - 1
+	return i >= 0 && bytes.Compare(target, db[i].min) >= 0 && bytes.Compare(target, db[i].max) <= 0
+}
+
+var benchmarkIPs = []net.IP{
+	net.ParseIP("172.217.11.68"),
+	net.ParseIP("106.85.37.170"),
+	net.ParseIP("2001:da8:1001:7::88"),
+	net.ParseIP("2001:470:4:1ee::2"),
+}
+
+func BenchmarkIPRangeDBTrie(b *testing.B) {
+	china := newChinaIPRangeDB()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		china.contains(benchmarkIPs[i%len(benchmarkIPs)])
+	}
+}
+
+func BenchmarkIPRangeDBSlice(b *testing.B) {
+	china := newSliceIPRangeDB()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		china.contains(benchmarkIPs[i%len(benchmarkIPs)])
+	}
+}
+
+func BenchmarkIPRangeDBLoad(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		newChinaIPRangeDB()
+	}
+}
+
+func TestCIDRCover(t *testing.T) {
+	for _, c := range []struct {
+		min, max string
+		networks []string
+	}{
+		{"1.0.1.0", "1.0.1.255", []string{"1.0.1.0/24"}},
+		{"1.0.0.0", "1.0.2.255", []string{"1.0.0.0/23", "1.0.2.0/24"}},
+		{"1.0.1.0", "1.0.3.255", []string{"1.0.1.0/24", "1.0.2.0/23"}},
+		{"1.0.1.128", "1.0.2.127", []string{"1.0.1.128/25", "1.0.2.0/25"}},
+		{"10.0.0.1", "10.0.0.1", []string{"10.0.0.1/32"}},
+		{"10.0.0.1", "10.0.0.6", []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.6/32"}},
+		{"0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"255.255.255.0", "255.255.255.255", []string{"255.255.255.0/24"}},
+		{"2001:db8::", "2001:db8:2:ffff:ffff:ffff:ffff:ffff", []string{"2001:db8::/47", "2001:db8:2::/48"}},
+	} {
+		min, max, ok := parseIPInterval(c.min + "-" + c.max)
+		require.True(t, ok)
+		var networks []string
+		for _, network := range cidrCover(min, max) {
+			networks = append(networks, network.String())
+		}
+		require.Equal(t, c.networks, networks, c.min+"-"+c.max)
+	}
+
+	for _, s := range []string{"1.0.1.0", "1.0.2.0-1.0.1.0", "1.0.1.0-2001:db8::", "1.0.1.0-1.0.2.0-1.0.3.0", "a-b"} {
+		_, _, ok := parseIPInterval(s)
+		require.False(t, ok, s)
+	}
+}
+
+func TestIPRangeInterval(t *testing.T) {
+	db := &IPRangeDB{}
+	db.replace([]*ipRange{
+		{value: "1.0.1.0-1.0.3.255", country: "CN"},
+		{value: "::ffff:1.0.8.0-::ffff:1.0.8.9", country: "CN"},
+		{value: "2001:db8::-2001:db8:2:ffff:ffff:ffff:ffff:ffff", country: "CN"},
+	}, "test", time.Now())
+
+	for ip, in := range map[string]bool{
+		"1.0.0.255":         false,
+		"1.0.1.0":           true,
+		"1.0.3.255":         true,
+		"1.0.4.0":           false,
+		"1.0.8.9":           true,
+		"1.0.8.10":          false,
+		"2001:db8:2::1":     true,
+		"2001:db8:3::":      false,
+		"::ffff:1.0.2.1":    true,
+		"2001:db7:ffff::ff": false,
+	} {
+		require.Equal(t, in, db.contains(net.ParseIP(ip)), ip)
+	}
+
+	r := &ipRange{value: "1.0.1.0-1.0.3.255"}
+	r.init()
+	require.Equal(t, net.ParseIP("1.0.1.0").To4(), r.min)
+	require.Equal(t, net.ParseIP("1.0.3.255").To4(), r.max)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultIPRangeInterval = 4 * time.Hour
+
+	// ipRangeCacheFormat is the format of the cached ranges. Caches of
+	// other formats are ignored; those without one hold ranges rounded to
+	// CIDRs.
+	ipRangeCacheFormat = 1
+)
+
+// builtinIPRangeDate is when the ranges of chinaipdb.go were pulled, cached
+// ranges older than them aren't loaded.
+var builtinIPRangeDate = time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+func ipRangeCacheFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".sandwich", "ip-ranges.json")
+}
+
+// ipRangeCache holds the ranges last pulled from each source for the
+// countries given, with the validators to ask for them again conditionally.
+type ipRangeCache struct {
+	Format    int                        `json:"format"`
+	Countries []string                   `json:"countries"`
+	Sources   map[string]*cachedIPRanges `json:"sources"`
+}
+
+type cachedIPRanges struct {
+	ETag         string              `json:"etag,omitempty"`
+	LastModified string              `json:"last_modified,omitempty"`
+	Version      string              `json:"version"`
+	FetchedAt    time.Time           `json:"fetched_at"`
+	Ranges       map[string][]string `json:"ranges"`
+}
+
+func newCachedIPRanges(ranges []*ipRange, version string, header http.Header) *cachedIPRanges {
+	c := &cachedIPRanges{
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		Version:      version,
+		FetchedAt:    time.Now(),
+		Ranges:       make(map[string][]string),
+	}
+	for _, r := range ranges {
+		c.Ranges[r.country] = append(c.Ranges[r.country], r.value)
+	}
+	return c
+}
+
+// setValidators makes req conditional on the ranges having changed since c.
+func (c *cachedIPRanges) setValidators(req *http.Request) {
+	if c == nil {
+		return
+	}
+	if c.ETag != "" {
+		req.Header.Set("If-None-Match", c.ETag)
+	}
+	if c.LastModified != "" {
+		req.Header.Set("If-Modified-Since", c.LastModified)
+	}
+}
+
+func (c *cachedIPRanges) size() int {
+	n := 0
+	for _, values := range c.Ranges {
+		n += len(values)
+	}
+	return n
+}
+
+func (c *cachedIPRanges) ipRanges() []*ipRange {
+	var ranges []*ipRange
+	for country, values := range c.Ranges {
+		for _, value := range values {
+			ranges = append(ranges, &ipRange{value: value, country: country})
+		}
+	}
+	return ranges
+}
+
+// matches reports whether c holds the ranges of countries.
+func (c *ipRangeCache) matches(countries map[string]bool) bool {
+	return c != nil && strings.Join(c.Countries, ",") == strings.Join(sortedCountries(countries), ",")
+}
+
+// saveIPRangeCache writes c to path.
+func saveIPRangeCache(path string, c *ipRangeCache) error {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf)
+}
+
+// loadIPRangeCache reads the ranges cached at path. They replace the ranges
+// built in when they were pulled for the current countries and sources after
+// them. It returns when they were pulled, zero if they weren't loaded. A
+// cache of another format is ignored, its validators aren't used either.
+func (l *localProxy) loadIPRangeCache(path string) (time.Time, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var c ipRangeCache
+	if err = json.Unmarshal(buf, &c); err != nil {
+		return time.Time{}, err
+	}
+	if c.Format != ipRangeCacheFormat {
+		return time.Time{}, nil
+	}
+
+	countries, sources := l.ipRangeSettings()
+	if !c.matches(countries) {
+		return time.Time{}, nil
+	}
+
+	var ranges []*ipRange
+	var versions []string
+	var fetchedAt time.Time
+	statuses := make(map[string]*ipRangeSourceStatus)
+	for _, s := range sources {
+		cached, ok := c.Sources[s.cacheKey()]
+		if !ok {
+			return time.Time{}, nil
+		}
+		ranges = append(ranges, cached.ipRanges()...)
+		if cached.Version != "" {
+			versions = append(versions, cached.Version)
+		}
+		if fetchedAt.IsZero() || cached.FetchedAt.Before(fetchedAt) {
+			fetchedAt = cached.FetchedAt
+		}
+		statuses[s.URL] = newIPRangeSourceStatus(s, cached, nil)
+	}
+
+	l.Lock()
+	l.ipRangeCache = &c
+	l.Unlock()
+	if len(ranges) == 0 || !fetchedAt.After(builtinIPRangeDate) {
+		return time.Time{}, nil
+	}
+
+	l.ipRangeDB.replace(ranges, strings.Join(versions, ","), fetchedAt)
+	l.Lock()
+	l.ipRangeStatus = statuses
+	l.Unlock()
+	return fetchedAt, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullIPRangeCache(t *testing.T) {
+	var mu sync.Mutex
+	stats := "2|apnic|20200901|2|19830613|20200831|+1000\n" +
+		"apnic|CN|ipv4|1.0.1.0|256|20110414|allocated\n" +
+		"apnic|CN|ipv6|2001:da8::|32|20020531|allocated\n"
+	etag := `"v1"`
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.Header.Get("If-None-Match") == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		rw.Header().Set("ETag", etag)
+		rw.Header().Set("Last-Modified", "Tue, 01 Sep 2020 00:00:00 GMT")
+		fmt.Fprint(rw, stats)
+	}))
+	defer server.Close()
+
+	url := rirStats[defaultRIRs]
+	rirStats[defaultRIRs] = server.URL
+	defer func() {
+		rirStats[defaultRIRs] = url
+	}()
+
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ip-ranges.json")
+
+	local := &localProxy{
+		client:           server.Client(),
+		ipRangeDB:        newChinaIPRangeDB(),
+		ipRangeCacheFile: path,
+	}
+	ctx := context.Background()
+	require.Nil(t, local.pullLatestIPRange(ctx))
+	require.Equal(t, 2, local.ipRangeDB.Len())
+	require.Equal(t, 1, downloads)
+
+	// not modified.
+	require.Nil(t, local.pullLatestIPRange(ctx))
+	require.Equal(t, 2, local.ipRangeDB.Len())
+	require.Equal(t, 1, downloads)
+	saved, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+
+	// cut short.
+	mu.Lock()
+	etag = `"v2"`
+	stats = "2|apnic|20200902|3|19830613|20200901|+1000\n" +
+		"apnic|CN|ipv4|1.0.1.0|256|20110414|allocated\n"
+	mu.Unlock()
+	require.NotNil(t, local.pullLatestIPRange(ctx))
+	require.Equal(t, 2, local.ipRangeDB.Len())
+	require.True(t, local.ipRangeDB.contains(net.ParseIP("2001:da8::1")))
+	buf, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, saved, buf)
+
+	// loaded at startup.
+	loaded := &localProxy{ipRangeDB: newChinaIPRangeDB()}
+	pulledAt, err := loaded.loadIPRangeCache(path)
+	require.Nil(t, err)
+	require.WithinDuration(t, time.Now(), pulledAt, time.Minute)
+	require.Equal(t, 2, loaded.ipRangeDB.Len())
+	require.Equal(t, "apnic-20200901", loaded.ipRangeDB.version)
+
+	// pulled for other countries.
+	other := &localProxy{ipRangeDB: newChinaIPRangeDB(), directCountries: map[string]bool{"HK": true}}
+	pulledAt, err = other.loadIPRangeCache(path)
+	require.Nil(t, err)
+	require.True(t, pulledAt.IsZero())
+	require.NotEqual(t, 2, other.ipRangeDB.Len())
+
+	_, err = loaded.loadIPRangeCache(filepath.Join(dir, "missing.json"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestLoadStaleIPRangeCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ip-ranges.json")
+
+	require.Nil(t, saveIPRangeCache(path, &ipRangeCache{
+		Format:    ipRangeCacheFormat,
+		Countries: []string{"CN"},
+		Sources: map[string]*cachedIPRanges{
+			defaultIPRangeSources([]string{defaultRIRs}, "")[0].cacheKey(): {
+				Version:   "apnic-20190101",
+				FetchedAt: builtinIPRangeDate.Add(-time.Hour),
+				Ranges:    map[string][]string{"CN": {"1.0.1.0/24"}},
+			},
+		},
+	}))
+
+	local := &localProxy{ipRangeDB: newChinaIPRangeDB()}
+	pulledAt, err := local.loadIPRangeCache(path)
+	require.Nil(t, err)
+	require.True(t, pulledAt.IsZero())
+	require.NotEqual(t, 1, local.ipRangeDB.Len())
+	require.NotNil(t, local.ipRangeCache)
+}
+
+func TestLoadOldIPRangeCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// written before the format was recorded, with ranges rounded to CIDRs.
+	path := writeTestFile(t, dir, "ip-ranges.json", `{"countries":["CN"],"sources":{"`+rirStats[defaultRIRs]+`":`+
+		`{"etag":"\"v1\"","version":"apnic-20200901","fetched_at":"2020-09-01T00:00:00Z","ranges":{"CN":["1.0.0.0/23"]}}}}`)
+
+	local := &localProxy{ipRangeDB: newChinaIPRangeDB()}
+	pulledAt, err := local.loadIPRangeCache(path)
+	require.Nil(t, err)
+	require.True(t, pulledAt.IsZero())
+	require.NotEqual(t, 1, local.ipRangeDB.Len())
+	require.Nil(t, local.ipRangeCache)
+}
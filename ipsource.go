@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	ipRangeFormatDelegatedStats = "delegated-stats"
+	ipRangeFormatCIDR           = "cidr"
+	ipRangeFormatMMDB           = "mmdb"
+)
+
+var errNotModified = errors.New("not modified")
+
+// ipRangeSource is a list of IP ranges at an http(s) URL or in a local file.
+// Format is "delegated-stats" for the files of the registries, "cidr" for a
+// CIDR, address or interval on each line like china_ip_list or chnroutes,
+// or "mmdb" for a MaxMind DB country database. The ranges of a cidr list
+// are in Country; without one they are always reached directly.
+type ipRangeSource struct {
+	URL     string `yaml:"url"`
+	Format  string `yaml:"format"`
+	Country string `yaml:"country"`
+}
+
+func (s ipRangeSource) validate() error {
+	if s.URL == "" {
+		return errors.New("ip-ranges: no url")
+	}
+	switch s.Format {
+	case ipRangeFormatDelegatedStats, ipRangeFormatMMDB:
+		if s.Country != "" {
+			return fmt.Errorf("ip-ranges: %s: country only applies to cidr lists", s.URL)
+		}
+	case ipRangeFormatCIDR:
+		if s.Country != "" {
+			if _, err := parseCountry(s.Country); err != nil {
+				return fmt.Errorf("ip-ranges: %s: %s", s.URL, err.Error())
+			}
+		}
+	default:
+		return fmt.Errorf("ip-ranges: %s: unknown format %q", s.URL, s.Format)
+	}
+	return nil
+}
+
+// cacheKey identifies the cached ranges of s. Ranges of the same URL read in
+// another format or for another country aren't those of s.
+func (s ipRangeSource) cacheKey() string {
+	return s.Format + "," + strings.ToUpper(s.Country) + "," + s.URL
+}
+
+func (s ipRangeSource) isRemote() bool {
+	return strings.HasPrefix(s.URL, "http://") || strings.HasPrefix(s.URL, "https://")
+}
+
+// defaultIPRangeSources returns the sources of the -rirs and -geoip-db
+// flags: the mmdb file when given, the delegated-stats of rirs otherwise.
+func defaultIPRangeSources(rirs []string, geoIPFile string) []ipRangeSource {
+	if geoIPFile != "" {
+		return []ipRangeSource{{URL: geoIPFile, Format: ipRangeFormatMMDB}}
+	}
+	var sources []ipRangeSource
+	for _, rir := range rirs {
+		sources = append(sources, ipRangeSource{URL: rirStats[rir], Format: ipRangeFormatDelegatedStats})
+	}
+	return sources
+}
+
+// ipRangeSourceStatus is how pulling the ranges of a source last went.
+type ipRangeSourceStatus struct {
+	URL       string     `json:"url"`
+	Format    string     `json:"format"`
+	Version   string     `json:"version,omitempty"`
+	Ranges    int        `json:"ranges"`
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func newIPRangeSourceStatus(s ipRangeSource, fetched *cachedIPRanges, err error) *ipRangeSourceStatus {
+	status := &ipRangeSourceStatus{URL: s.URL, Format: s.Format}
+	if fetched != nil {
+		status.Version = fetched.Version
+		status.Ranges = fetched.size()
+		fetchedAt := fetched.FetchedAt
+		status.FetchedAt = &fetchedAt
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// ipRangeStatuses returns the status of every source, in order.
+func (l *localProxy) ipRangeStatuses() []ipRangeSourceStatus {
+	_, sources := l.ipRangeSettings()
+	l.RLock()
+	defer l.RUnlock()
+	statuses := make([]ipRangeSourceStatus, 0, len(sources))
+	for _, s := range sources {
+		if status, ok := l.ipRangeStatus[s.URL]; ok {
+			statuses = append(statuses, *status)
+		} else {
+			statuses = append(statuses, ipRangeSourceStatus{URL: s.URL, Format: s.Format})
+		}
+	}
+	return statuses
+}
+
+// openIPRangeSource returns the content of s, or errNotModified if it hasn't
+// changed since cached.
+func (l *localProxy) openIPRangeSource(ctx context.Context, s ipRangeSource, cached *cachedIPRanges) (io.ReadCloser, http.Header, error) {
+	if !s.isRemote() {
+		f, err := os.Open(s.URL)
+		return f, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	cached.setValidators(req)
+	res, err := l.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case res.StatusCode == http.StatusNotModified && cached != nil:
+		res.Body.Close()
+		return nil, nil, errNotModified
+	case res.StatusCode != http.StatusOK:
+		res.Body.Close()
+		return nil, nil, errors.New(res.Status)
+	}
+	return res.Body, res.Header, nil
+}
+
+// fetchIPRanges returns the ranges of s in countries, those of cached when
+// they haven't changed.
+func (l *localProxy) fetchIPRanges(ctx context.Context, s ipRangeSource, countries map[string]bool, cached *cachedIPRanges) (*cachedIPRanges, error) {
+	r, header, err := l.openIPRangeSource(ctx, s, cached)
+	if err == errNotModified {
+		fetched := *cached
+		fetched.FetchedAt = time.Now()
+		return &fetched, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", s.URL, err.Error())
+	}
+	defer r.Close()
+
+	var ranges []*ipRange
+	var version string
+	switch s.Format {
+	case ipRangeFormatDelegatedStats:
+		ranges, version, err = parseDelegatedStats(ctx, r, countries)
+	case ipRangeFormatCIDR:
+		ranges, err = parseCIDRList(r, strings.ToUpper(s.Country))
+	case ipRangeFormatMMDB:
+		var buf []byte
+		if buf, err = ioutil.ReadAll(r); err == nil {
+			ranges, version, err = parseMMDB(buf, countries)
+		}
+	default:
+		err = fmt.Errorf("unknown format %q", s.Format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", s.URL, err.Error())
+	}
+	return newCachedIPRanges(ranges, version, header), nil
+}
+
+// parseCIDRList reads a CIDR, an address or an interval "start-end" on each
+// line, # starting a comment, all in country.
+func parseCIDRList(r io.Reader, country string) ([]*ipRange, error) {
+	var ranges []*ipRange
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if min, max, ok := parseIPInterval(line); ok {
+			ranges = append(ranges, &ipRange{value: fmt.Sprintf("%s-%s", min, max), country: country})
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			if strings.Contains(line, ":") {
+				line += "/128"
+			} else {
+				line += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("bad cidr %q", line)
+		}
+		ranges = append(ranges, &ipRange{value: canonicalNetwork(network).String(), country: country})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCIDRList(t *testing.T) {
+	ranges, err := parseCIDRList(strings.NewReader(`# office
+10.8.0.0/16
+192.0.2.1        # vpn gateway
+
+2001:db8::/32
+2001:db8::1
+::ffff:198.51.100.0/120
+198.51.100.200 - 198.51.101.9
+`), "")
+	require.Nil(t, err)
+	require.Equal(t, []*ipRange{
+		{value: "10.8.0.0/16"},
+		{value: "192.0.2.1/32"},
+		{value: "2001:db8::/32"},
+		{value: "2001:db8::1/128"},
+		{value: "198.51.100.0/24"},
+		{value: "198.51.100.200-198.51.101.9"},
+	}, ranges)
+
+	ranges, err = parseCIDRList(strings.NewReader("1.0.1.0/24\n"), "CN")
+	require.Nil(t, err)
+	require.Equal(t, []*ipRange{{value: "1.0.1.0/24", country: "CN"}}, ranges)
+
+	for _, list := range []string{"1.0.1.0/33\n", "1.0.1\n", "example.com\n", "1.0.2.0-1.0.1.0\n"} {
+		_, err = parseCIDRList(strings.NewReader(list), "")
+		require.NotNil(t, err, list)
+	}
+}
+
+func TestPullMergedIPRanges(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if status != http.StatusOK {
+			rw.WriteHeader(status)
+			return
+		}
+		switch req.URL.Path {
+		case "/delegated":
+			fmt.Fprint(rw, "2|apnic|20200901|2|19830613|20200831|+1000\n"+
+				"apnic|CN|ipv4|1.0.1.0|256|20110414|allocated\n"+
+				"apnic|CN|ipv4|1.0.2.0|512|20110414|allocated\n")
+		case "/china_ip_list.txt":
+			fmt.Fprint(rw, "1.0.1.0/24\n1.0.8.0/21\n")
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	office := writeTestFile(t, dir, "office.txt", "203.0.113.0/24\n")
+	foreign := writeTestFile(t, dir, "foreign.txt", "1.0.8.8/32\n")
+
+	sources := []ipRangeSource{
+		{URL: server.URL + "/delegated", Format: ipRangeFormatDelegatedStats},
+		{URL: server.URL + "/china_ip_list.txt", Format: ipRangeFormatCIDR, Country: "cn"},
+		{URL: office, Format: ipRangeFormatCIDR},
+		{URL: foreign, Format: ipRangeFormatCIDR, Country: "US"},
+	}
+	local := &localProxy{client: server.Client(), ipRangeDB: &IPRangeDB{}}
+	local.setIPRangeSources(map[string]bool{"CN": true}, sources)
+	require.Nil(t, local.pullLatestIPRange(context.Background()))
+
+	for ip, direct := range map[string]bool{
+		"1.0.1.1":     true,
+		"1.0.3.1":     true,
+		"1.0.9.1":     true,
+		"1.0.8.8":     false,
+		"203.0.113.1": true,
+		"8.8.8.8":     false,
+	} {
+		require.Equal(t, direct, local.isDirect(net.ParseIP(ip)), ip)
+	}
+	// 1.0.1.0/24 is in both lists.
+	require.Equal(t, 5, local.ipRangeDB.Len())
+
+	statuses := local.ipRangeStatuses()
+	require.Len(t, statuses, 4)
+	require.Equal(t, "apnic-20200901", statuses[0].Version)
+	require.Equal(t, 2, statuses[0].Ranges)
+	require.Equal(t, 2, statuses[1].Ranges)
+	require.Equal(t, 1, statuses[2].Ranges)
+	require.NotNil(t, statuses[3].FetchedAt)
+	require.Empty(t, statuses[3].Error)
+
+	// failing sources keep their ranges.
+	mu.Lock()
+	status = http.StatusBadGateway
+	mu.Unlock()
+	require.NotNil(t, local.pullLatestIPRange(context.Background()))
+	require.True(t, local.isDirect(net.ParseIP("1.0.9.1")))
+	statuses = local.ipRangeStatuses()
+	require.Contains(t, statuses[0].Error, "502")
+	require.Equal(t, 2, statuses[0].Ranges)
+	require.Empty(t, statuses[2].Error)
+
+	// a new source never pulled leaves the ranges as they are.
+	local.setIPRangeSources(map[string]bool{"CN": true}, append(sources, ipRangeSource{URL: dir + "/missing.txt", Format: ipRangeFormatCIDR}))
+	require.NotNil(t, local.pullLatestIPRange(context.Background()))
+	require.Equal(t, 5, local.ipRangeDB.Len())
+	require.NotEmpty(t, local.ipRangeStatuses()[4].Error)
+}
+
+func TestIPRangeSourceCountryChanged(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		rw.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(rw, "203.0.113.0/24\n")
+	}))
+	defer server.Close()
+
+	local := &localProxy{client: server.Client(), ipRangeDB: &IPRangeDB{}}
+	source := ipRangeSource{URL: server.URL, Format: ipRangeFormatCIDR, Country: "US"}
+	local.setIPRangeSources(map[string]bool{"CN": true}, []ipRangeSource{source})
+	require.Nil(t, local.pullLatestIPRange(context.Background()))
+	require.False(t, local.isDirect(net.ParseIP("203.0.113.1")))
+
+	// the same list, now in another country, is downloaded again.
+	source.Country = "CN"
+	local.setIPRangeSources(map[string]bool{"CN": true}, []ipRangeSource{source})
+	require.Nil(t, local.pullLatestIPRange(context.Background()))
+	require.True(t, local.isDirect(net.ParseIP("203.0.113.1")))
+	require.Equal(t, int32(2), atomic.LoadInt32(&downloads))
+}
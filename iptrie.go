@@ -0,0 +1,224 @@
+package main
+
+import (
+	"math/bits"
+	"net"
+)
+
+// ipTrie is a binary Patricia trie of IP prefixes, each holding a value like
+// a country, a rule or a tag. IPv4 prefixes and addresses, IPv4-mapped IPv6
+// ones included, are kept apart from IPv6 ones. Values must be comparable.
+type ipTrie struct {
+	v4   *trieNode
+	v6   *trieNode
+	size int
+}
+
+// trieNode is the prefix of key of length bits. Nodes without a value only
+// join their two children.
+type trieNode struct {
+	key      []byte
+	bits     int
+	value    interface{}
+	hasValue bool
+	children [2]*trieNode
+}
+
+// ipKey returns the key of the network ip/ones in its family, IPv4-mapped
+// networks as IPv4 ones.
+func ipKey(ip net.IP, ones int) ([]byte, int) {
+	if ip4 := ip.To4(); ip4 != nil {
+		if len(ip) == net.IPv6len && ones >= 96 {
+			ones -= 96
+		}
+		if ones > 32 {
+			ones = 32
+		}
+		return ip4, ones
+	}
+	return ip.To16(), ones
+}
+
+// canonicalNetwork returns network in its family, IPv4-mapped networks as
+// IPv4 ones.
+func canonicalNetwork(network *net.IPNet) *net.IPNet {
+	ones, _ := network.Mask.Size()
+	key, ones := ipKey(network.IP, ones)
+	return &net.IPNet{IP: key, Mask: net.CIDRMask(ones, len(key)*8)}
+}
+
+func (t *ipTrie) root(key []byte) **trieNode {
+	if len(key) == net.IPv4len {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// insert sets the value of network, replacing the one it had.
+func (t *ipTrie) insert(network *net.IPNet, value interface{}) {
+	ones, _ := network.Mask.Size()
+	key, ones := ipKey(network.IP, ones)
+	if key == nil {
+		return
+	}
+	key = maskKey(key, ones)
+
+	n := t.root(key)
+	for {
+		node := *n
+		if node == nil {
+			*n = &trieNode{key: key, bits: ones, value: value, hasValue: true}
+			t.size++
+			return
+		}
+
+		common := commonBits(key, node.key, min(ones, node.bits))
+		if common < node.bits {
+			parent := &trieNode{key: maskKey(key, common), bits: common}
+			parent.children[keyBit(node.key, common)] = node
+			if common == ones {
+				parent.value, parent.hasValue = value, true
+			} else {
+				parent.children[keyBit(key, common)] = &trieNode{key: key, bits: ones, value: value, hasValue: true}
+			}
+			*n = parent
+			t.size++
+			return
+		}
+
+		if ones == node.bits {
+			if !node.hasValue {
+				t.size++
+			}
+			node.value, node.hasValue = value, true
+			return
+		}
+		n = &node.children[keyBit(key, node.bits)]
+	}
+}
+
+// lookup returns the value of the longest prefix ip is in.
+func (t *ipTrie) lookup(ip net.IP) (interface{}, bool) {
+	key, _ := ipKey(ip, 0)
+	if key == nil {
+		return nil, false
+	}
+
+	var best *trieNode
+	for n := *t.root(key); n != nil; n = n.children[keyBit(key, n.bits)] {
+		if commonBits(key, n.key, n.bits) < n.bits {
+			break
+		}
+		if n.hasValue {
+			best = n
+		}
+		if n.bits == len(key)*8 {
+			break
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	return best.value, true
+}
+
+// walk calls f for every prefix having a value, IPv4 ones first, each in
+// address order with a prefix before those it covers.
+func (t *ipTrie) walk(f func(network *net.IPNet, value interface{})) {
+	var visit func(n *trieNode)
+	visit = func(n *trieNode) {
+		if n == nil {
+			return
+		}
+		if n.hasValue {
+			f(&net.IPNet{IP: append(net.IP(nil), n.key...), Mask: net.CIDRMask(n.bits, len(n.key)*8)}, n.value)
+		}
+		visit(n.children[0])
+		visit(n.children[1])
+	}
+	visit(t.v4)
+	visit(t.v6)
+}
+
+// aggregate merges the prefixes whose two halves have the same value and
+// drops those having the value of a shorter prefix covering them, leaving
+// the fewest prefixes giving the same answers.
+func (t *ipTrie) aggregate() {
+	t.v4 = aggregateNode(t.v4, nil, false)
+	t.v6 = aggregateNode(t.v6, nil, false)
+	t.size = 0
+	t.walk(func(*net.IPNet, interface{}) {
+		t.size++
+	})
+}
+
+func aggregateNode(n *trieNode, inherited interface{}, hasInherited bool) *trieNode {
+	if n == nil {
+		return nil
+	}
+	if n.hasValue && hasInherited && n.value == inherited {
+		n.value, n.hasValue = nil, false
+	}
+	if n.hasValue {
+		inherited, hasInherited = n.value, true
+	}
+	for i := range n.children {
+		n.children[i] = aggregateNode(n.children[i], inherited, hasInherited)
+	}
+
+	l, r := n.children[0], n.children[1]
+	if !n.hasValue && l != nil && r != nil && l.bits == n.bits+1 && r.bits == n.bits+1 &&
+		l.hasValue && r.hasValue && l.value == r.value {
+		n.value, n.hasValue = l.value, true
+		l.value, l.hasValue = nil, false
+		r.value, r.hasValue = nil, false
+		n.children[0], n.children[1] = compactNode(l), compactNode(r)
+	}
+	return compactNode(n)
+}
+
+// compactNode removes n if it has no value and doesn't join two children.
+func compactNode(n *trieNode) *trieNode {
+	if n.hasValue || (n.children[0] != nil && n.children[1] != nil) {
+		return n
+	}
+	if n.children[0] != nil {
+		return n.children[0]
+	}
+	return n.children[1]
+}
+
+// maskKey returns a copy of key with the bits after the first ones cleared.
+func maskKey(key []byte, ones int) []byte {
+	masked := make([]byte, len(key))
+	for i := range masked {
+		switch {
+		case ones >= (i+1)*8:
+			masked[i] = key[i]
+		case ones > i*8:
+			masked[i] = key[i] & ^byte(0xff>>uint(ones-i*8))
+		}
+	}
+	return masked
+}
+
+// commonBits returns how many of the first n bits of a and b are the same.
+func commonBits(a, b []byte, n int) int {
+	for i := 0; i*8 < n; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			return min(i*8+bits.LeadingZeros8(x), n)
+		}
+	}
+	return n
+}
+
+func keyBit(key []byte, i int) int {
+	return int(key[i/8]>>uint(7-i%8)) & 1
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestIPTrie(networks map[string]string) *ipTrie {
+	trie := &ipTrie{}
+	for network, value := range networks {
+		_, n, _ := net.ParseCIDR(network)
+		trie.insert(n, value)
+	}
+	return trie
+}
+
+func trieNetworks(trie *ipTrie) []string {
+	var networks []string
+	trie.walk(func(network *net.IPNet, value interface{}) {
+		networks = append(networks, network.String()+" "+value.(string))
+	})
+	return networks
+}
+
+func TestIPTrieLongestPrefixMatch(t *testing.T) {
+	trie := newTestIPTrie(map[string]string{
+		"10.0.0.0/8":      "a",
+		"10.1.0.0/16":     "b",
+		"10.1.2.0/24":     "c",
+		"10.1.2.3/32":     "d",
+		"0.0.0.0/0":       "default",
+		"2001:db8::/32":   "e",
+		"2001:db8:1::/48": "f",
+	})
+	require.Equal(t, 7, trie.size)
+
+	for ip, value := range map[string]string{
+		"10.2.0.1":          "a",
+		"10.1.3.1":          "b",
+		"10.1.2.4":          "c",
+		"10.1.2.3":          "d",
+		"::ffff:10.1.2.3":   "d",
+		"8.8.8.8":           "default",
+		"2001:db8:2::1":     "e",
+		"2001:db8:1:ffff::": "f",
+	} {
+		v, ok := trie.lookup(net.ParseIP(ip))
+		require.True(t, ok, ip)
+		require.Equal(t, value, v, ip)
+	}
+
+	for _, ip := range []string{"2001:db9::1", "::1", "::10.1.2.3"} {
+		_, ok := trie.lookup(net.ParseIP(ip))
+		require.False(t, ok, ip)
+	}
+	_, ok := trie.lookup(nil)
+	require.False(t, ok)
+
+	// inserting a network again replaces its value.
+	_, n, _ := net.ParseCIDR("10.1.0.0/16")
+	trie.insert(n, "g")
+	require.Equal(t, 7, trie.size)
+	v, _ := trie.lookup(net.ParseIP("10.1.3.1"))
+	require.Equal(t, "g", v)
+}
+
+func TestIPTrieMappedNetworks(t *testing.T) {
+	trie := newTestIPTrie(map[string]string{
+		"::ffff:1.2.3.0/120": "a",
+	})
+	v, ok := trie.lookup(net.ParseIP("1.2.3.4"))
+	require.True(t, ok)
+	require.Equal(t, "a", v)
+	require.Equal(t, []string{"1.2.3.0/24 a"}, trieNetworks(trie))
+}
+
+func TestIPTrieAggregate(t *testing.T) {
+	trie := newTestIPTrie(map[string]string{
+		"1.0.0.0/24":         "CN",
+		"1.0.1.0/24":         "CN",
+		"1.0.2.0/23":         "CN",
+		"1.0.2.128/25":       "CN",
+		"1.0.4.0/24":         "CN",
+		"1.0.5.0/24":         "HK",
+		"1.0.8.0/21":         "CN",
+		"1.0.9.0/24":         "JP",
+		"1.0.9.0/25":         "CN",
+		"2001:db8::/33":      "CN",
+		"2001:db8:8000::/33": "CN",
+	})
+	trie.aggregate()
+	require.Equal(t, []string{
+		"1.0.0.0/22 CN",
+		"1.0.4.0/24 CN",
+		"1.0.5.0/24 HK",
+		"1.0.8.0/21 CN",
+		"1.0.9.0/24 JP",
+		"1.0.9.0/25 CN",
+		"2001:db8::/32 CN",
+	}, trieNetworks(trie))
+	require.Equal(t, 7, trie.size)
+
+	for ip, value := range map[string]string{
+		"1.0.2.200": "CN",
+		"1.0.9.1":   "CN",
+		"1.0.9.200": "JP",
+		"1.0.10.1":  "CN",
+	} {
+		v, ok := trie.lookup(net.ParseIP(ip))
+		require.True(t, ok, ip)
+		require.Equal(t, value, v, ip)
+	}
+}
@@ -3,16 +3,10 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/tls"
-	"errors"
 	"fmt"
-	"io"
-	"math"
 	"net"
 	"net/http"
-	"net/url"
-	"sort"
-	"strconv"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -29,9 +23,53 @@ const (
 	typeIPv6 = 28
 )
 
+// answerCache is every address of a resolved host, A records first, and the
+// TTL they came with. A cached negative answer has no address, nameError is
+// set when the host doesn't exist.
 type answerCache struct {
-	ip        net.IP
-	expiredAt time.Time
+	ips        []net.IP
+	ttl        time.Duration
+	expiredAt  time.Time
+	nameError  bool
+	refreshing bool
+}
+
+// answer returns the cached addresses valid for ttl, or the negative answer.
+func (r *answerCache) answer(ttl time.Duration) ([]net.IP, time.Duration, error) {
+	if len(r.ips) == 0 {
+		return nil, ttl, &negativeAnswer{ttl: ttl, nameError: r.nameError}
+	}
+	return r.ips, ttl, nil
+}
+
+// hostCache is an lru cache of answerCache by host that can also be listed.
+// It is not safe for concurrent use.
+type hostCache struct {
+	*lru.Cache
+	entries map[string]*answerCache
+}
+
+func newHostCache(maxEntries int) *hostCache {
+	c := &hostCache{
+		Cache:   lru.New(maxEntries),
+		entries: make(map[string]*answerCache),
+	}
+	c.OnEvicted = func(key lru.Key, _ interface{}) {
+		delete(c.entries, key.(string))
+	}
+	return c
+}
+
+func (c *hostCache) Add(host string, answer *answerCache) {
+	c.entries[host] = answer
+	c.Cache.Add(host, answer)
+}
+
+// each calls f for every host in the cache, in no particular order.
+func (c *hostCache) each(f func(host string, answer *answerCache)) {
+	for host, answer := range c.entries {
+		f(host, answer)
+	}
 }
 
 type answer struct {
@@ -42,55 +80,175 @@ type answer struct {
 }
 
 type response struct {
-	Status int      `json:"Status"`
-	Answer []answer `json:"Answer"`
+	Status    int      `json:"Status"`
+	Answer    []answer `json:"Answer"`
+	Authority []answer `json:"Authority"`
 }
 
 type localProxy struct {
 	sync.RWMutex
-	remoteProxyAddr   *url.URL
-	secretKey         string
-	chinaIPRangeDB    *IPRangeDB
-	dnsCache          *lru.Cache
-	autoCrossFirewall bool
-	client            *http.Client
-	dns               dns
+	remotes             *remoteSet
+	ipRangeDB           *IPRangeDB
+	dnsCache            *hostCache
+	autoCrossFirewall   bool
+	preferFamily        string
+	remoteDNS           string
+	domesticDomains     *domainList
+	clientSubnet        *net.IPNet
+	clientSubnetSetting string
+	directCountries     map[string]bool
+	ipRangeSources      []ipRangeSource
+	ipRangeStatus       map[string]*ipRangeSourceStatus
+	ipRangeCache        *ipRangeCache
+	ipRangeCacheFile    string
+	client              *http.Client
+	dns                 dns
+	dnsConfig           dnsConfig
+	pac                 *pacFile
+	rules               *ruleSet
 }
 
 func (l *localProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect && !req.URL.IsAbs() {
+		switch req.URL.Path {
+		case "/proxy.pac", "/wpad.dat":
+			l.RLock()
+			pac := l.pac
+			l.RUnlock()
+			pac.ServeHTTP(rw, req)
+		default:
+			http.NotFound(rw, req)
+		}
+		return
+	}
+
 	targetAddr := appendPort(req.Host, req.URL.Scheme)
 	host, port, _ := net.SplitHostPort(targetAddr)
 
-	if !l.autoCrossFirewall {
-		l.remote(rw, req)
+	targetIPs, action, err := l.route(req.Context(), host, port)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
-	targetIP := net.ParseIP(host)
-	if targetIP == nil {
-		targetIP = l.lookup(host)
+	targetIP := firstIP(targetIPs)
+	if targetIP != nil {
+		req.URL.Host = net.JoinHostPort(targetIP.String(), port)
 	}
-	if targetIP == nil {
-		http.Error(rw, fmt.Sprintf("lookup %s: no such host", host), http.StatusServiceUnavailable)
-		return
+	switch action {
+	case actionDirect:
+		l.direct(rw, req, targetAddr, targetIPs)
+	case actionReject:
+		connStats.rejected()
+		http.Error(rw, fmt.Sprintf("%s: %s", host, errRejected.Error()), http.StatusForbidden)
+	default:
+		l.remote(rw, req, targetIP)
 	}
+}
 
-	req.URL.Host = targetIP.String() + ":" + port
-	if l.chinaIPRangeDB.contains(targetIP) || privateIPRange.contains(targetIP) {
-		l.direct(rw, req, targetAddr)
-		return
+// route decides whether host should be reached directly, through the remote
+// proxy or not at all. Rules are consulted first and host is only resolved
+// when a rule or the IP range tables need its addresses, so targetIPs may be
+// empty. Hosts having addresses in the direct IP ranges are reached directly,
+// on those addresses only. In a remote DNS mode, hosts that aren't domestic
+// domains are resolved by the remote proxy or not at all, and go through it
+// unresolved when their addresses are unknown.
+func (l *localProxy) route(ctx context.Context, host, port string) (targetIPs []net.IP, action string, err error) {
+	l.RLock()
+	rules, autoCrossFirewall := l.rules, l.autoCrossFirewall
+	remoteDNS, domesticDomains := l.remoteDNS, l.domesticDomains
+	l.RUnlock()
+
+	lookup := l.lookup
+	ip := net.ParseIP(host)
+	if ip != nil {
+		targetIPs = []net.IP{ip}
+	}
+	foreign := false
+	if ip == nil && remoteDNS != "" && !domesticDomains.contains(host) {
+		// names of the static hosts and the hosts file are local ones the
+		// remote proxy can't know.
+		if targetIPs = l.lookupHosts(ctx, host); targetIPs == nil {
+			foreign = true
+			lookup = nil
+			if remoteDNS == remoteDNSResolve {
+				lookup = l.lookupRemote
+			}
+		}
+	}
+
+	resolved := targetIPs != nil || lookup == nil
+	resolve := func() []net.IP {
+		if !resolved {
+			targetIPs, resolved = lookup(ctx, host), true
+		}
+		return targetIPs
+	}
+
+	if action, ok := rules.match(host, port, resolve); ok {
+		return targetIPs, action, nil
+	}
+
+	if !autoCrossFirewall {
+		return targetIPs, actionRemote, nil
 	}
 
-	l.remote(rw, req)
+	if len(resolve()) == 0 {
+		if foreign {
+			return nil, actionRemote, nil
+		}
+		return nil, "", fmt.Errorf("lookup %s: no such host", host)
+	}
+
+	var direct []net.IP
+	for _, ip := range targetIPs {
+		if l.isDirect(ip) {
+			direct = append(direct, ip)
+		}
+	}
+	if len(direct) > 0 {
+		return direct, actionDirect, nil
+	}
+	return targetIPs, actionRemote, nil
+}
+
+func firstIP(ips []net.IP) net.IP {
+	if len(ips) == 0 {
+		return nil
+	}
+	return ips[0]
+}
+
+func (l *localProxy) direct(rw http.ResponseWriter, req *http.Request, targetAddr string, targetIPs []net.IP) {
+	target, err := l.dialDirect(req.Context(), targetAddr, targetIPs)
+	if err != nil {
+		connStats.failed(routeDirect)
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	l.tunnel(rw, req, connStats.track(target, req.RemoteAddr, targetAddr, remoteIP(target), routeDirect))
 }
 
-func (l *localProxy) direct(rw http.ResponseWriter, req *http.Request, targetAddr string) {
-	client, _, _ := rw.(http.Hijacker).Hijack()
-	target, err := net.Dial("tcp", targetAddr)
+func (l *localProxy) remote(rw http.ResponseWriter, req *http.Request, targetIP net.IP) {
+	targetAddr := appendPort(req.Host, req.URL.Scheme)
+	target, err := l.dialRemote(context.Background(), targetAddr, nil)
 	if err != nil {
+		connStats.failed(routeRemote)
 		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	l.tunnel(rw, req, connStats.track(target, req.RemoteAddr, targetAddr, targetIP, routeRemote))
+}
+
+// tunnel relays the client of req to target. Plain HTTP requests are
+// forwarded first, CONNECT requests are acknowledged.
+func (l *localProxy) tunnel(rw http.ResponseWriter, req *http.Request, target net.Conn) {
+	client, _, err := rw.(http.Hijacker).Hijack()
+	if err != nil {
+		target.Close()
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	if req.Method == http.MethodConnect {
 		client.Write([]byte(fmt.Sprintf("%s 200 OK\r\n\r\n", req.Proto)))
@@ -106,115 +264,114 @@ func (l *localProxy) direct(rw http.ResponseWriter, req *http.Request, targetAdd
 	transfer(target, client)
 }
 
-func (l *localProxy) remote(rw http.ResponseWriter, req *http.Request) {
-	client, _, _ := rw.(http.Hijacker).Hijack()
-	var remoteProxy net.Conn
-	var err error
-
-	remoteProxyAddr := appendPort(l.remoteProxyAddr.Host, l.remoteProxyAddr.Scheme)
-
-	if l.remoteProxyAddr.Scheme == "https" {
-		remoteProxy, err = tls.Dial("tcp", remoteProxyAddr, nil)
-	} else {
-		remoteProxy, err = net.Dial("tcp", remoteProxyAddr)
-	}
+// dialDirect connects to targetAddr without the remote proxy, racing the
+// addresses of its host with Happy Eyeballs. The host is resolved first when
+// targetIPs is empty.
+func (l *localProxy) dialDirect(ctx context.Context, targetAddr string, targetIPs []net.IP) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(targetAddr)
 	if err != nil {
-		return
+		return nil, err
 	}
+	if len(targetIPs) == 0 {
+		targetIPs = l.lookup(ctx, host)
+	}
+	if len(targetIPs) == 0 {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", targetAddr)
+	}
+	return dialHappyEyeballs(ctx, targetIPs, port, l.preferFamily, connectionAttemptDelay)
+}
 
-	req.Header.Set(headerSecret, l.secretKey)
-	req.Write(remoteProxy)
+// dialRemote asks the remote proxy to open a tunnel to targetAddr. Extra
+// headers are sent along with the CONNECT request.
+func (l *localProxy) dialRemote(ctx context.Context, targetAddr string, header http.Header) (net.Conn, error) {
+	l.RLock()
+	remotes := l.remotes
+	l.RUnlock()
+	return remotes.dial(ctx, targetAddr, header)
+}
 
-	go transfer(remoteProxy, client)
-	transfer(client, remoteProxy)
+func (l *localProxy) remoteStatuses() []remoteStatus {
+	l.RLock()
+	remotes := l.remotes
+	l.RUnlock()
+	return remotes.statuses()
 }
 
-func (l *localProxy) lookup(host string) net.IP {
+// update swaps the settings that can be reloaded while the proxy runs and
+// returns the remotes it replaced. Tunnels already open are left alone.
+func (l *localProxy) update(remotes *remoteSet, rules *ruleSet, dns dns, dnsCfg dnsConfig, autoCrossFirewall bool) *remoteSet {
 	l.Lock()
-	if v, ok := l.dnsCache.Get(host); ok {
-		r := v.(*answerCache)
-		if time.Now().Before(r.expiredAt) {
-			l.Unlock()
-			return r.ip
-		}
-		l.dnsCache.Remove(host)
+	defer l.Unlock()
+	old := l.remotes
+	l.remotes = remotes
+	l.rules = rules
+	l.autoCrossFirewall = autoCrossFirewall
+	l.pac = newPACFile(rules, l.isDirectCountry, l.ipRangeDB, privateIPRange)
+	l.dns = dns
+	// the cache outlives restarts and serves stale answers, it's only
+	// dropped when the answers may differ.
+	if !reflect.DeepEqual(l.dnsConfig, dnsCfg) {
+		l.dnsCache.Clear()
 	}
+	l.dnsConfig = dnsCfg
+	return old
+}
+
+// setRemoteDNS sets the remote DNS mode, "" to resolve every host locally,
+// and the domestic domains still resolved locally in that mode.
+func (l *localProxy) setRemoteDNS(mode string, domesticDomains *domainList) {
+	l.Lock()
+	l.remoteDNS = mode
+	l.domesticDomains = domesticDomains
 	l.Unlock()
+}
 
-	ip, expiredAt := l.dns.lookup(host)
-	if ip != nil {
-		l.Lock()
-		l.dnsCache.Add(host, &answerCache{
-			ip:        ip,
-			expiredAt: expiredAt,
-		})
-		l.Unlock()
-	}
-	return ip
+// lookup returns every address of host, A records first, from the cache
+// when it has them.
+func (l *localProxy) lookup(ctx context.Context, host string) []net.IP {
+	ips, _, _ := l.resolveCached(ctx, host, l.resolve)
+	return ips
 }
 
-func (l *localProxy) pullLatestIPRange(ctx context.Context) error {
-	addr := "http://ftp.apnic.net/apnic/stats/apnic/delegated-apnic-latest"
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, addr, nil)
-	res, err := l.client.Do(req)
-	if res != nil {
-		defer res.Body.Close()
+// lookupHosts returns the addresses of host in the static hosts and the
+// hosts file, nil if it has none.
+func (l *localProxy) lookupHosts(ctx context.Context, host string) []net.IP {
+	l.RLock()
+	d, ok := l.dns.(*smartDNS)
+	l.RUnlock()
+	if !ok {
+		return nil
 	}
-	if err != nil {
-		return err
+	var ips []net.IP
+	for _, r := range d.lookupHosts(ctx, host) {
+		ips = append(ips, r.ip)
 	}
+	return ips
+}
 
-	reader := bufio.NewReader(res.Body)
-	var line []byte
-	var db []*ipRange
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-		}
-
-		if line, _, err = reader.ReadLine(); err != nil && err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
-
-		if len(line) == 0 || line[0] == '#' {
-			continue
-		}
-
-		parts := strings.SplitN(string(line), "|", 6)
-		if len(parts) != 6 {
-			continue
-		}
-
-		cc, typ, start, value := parts[1], parts[2], parts[3], parts[4]
-		if !(cc == "CN" && (typ == "ipv4" || typ == "ipv6")) {
-			continue
-		}
-
-		prefixLength, err := strconv.Atoi(value)
-		if err != nil {
-			return err
-		}
-		if typ == "ipv4" {
-			prefixLength = 32 - int(math.Log(float64(prefixLength))/math.Log(2))
-		}
-
-		db = append(db, &ipRange{value: fmt.Sprintf("%s/%d", start, prefixLength)})
+// resolve asks the resolvers of l. No address without a negative answer is
+// taken as a failure, so a stale entry is kept rather than dropped when the
+// resolvers can't be reached.
+func (l *localProxy) resolve(ctx context.Context, host string) ([]dnsRecord, error) {
+	l.RLock()
+	dns := l.dns
+	l.RUnlock()
+	records, err := dns.lookup(ctx, host)
+	if len(records) == 0 && err == nil {
+		return nil, errDNSNoAnswer
 	}
+	return records, err
+}
 
-	if len(db) == 0 {
-		return errors.New("empty ip range db")
-	}
+// bufferedConn is a net.Conn whose reads are served from a bufio.Reader that
+// may already hold bytes read off the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
 
-	l.chinaIPRangeDB.Lock()
-	defer l.chinaIPRangeDB.Unlock()
-	l.chinaIPRangeDB.db = db
-	l.chinaIPRangeDB.init()
-	sort.Sort(l.chinaIPRangeDB)
-	return nil
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
 }
 
 func appendPort(host string, schema string) string {
@@ -5,8 +5,8 @@ import (
 	"net"
 	"net/http"
 	"testing"
+	"time"
 
-	"github.com/golang/groupcache/lru"
 	"github.com/stretchr/testify/require"
 )
 
@@ -19,17 +19,17 @@ func TestDNSOverHTTPS(t *testing.T) {
 	}
 	local := &localProxy{
 		client:   client,
-		dnsCache: lru.New(10),
+		dnsCache: newHostCache(10),
 		dns:      &dnsOverHTTPS{client: client},
 	}
 	host := "www.baidu.com"
-	answer := local.lookup(host)
-	require.NotNil(t, answer)
-	require.True(t, chinaIPDB.contains(answer))
+	answer := local.lookup(context.Background(), host)
+	require.NotEmpty(t, answer)
+	require.True(t, chinaIPDB.contains(answer[0]))
 
 	cache, ok := local.dnsCache.Get("www.baidu.com")
 	require.True(t, ok)
-	require.EqualValues(t, answer, cache.(*answerCache).ip)
+	require.EqualValues(t, answer, cache.(*answerCache).ips)
 }
 
 func TestPullLatestIPRange(t *testing.T) {
@@ -39,25 +39,61 @@ func TestPullLatestIPRange(t *testing.T) {
 				Proxy: nil,
 			},
 		},
-		chinaIPRangeDB: newChinaIPRangeDB(),
+		ipRangeDB: newChinaIPRangeDB(),
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	defer cancel()
 
-	t.Log(local.chinaIPRangeDB.Len())
+	t.Log(local.ipRangeDB.Len())
 	err := local.pullLatestIPRange(ctx)
 	require.Nil(t, err)
-	require.NotZero(t, local.chinaIPRangeDB.Len())
-	t.Log(local.chinaIPRangeDB.Len())
+	require.NotZero(t, local.ipRangeDB.Len())
+	t.Log(local.ipRangeDB.Len())
 
 	cn := "2001:da8:1001:7::88"
-	require.True(t, local.chinaIPRangeDB.contains(net.ParseIP(cn)))
+	require.True(t, local.ipRangeDB.contains(net.ParseIP(cn)))
 
 	usa := "172.217.11.68"
-	require.False(t, local.chinaIPRangeDB.contains(net.ParseIP(usa)))
+	require.False(t, local.ipRangeDB.contains(net.ParseIP(usa)))
 
 	cn = "106.85.37.170"
-	require.True(t, local.chinaIPRangeDB.contains(net.ParseIP(cn)))
+	require.True(t, local.ipRangeDB.contains(net.ParseIP(cn)))
+}
+
+func TestRouteAddressSet(t *testing.T) {
+	local := &localProxy{
+		ipRangeDB:         newChinaIPRangeDB(),
+		dnsCache:          newHostCache(8),
+		autoCrossFirewall: true,
+		dns: newSmartDNS(dnsResolver{name: "test", lookup: func(ctx context.Context, host string) ([]dnsRecord, error) {
+			switch host {
+			case "mixed.example.com":
+				return []dnsRecord{
+					{ip: net.ParseIP("8.8.8.8").To4(), ttl: time.Minute},
+					{ip: net.ParseIP("192.168.1.1").To4(), ttl: time.Minute},
+				}, nil
+			case "foreign.example.com":
+				return []dnsRecord{
+					{ip: net.ParseIP("8.8.8.8").To4(), ttl: time.Minute},
+					{ip: net.ParseIP("2001:4860::8888"), ttl: time.Minute},
+				}, nil
+			}
+			return nil, &negativeAnswer{ttl: time.Minute}
+		}}),
+	}
+
+	ips, action, err := local.route(context.Background(), "mixed.example.com", "443")
+	require.Nil(t, err)
+	require.Equal(t, actionDirect, action)
+	require.Equal(t, []net.IP{net.ParseIP("192.168.1.1").To4()}, ips)
+
+	ips, action, err = local.route(context.Background(), "foreign.example.com", "443")
+	require.Nil(t, err)
+	require.Equal(t, actionRemote, action)
+	require.Len(t, ips, 2)
+
+	_, _, err = local.route(context.Background(), "nonexistent.example.com", "443")
+	require.NotNil(t, err)
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -11,28 +12,89 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
-	"github.com/golang/groupcache/lru"
 	"github.com/robfig/cron/v3"
 	"github.com/sevlyar/go-daemon"
 )
 
 type options struct {
+	configFile               string
 	remoteProxyMode          bool
 	remoteProxyAddr          string
 	listenAddr               string
 	certFile                 string
 	privateKeyFile           string
 	secretKey                string
+	secretKeyFile            string
 	reversedWebsite          string
 	disableAutoCrossFirewall bool
+	transparent              bool
+	transparentListenAddr    string
+	tproxy                   bool
+	rulesFile                string
+	pacOverridesFile         string
+	tokenSkew                time.Duration
+	legacySecretUntil        string
+	remotePolicy             string
+	healthCheckTarget        string
+	healthCheckInterval      time.Duration
+	adminAddr                string
+	dnsListenAddr            string
+	preferFamily             string
+	remoteDNS                string
+	domesticDomainsFile      string
+	directCountries          string
+	rirs                     string
+	geoIPFile                string
+	ipRangeInterval          time.Duration
 }
 
 var (
-	flags options
+	reloader struct {
+		sync.Mutex
+		reload func() error
+	}
+	stopper struct {
+		sync.Mutex
+		stop func()
+	}
 )
 
+func registerFlags(fs *flag.FlagSet, o *options) {
+	fs.StringVar(&o.configFile, "config", defaultConfigFile(), "config file, flags given on the command line take precedence")
+	fs.BoolVar(&o.remoteProxyMode, "remote-proxy-mode", false, "remote proxy mode")
+	fs.StringVar(&o.remoteProxyAddr, "remote-proxy-addr", "https://yourdomain.com:443", "the remote proxy addresses to connect to, separated by commas")
+	fs.StringVar(&o.remotePolicy, "remote-policy", policyLatency, "how to pick a remote proxy: latency, round-robin or hash")
+	fs.StringVar(&o.healthCheckTarget, "health-check-target", defaultHealthCheckTarget, "the address remote proxies are asked to connect to when health checked")
+	fs.DurationVar(&o.healthCheckInterval, "health-check-interval", defaultHealthCheckInterval, "how often remote proxies are health checked")
+	fs.StringVar(&o.listenAddr, "listen-addr", "127.0.0.1:2286", "listens on given address")
+	fs.StringVar(&o.certFile, "cert-file", "", "cert file path")
+	fs.StringVar(&o.privateKeyFile, "private-key-file", "", "private key file path")
+	fs.StringVar(&o.secretKey, "secret-key", "dbf07cfb73d0bf0777b5", "secrect header key to cross firewall, prefer "+envSecretKey+" or -secret-key-file")
+	fs.StringVar(&o.secretKeyFile, "secret-key-file", "", "file holding the secret key")
+	fs.StringVar(&o.reversedWebsite, "reversed-website", "http://mirrors.codec-cluster.org/", "reversed website to fool firewall")
+	fs.StringVar(&o.directCountries, "direct-countries", defaultDirectCountries, "countries whose addresses are reached directly, separated by commas, e.g. CN,HK")
+	fs.StringVar(&o.rirs, "rirs", defaultRIRs, "registries whose delegated stats the ip ranges are pulled from, separated by commas: apnic, arin, ripencc, lacnic or afrinic")
+	fs.StringVar(&o.geoIPFile, "geoip-db", "", "a MaxMind or DB-IP .mmdb country database the ip ranges are read from instead of the registries")
+	fs.DurationVar(&o.ipRangeInterval, "ip-range-interval", defaultIPRangeInterval, "how often the ip ranges are pulled again")
+	fs.BoolVar(&o.disableAutoCrossFirewall, "disable-auto-cross-firewall", false, "disable auto cross firewall")
+	fs.BoolVar(&o.transparent, "transparent", false, "accept connections redirected by iptables/nftables (linux only)")
+	fs.StringVar(&o.transparentListenAddr, "transparent-listen-addr", ":2287", "listens on given address for redirected connections")
+	fs.BoolVar(&o.tproxy, "tproxy", false, "redirected connections come from TPROXY rather than REDIRECT")
+	fs.StringVar(&o.rulesFile, "rules-file", "", "routing rules consulted before the ip range check, one \"TYPE,value,action\" per line")
+	fs.StringVar(&o.pacOverridesFile, "pac-overrides-file", "", "file of \"direct <domain>\" or \"remote <domain>\" lines, matched before all other rules")
+	fs.DurationVar(&o.tokenSkew, "token-skew", defaultTokenSkew, "maximum clock difference accepted between local and remote proxy")
+	fs.StringVar(&o.preferFamily, "prefer-family", familyIPv6, "address family tried first when connecting directly to a host having both: ipv6 or ipv4")
+	fs.StringVar(&o.remoteDNS, "remote-dns", "", "keep hosts that aren't domestic domains off local DNS: \"list\" sends them to the remote proxy unresolved, \"resolve\" has the remote proxy resolve them")
+	fs.StringVar(&o.domesticDomainsFile, "domestic-domains-file", "", "domains still resolved locally with -remote-dns, one per line or as dnsmasq server lines")
+	fs.StringVar(&o.dnsListenAddr, "dns-listen-addr", "", "serves DNS over udp and tcp on given address for the LAN, disabled if empty")
+	fs.StringVar(&o.adminAddr, "admin-addr", "", "listens on given address for the management API and /metrics, disabled if empty")
+	fs.StringVar(&o.legacySecretUntil, "legacy-secret-until", "", "accept clients sending the plain secret header until given date, e.g. 2006-01-02")
+}
+
 func main() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 	log.SetOutput(os.Stdout)
@@ -40,17 +102,13 @@ func main() {
 	workDir := filepath.Join(os.Getenv("HOME"), ".sandwich")
 	logFile := filepath.Join(workDir, "sandwich.log")
 
-	flag.BoolVar(&flags.remoteProxyMode, "remote-proxy-mode", false, "remote proxy mode")
-	flag.StringVar(&flags.remoteProxyAddr, "remote-proxy-addr", "https://yourdomain.com:443", "the remote proxy address to connect to")
-	flag.StringVar(&flags.listenAddr, "listen-addr", "127.0.0.1:2286", "listens on given address")
-	flag.StringVar(&flags.certFile, "cert-file", "", "cert file path")
-	flag.StringVar(&flags.privateKeyFile, "private-key-file", "", "private key file path")
-	flag.StringVar(&flags.secretKey, "secret-key", "dbf07cfb73d0bf0777b5", "secrect header key to cross firewall")
-	flag.StringVar(&flags.reversedWebsite, "reversed-website", "http://mirrors.codec-cluster.org/", "reversed website to fool firewall")
-	flag.BoolVar(&flags.disableAutoCrossFirewall, "disable-auto-cross-firewall", false, "disable auto cross firewall")
-	flag.Parse()
+	flags, cfg, err := loadOptions(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("error: %s", err.Error())
+	}
 
 	daemon.SetSigHandler(termHandler, syscall.SIGQUIT, syscall.SIGTERM)
+	daemon.SetSigHandler(reloadHandler, syscall.SIGHUP)
 
 	os.MkdirAll(workDir, 0755)
 
@@ -90,7 +148,7 @@ func main() {
 	if flags.remoteProxyMode {
 		go startRemoteProxy(flags, listener, errCh)
 	} else {
-		go startLocalProxy(flags, listener, errCh)
+		go startLocalProxy(flags, cfg, listener, errCh)
 	}
 
 	select {
@@ -103,65 +161,383 @@ func main() {
 	}
 }
 
-func startLocalProxy(o options, listener net.Listener, errChan chan<- error) {
-	var err error
-	u, err := url.Parse(o.remoteProxyAddr)
+func newRemotes(o options) (*remoteSet, error) {
+	switch o.remotePolicy {
+	case policyLatency, policyRoundRobin, policyHash:
+	default:
+		return nil, fmt.Errorf("unknown remote policy %q", o.remotePolicy)
+	}
+
+	auth := newAuthenticator(o.secretKey, o.tokenSkew, time.Time{})
+	remotes := newRemoteSet(o.remotePolicy, o.healthCheckTarget, o.healthCheckInterval)
+	for _, addr := range strings.Split(o.remoteProxyAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		remotes.add(addr, newRemoteDialer(u, auth, remotePoolSize))
+	}
+	return remotes, nil
+}
+
+// newRules returns the rules of the PAC overrides file followed by those of
+// the config file and the rules file.
+func newRules(o options, cfg *fileConfig) (*ruleSet, error) {
+	rules := &ruleSet{}
+	if o.pacOverridesFile != "" {
+		overrides, err := readPACOverrides(o.pacOverridesFile)
+		if err != nil {
+			return nil, err
+		}
+		rules.rules = append(rules.rules, overrides.rules...)
+	}
+	cfgRules, err := parseRules(strings.NewReader(strings.Join(cfg.Rules, "\n")))
 	if err != nil {
+		return nil, err
+	}
+	rules.rules = append(rules.rules, cfgRules.rules...)
+	if o.rulesFile != "" {
+		fileRules, err := readRules(o.rulesFile)
+		if err != nil {
+			return nil, err
+		}
+		rules.rules = append(rules.rules, fileRules.rules...)
+	}
+	if len(rules.rules) == 0 {
+		return nil, nil
+	}
+	return rules, nil
+}
+
+// newDomesticDomains checks the remote DNS mode of o and reads its domestic
+// domains.
+func newDomesticDomains(o options) (*domainList, error) {
+	switch o.remoteDNS {
+	case "", remoteDNSList, remoteDNSResolve:
+	default:
+		return nil, fmt.Errorf("unknown remote dns mode %q", o.remoteDNS)
+	}
+	if o.domesticDomainsFile == "" {
+		return nil, nil
+	}
+	return readDomainList(o.domesticDomainsFile)
+}
+
+// newIPRangeSources parses the direct countries of o and returns the sources
+// of the IP ranges: those of cfg, or those of the registries and the mmdb
+// file of o.
+func newIPRangeSources(o options, cfg *fileConfig) (map[string]bool, []ipRangeSource, error) {
+	countries, err := parseCountries(o.directCountries)
+	if err != nil {
+		return nil, nil, err
+	}
+	rirs, err := parseRIRs(o.rirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if o.ipRangeInterval <= 0 {
+		return nil, nil, fmt.Errorf("bad ip range interval %s", o.ipRangeInterval)
+	}
+	if len(cfg.IPRanges) > 0 {
+		return countries, cfg.IPRanges, nil
+	}
+	return countries, defaultIPRangeSources(rirs, o.geoIPFile), nil
+}
+
+// newDNS chains the resolvers in the order cfg gives, after its static
+// hosts.
+func newDNS(cfg *fileConfig, doh *dnsOverHTTPS, dot *dnsOverTLS) dns {
+	var resolvers []dnsResolver
+	for _, name := range cfg.DNS.resolvers() {
+		r := dnsResolver{name: name}
+		switch name {
+		case resolverHosts:
+			r.lookup = newDNSOverHostsFile(hostsFilePath()).lookup
+		case resolverDoH:
+			r.lookup = doh.lookup
+		case resolverDoT:
+			r.lookup = dot.lookup
+		case resolverSystem:
+			r.lookup = (&dnsOverUDP{servers: cfg.DNS.Servers}).lookup
+		}
+		resolvers = append(resolvers, r)
+	}
+
+	d := newSmartDNS(resolvers...)
+	// the config has been validated.
+	d.static, _ = newStaticHosts(cfg.DNS.Hosts)
+	if cfg.DNS.Strategy != "" {
+		d.strategy = cfg.DNS.Strategy
+	}
+	d.prefer = cfg.DNS.Prefer
+	if cfg.DNS.Grace > 0 {
+		d.grace = cfg.DNS.Grace
+	}
+	if cfg.DNS.Timeout > 0 {
+		d.timeout = cfg.DNS.Timeout
+	}
+	return d
+}
+
+func startLocalProxy(o options, cfg *fileConfig, listener net.Listener, errChan chan<- error) {
+	remotes, err := newRemotes(o)
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	var rules *ruleSet
+	if rules, err = newRules(o, cfg); err != nil {
+		errChan <- err
+		return
+	}
+
+	switch o.preferFamily {
+	case familyIPv6, familyIPv4:
+	default:
+		errChan <- fmt.Errorf("unknown address family %q", o.preferFamily)
+		return
+	}
+
+	var domesticDomains *domainList
+	if domesticDomains, err = newDomesticDomains(o); err != nil {
 		errChan <- err
 		return
 	}
 
-	h := make(http.Header, 0)
-	h.Set(headerSecret, o.secretKey)
+	countries, ipRangeSources, err := newIPRangeSources(o, cfg)
+	if err != nil {
+		errChan <- err
+		return
+	}
 
+	var local *localProxy
 	client := &http.Client{
 		Transport: &http.Transport{
-			Proxy: func(request *http.Request) (i *url.URL, e error) {
-				request.Header.Set(headerSecret, o.secretKey)
-				return u, nil
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return local.dialRemote(ctx, addr, nil)
 			},
-			TLSClientConfig:    &tls.Config{InsecureSkipVerify: false},
-			ProxyConnectHeader: h,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: false},
 		},
 	}
 
-	dns := newSmartDNS(
-		(&dnsOverHostsFile{}).lookup,
-		(&dnsOverHTTPS{client: client}).lookup,
-		(&dnsOverUDP{}).lookup,
-	)
-
-	local := &localProxy{
-		remoteProxyAddr:   u,
-		secretKey:         o.secretKey,
-		chinaIPRangeDB:    newChinaIPRangeDB(),
-		dnsCache:          lru.New(8192),
+	dialRemote := func(ctx context.Context, addr string) (net.Conn, error) {
+		return local.dialRemote(ctx, addr, nil)
+	}
+	subnetFor := func(host string) (*net.IPNet, func([]dnsRecord) bool) {
+		return local.subnetFor(host)
+	}
+	doh := &dnsOverHTTPS{client: client, providers: cfg.DNS.DoH, clientSubnet: subnetFor}
+	dot := newDNSOverTLS(cfg.DNS.DoT, dialRemote)
+	dot.clientSubnet = subnetFor
+	ipRangeDB := newChinaIPRangeDB()
+	local = &localProxy{
+		remotes:           remotes,
+		ipRangeDB:         ipRangeDB,
+		dnsCache:          newHostCache(8192),
 		autoCrossFirewall: !o.disableAutoCrossFirewall,
+		preferFamily:      o.preferFamily,
+		remoteDNS:         o.remoteDNS,
+		domesticDomains:   domesticDomains,
+		directCountries:   countries,
+		ipRangeSources:    ipRangeSources,
+		ipRangeCacheFile:  ipRangeCacheFile(),
 		client:            client,
-		dns:               dns,
+		dns:               newDNS(cfg, doh, dot),
+		dnsConfig:         cfg.DNS,
+		rules:             rules,
+	}
+	local.pac = newPACFile(rules, local.isDirectCountry, ipRangeDB, privateIPRange)
+
+	if err = local.setClientSubnet(cfg.DNS.ClientSubnet); err != nil {
+		errChan <- err
+		return
+	}
+	refreshClientSubnet := func() {
+		if err := local.refreshClientSubnet(context.Background()); err != nil {
+			log.Printf("error: detect client subnet: %s", err.Error())
+		}
+	}
+	go refreshClientSubnet()
+
+	cacheFile := dnsCacheFile()
+	if err = local.loadDNSCache(cacheFile); err != nil && !os.IsNotExist(err) {
+		log.Printf("error: load dns cache: %s", err.Error())
+	}
+	saveDNSCache := func() {
+		if err := local.saveDNSCache(cacheFile); err != nil {
+			log.Printf("error: save dns cache: %s", err.Error())
+		}
+	}
+	setStop(saveDNSCache)
+
+	if o.transparent {
+		transparentListener, err := listenTransparent(o.transparentListenAddr, o.tproxy)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		go func() {
+			errChan <- serveTransparent(transparentListener, local, o.tproxy)
+		}()
+	}
+
+	var dnsServer *dnsServer
+	if o.dnsListenAddr != "" {
+		packetConn, err := net.ListenPacket("udp", o.dnsListenAddr)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		dnsListener, err := net.Listen("tcp", o.dnsListenAddr)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		domestic := &dnsOverUDP{servers: cfg.DNS.Servers}
+		dnsServer = newDNSServer(local, domestic.resolve, domestic.exchange, doh)
+		go func() {
+			errChan <- dnsServer.serveUDP(packetConn)
+		}()
+		go func() {
+			errChan <- dnsServer.serveTCP(dnsListener)
+		}()
+	}
+
+	if o.adminAddr != "" {
+		go func() {
+			errChan <- http.ListenAndServe(o.adminAddr, newAdminServer(local))
+		}()
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	setSysProxy(o.listenAddr)
+	remotes.start()
+
+	pullLatestIPRange := func() {
+		if err := local.pullLatestIPRange(ctx); err != nil {
+			log.Printf("error: pull ip ranges: %s", err.Error())
+		}
+	}
+	pulledAt, err := local.loadIPRangeCache(local.ipRangeCacheFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("error: load ip range cache: %s", err.Error())
+	}
+	// local files are read again at once, they may have been edited.
+	stale := time.Since(pulledAt) >= o.ipRangeInterval
+	for _, s := range ipRangeSources {
+		stale = stale || !s.isRemote()
+	}
+	if stale {
+		go pullLatestIPRange()
+	}
 
 	s := cron.New()
-	s.AddFunc("@every 4h", func() {
-		local.pullLatestIPRange(ctx)
+	ipRangeInterval := o.ipRangeInterval
+	pullEntry, _ := s.AddFunc("@every "+ipRangeInterval.String(), pullLatestIPRange)
+
+	setReload(func() error {
+		o, cfg, err := loadOptions(flag.NewFlagSet(os.Args[0], flag.ContinueOnError), os.Args[1:])
+		if err != nil {
+			return err
+		}
+		remotes, err := newRemotes(o)
+		if err != nil {
+			return err
+		}
+		rules, err := newRules(o, cfg)
+		if err != nil {
+			return err
+		}
+		domesticDomains, err := newDomesticDomains(o)
+		if err != nil {
+			return err
+		}
+		countries, ipRangeSources, err := newIPRangeSources(o, cfg)
+		if err != nil {
+			return err
+		}
+		if err = local.setClientSubnet(cfg.DNS.ClientSubnet); err != nil {
+			return err
+		}
+		go refreshClientSubnet()
+		doh := &dnsOverHTTPS{client: client, providers: cfg.DNS.DoH, clientSubnet: subnetFor}
+		oldDoT := dot
+		dot = newDNSOverTLS(cfg.DNS.DoT, dialRemote)
+		dot.clientSubnet = subnetFor
+		remotes.start()
+		local.setRemoteDNS(o.remoteDNS, domesticDomains)
+		if local.setIPRangeSources(countries, ipRangeSources) {
+			go pullLatestIPRange()
+		}
+		if o.ipRangeInterval != ipRangeInterval {
+			s.Remove(pullEntry)
+			ipRangeInterval = o.ipRangeInterval
+			pullEntry, _ = s.AddFunc("@every "+ipRangeInterval.String(), pullLatestIPRange)
+		}
+		local.update(remotes, rules, newDNS(cfg, doh, dot), cfg.DNS, !o.disableAutoCrossFirewall).stop()
+		oldDoT.close()
+		if dnsServer != nil {
+			domestic := &dnsOverUDP{servers: cfg.DNS.Servers}
+			dnsServer.setResolvers(domestic.resolve, domestic.exchange, doh)
+		}
+		return nil
 	})
+
+	if err = setSysProxy(o.listenAddr); err != nil {
+		log.Printf("error: set system proxy: %s", err.Error())
+	}
+
+	s.AddFunc("@every 10m", saveDNSCache)
+	s.AddFunc("@every 30m", refreshClientSubnet)
 	s.Start()
 
 	defer cancel()
 
-	errChan <- http.Serve(listener, local)
+	errChan <- http.Serve(newMixedListener(listener, local.serveSOCKS), local)
+}
+
+func parseLegacySecretUntil(o options) (time.Time, error) {
+	if o.legacySecretUntil == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", o.legacySecretUntil)
 }
 
 func startRemoteProxy(o options, listener net.Listener, errChan chan<- error) {
-	var err error
+	legacyUntil, err := parseLegacySecretUntil(o)
+	if err != nil {
+		errChan <- err
+		return
+	}
+
 	r := &remoteProxy{
-		secretKey:       o.secretKey,
+		auth:            newAuthenticator(o.secretKey, o.tokenSkew, legacyUntil),
 		reversedWebsite: o.reversedWebsite,
+		lookup:          (&dnsOverUDP{}).resolve,
+	}
+
+	if o.adminAddr != "" {
+		go func() {
+			errChan <- http.ListenAndServe(o.adminAddr, newAdminServer(nil))
+		}()
 	}
+
+	setReload(func() error {
+		o, _, err := loadOptions(flag.NewFlagSet(os.Args[0], flag.ContinueOnError), os.Args[1:])
+		if err != nil {
+			return err
+		}
+		legacyUntil, err := parseLegacySecretUntil(o)
+		if err != nil {
+			return err
+		}
+		r.auth.update(o.secretKey, o.tokenSkew, legacyUntil)
+		r.setReversedWebsite(o.reversedWebsite)
+		return nil
+	})
+
 	if o.certFile != "" && o.privateKeyFile != "" {
 		err = http.ServeTLS(listener, r, o.certFile, o.privateKeyFile)
 	} else {
@@ -170,7 +546,40 @@ func startRemoteProxy(o options, listener net.Listener, errChan chan<- error) {
 	errChan <- err
 }
 
+func setReload(reload func() error) {
+	reloader.Lock()
+	reloader.reload = reload
+	reloader.Unlock()
+}
+
+// reloadHandler applies the config file and flags again. Settings that can't
+// change while listening, like the listen addresses, are left as they are.
+func reloadHandler(_ os.Signal) error {
+	reloader.Lock()
+	defer reloader.Unlock()
+	if reloader.reload == nil {
+		return nil
+	}
+	if err := reloader.reload(); err != nil {
+		log.Printf("error: reload: %s", err.Error())
+		return nil
+	}
+	log.Printf("reloaded")
+	return nil
+}
+
+func setStop(stop func()) {
+	stopper.Lock()
+	stopper.stop = stop
+	stopper.Unlock()
+}
+
 func termHandler(_ os.Signal) (err error) {
+	stopper.Lock()
+	if stopper.stop != nil {
+		stopper.stop()
+	}
+	stopper.Unlock()
 	unsetSysProxy()
 	return daemon.ErrStop
 }
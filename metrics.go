@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	routeDirect    = actionDirect
+	routeRemote    = actionRemote
+	routeReject    = actionReject
+	routeCrossWall = "cross-wall"
+)
+
+// routeCounters are the totals of the connections that took one route.
+type routeCounters struct {
+	opened   int64
+	failed   int64
+	sent     int64
+	received int64
+}
+
+// connTracker keeps the live connections and the totals exposed by the
+// admin API.
+type connTracker struct {
+	sync.Mutex
+	nextID   uint64
+	conns    map[uint64]*trackedConn
+	counters map[string]*routeCounters
+}
+
+var connStats = newConnTracker()
+
+func newConnTracker() *connTracker {
+	t := &connTracker{
+		conns:    make(map[uint64]*trackedConn),
+		counters: make(map[string]*routeCounters),
+	}
+	for _, route := range []string{routeDirect, routeRemote, routeReject, routeCrossWall} {
+		t.counters[route] = &routeCounters{}
+	}
+	return t
+}
+
+// track registers conn, a connection to host opened on behalf of client.
+func (t *connTracker) track(conn net.Conn, client, host string, ip net.IP, route string) *trackedConn {
+	c := &trackedConn{
+		Conn:      conn,
+		tracker:   t,
+		client:    client,
+		host:      host,
+		ip:        ip,
+		route:     route,
+		startedAt: time.Now(),
+		counters:  t.counters[route],
+	}
+	atomic.AddInt64(&c.counters.opened, 1)
+
+	t.Lock()
+	t.nextID++
+	c.id = t.nextID
+	t.conns[c.id] = c
+	t.Unlock()
+	return c
+}
+
+func (t *connTracker) failed(route string) {
+	atomic.AddInt64(&t.counters[route].failed, 1)
+}
+
+func (t *connTracker) rejected() {
+	atomic.AddInt64(&t.counters[routeReject].opened, 1)
+}
+
+func (t *connTracker) untrack(c *trackedConn) {
+	t.Lock()
+	delete(t.conns, c.id)
+	t.Unlock()
+}
+
+// connStatus is a live connection as reported by the admin API.
+type connStatus struct {
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	Host     string    `json:"host"`
+	IP       string    `json:"ip,omitempty"`
+	Route    string    `json:"route"`
+	Sent     int64     `json:"sent"`
+	Received int64     `json:"received"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+}
+
+func (t *connTracker) list() []connStatus {
+	t.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.Unlock()
+
+	statuses := make([]connStatus, len(conns))
+	for i, c := range conns {
+		statuses[i] = c.status()
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+	return statuses
+}
+
+// trackedConn is a connection to a target. transfer counts the bytes written
+// to and read from it.
+type trackedConn struct {
+	net.Conn
+	tracker   *connTracker
+	id        uint64
+	client    string
+	host      string
+	ip        net.IP
+	route     string
+	startedAt time.Time
+	sent      int64
+	received  int64
+	counters  *routeCounters
+	once      sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.tracker.untrack(c)
+	})
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) status() connStatus {
+	s := connStatus{
+		ID:       c.id,
+		Client:   c.client,
+		Host:     c.host,
+		Route:    c.route,
+		Sent:     atomic.LoadInt64(&c.sent),
+		Received: atomic.LoadInt64(&c.received),
+		Started:  c.startedAt,
+		Duration: time.Since(c.startedAt).Round(time.Second).String(),
+	}
+	if c.ip != nil {
+		s.IP = c.ip.String()
+	}
+	return s
+}
+
+// addSent and addReceived count the bytes of datagrams, which don't go
+// through transfer. They do nothing on a nil trackedConn.
+func (c *trackedConn) addSent(n int) {
+	if c != nil {
+		atomic.AddInt64(&c.sent, int64(n))
+		atomic.AddInt64(&c.counters.sent, int64(n))
+	}
+}
+
+func (c *trackedConn) addReceived(n int) {
+	if c != nil {
+		atomic.AddInt64(&c.received, int64(n))
+		atomic.AddInt64(&c.counters.received, int64(n))
+	}
+}
+
+// remoteIP returns the IP address conn is connected to, if it has one.
+func remoteIP(conn net.Conn) net.IP {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// countingWriter adds the bytes written through it to a connection's and a
+// route's counter.
+type countingWriter struct {
+	w     io.Writer
+	conn  *int64
+	route *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.conn, int64(n))
+	atomic.AddInt64(w.route, int64(n))
+	return n, err
+}
+
+// writeMetrics writes the counters in the Prometheus text format. local is
+// nil on the remote proxy.
+func writeMetrics(w io.Writer, t *connTracker, local *localProxy) {
+	routes := make([]string, 0, len(t.counters))
+	for route := range t.counters {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	active := make(map[string]int)
+	for _, c := range t.list() {
+		active[c.Route]++
+	}
+
+	fmt.Fprintln(w, "# HELP sandwich_connections_total Connections opened, by route.")
+	fmt.Fprintln(w, "# TYPE sandwich_connections_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(w, "sandwich_connections_total{route=%q} %d\n", route, atomic.LoadInt64(&t.counters[route].opened))
+	}
+	fmt.Fprintln(w, "# HELP sandwich_connections_failed_total Connections that could not be opened, by route.")
+	fmt.Fprintln(w, "# TYPE sandwich_connections_failed_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(w, "sandwich_connections_failed_total{route=%q} %d\n", route, atomic.LoadInt64(&t.counters[route].failed))
+	}
+	fmt.Fprintln(w, "# HELP sandwich_connections_active Connections open, by route.")
+	fmt.Fprintln(w, "# TYPE sandwich_connections_active gauge")
+	for _, route := range routes {
+		fmt.Fprintf(w, "sandwich_connections_active{route=%q} %d\n", route, active[route])
+	}
+	fmt.Fprintln(w, "# HELP sandwich_bytes_total Bytes sent to and received from targets, by route.")
+	fmt.Fprintln(w, "# TYPE sandwich_bytes_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(w, "sandwich_bytes_total{route=%q,direction=\"sent\"} %d\n", route, atomic.LoadInt64(&t.counters[route].sent))
+		fmt.Fprintf(w, "sandwich_bytes_total{route=%q,direction=\"received\"} %d\n", route, atomic.LoadInt64(&t.counters[route].received))
+	}
+
+	if local == nil {
+		return
+	}
+
+	local.Lock()
+	dnsCacheSize := local.dnsCache.Len()
+	local.Unlock()
+	fmt.Fprintln(w, "# HELP sandwich_dns_cache_entries Hosts in the DNS cache.")
+	fmt.Fprintln(w, "# TYPE sandwich_dns_cache_entries gauge")
+	fmt.Fprintf(w, "sandwich_dns_cache_entries %d\n", dnsCacheSize)
+
+	ipRanges := local.ipRangeDB.Len()
+	fmt.Fprintln(w, "# HELP sandwich_ip_ranges IP ranges reached directly.")
+	fmt.Fprintln(w, "# TYPE sandwich_ip_ranges gauge")
+	fmt.Fprintf(w, "sandwich_ip_ranges %d\n", ipRanges)
+
+	remotes := local.remoteStatuses()
+	fmt.Fprintln(w, "# HELP sandwich_remote_up Whether the last health check of a remote proxy passed.")
+	fmt.Fprintln(w, "# TYPE sandwich_remote_up gauge")
+	for _, r := range remotes {
+		up := 0
+		if r.Healthy {
+			up = 1
+		}
+		fmt.Fprintf(w, "sandwich_remote_up{remote=%q} %d\n", r.Name, up)
+	}
+	fmt.Fprintln(w, "# HELP sandwich_remote_latency_seconds Latency measured by the last passed health check of a remote proxy.")
+	fmt.Fprintln(w, "# TYPE sandwich_remote_latency_seconds gauge")
+	for _, r := range remotes {
+		fmt.Fprintf(w, "sandwich_remote_latency_seconds{remote=%q} %g\n", r.Name, r.latency.Seconds())
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// mmdbMetadataMarker starts the metadata section at the end of a MaxMind DB
+// file, https://maxmind.github.io/MaxMind-DB/.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	mmdbDataSectionSeparator = 16
+	maxMMDBDepth             = 32
+)
+
+var errMMDBCorrupt = errors.New("mmdb: corrupt database")
+
+// mmdbReader reads the networks of a MaxMind DB file, like the GeoIP2 and
+// GeoLite2 country databases or those of DB-IP.
+type mmdbReader struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint
+	version    string
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	at := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if at < 0 {
+		return nil, errors.New("mmdb: no metadata")
+	}
+	metadataStart := uint(at + len(mmdbMetadataMarker))
+	d := mmdbDecoder{data: buf[metadataStart:]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBCorrupt
+	}
+
+	r := &mmdbReader{buf: buf}
+	r.nodeCount, _ = mmdbUint(metadata["node_count"])
+	r.recordSize, _ = mmdbUint(metadata["record_size"])
+	r.ipVersion, _ = mmdbUint(metadata["ip_version"])
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("mmdb: unsupported ip version %d", r.ipVersion)
+	}
+	r.dataStart = r.nodeCount*r.recordSize/4 + mmdbDataSectionSeparator
+	if r.dataStart > metadataStart {
+		return nil, errMMDBCorrupt
+	}
+
+	typ, _ := metadata["database_type"].(string)
+	epoch, _ := mmdbUint(metadata["build_epoch"])
+	r.version = fmt.Sprintf("%s-%d", typ, epoch)
+	return r, nil
+}
+
+// record returns the left or right record of node.
+func (r *mmdbReader) record(node uint, right bool) (uint, error) {
+	size := r.recordSize / 4
+	off := node * size
+	if off+size > r.dataStart-mmdbDataSectionSeparator {
+		return 0, errMMDBCorrupt
+	}
+	b := r.buf[off : off+size]
+	switch r.recordSize {
+	case 24:
+		if right {
+			return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5]), nil
+		}
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+	case 28:
+		// the middle byte holds the high nibbles of both records.
+		if right {
+			return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+		}
+		return uint(b[3]>>4)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+	default:
+		if right {
+			return uint(binary.BigEndian.Uint32(b[4:])), nil
+		}
+		return uint(binary.BigEndian.Uint32(b)), nil
+	}
+}
+
+// networks calls f for every network having data, with the offset of its data
+// in the data section. IPv4 networks are reported as such, the aliases IPv6
+// databases have for them are skipped.
+func (r *mmdbReader) networks(f func(network *net.IPNet, data uint) error) error {
+	bits := 32
+	if r.ipVersion == 6 {
+		bits = 128
+	}
+	return r.walk(0, make(net.IP, bits/8), 0, f)
+}
+
+func (r *mmdbReader) walk(node uint, ip net.IP, depth int, f func(*net.IPNet, uint) error) error {
+	bits := len(ip) * 8
+	if len(ip) == net.IPv6len && depth == 16 && (ip[0] == 0x20 && ip[1] == 0x02) {
+		// 2002::/16, 6to4, maps IPv4.
+		return nil
+	}
+	if len(ip) == net.IPv6len && depth == 96 && ip[10] == 0xff && ip[11] == 0xff && isZero(ip[:10]) {
+		// ::ffff:0:0/96 maps IPv4.
+		return nil
+	}
+
+	for _, right := range []bool{false, true} {
+		next := append(net.IP(nil), ip...)
+		if right {
+			next[depth/8] |= 0x80 >> uint(depth%8)
+		}
+		record, err := r.record(node, right)
+		if err != nil {
+			return err
+		}
+		switch {
+		case record < r.nodeCount:
+			if depth+1 >= bits {
+				return errMMDBCorrupt
+			}
+			if err = r.walk(record, next, depth+1, f); err != nil {
+				return err
+			}
+		case record > r.nodeCount:
+			network := &net.IPNet{IP: next, Mask: net.CIDRMask(depth+1, bits)}
+			if len(next) == net.IPv6len && depth+1 > 96 && isZero(next[:12]) {
+				// ::/96 holds the IPv4 networks of IPv6 databases.
+				network = &net.IPNet{IP: next[12:], Mask: net.CIDRMask(depth+1-96, 32)}
+			}
+			if err = f(network, record-r.nodeCount-mmdbDataSectionSeparator); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// data decodes the data at off in the data section.
+func (r *mmdbReader) data(off uint) (interface{}, error) {
+	d := mmdbDecoder{data: r.buf[r.dataStart:]}
+	v, _, err := d.decode(off, 0)
+	return v, err
+}
+
+// mmdbDecoder decodes the data format of MaxMind DB files into maps, slices,
+// strings, []byte, uint64, int32, float64 and bool.
+type mmdbDecoder struct {
+	data []byte
+}
+
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// decode returns the value at off and the offset following it.
+func (d *mmdbDecoder) decode(off uint, depth int) (interface{}, uint, error) {
+	if depth > maxMMDBDepth {
+		return nil, 0, errMMDBCorrupt
+	}
+	typ, size, off, err := d.control(off)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == mmdbPointer {
+		ptr, next, err := d.pointer(size, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, next, err
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			if k, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, off, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+	case mmdbBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(d.data)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b := d.data[off : off+size]
+	off += size
+	switch typ {
+	case mmdbString:
+		return string(b), off, nil
+	case mmdbBytes, mmdbUint128:
+		return append([]byte(nil), b...), off, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		if size > 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if typ == mmdbInt32 {
+			return int32(v), off, nil
+		}
+		return v, off, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unknown data type %d", typ)
+}
+
+// control reads the control byte at off: the type and the size of the value
+// following it.
+func (d *mmdbDecoder) control(off uint) (typ, size, next uint, err error) {
+	if off >= uint(len(d.data)) {
+		return 0, 0, 0, errMMDBCorrupt
+	}
+	c := d.data[off]
+	off++
+	typ = uint(c >> 5)
+	if typ == mmdbExtended {
+		if off >= uint(len(d.data)) {
+			return 0, 0, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(d.data[off])
+		off++
+	}
+	size = uint(c & 0x1f)
+	if typ == mmdbPointer || size < 29 {
+		return typ, size, off, nil
+	}
+
+	n := size - 28
+	if off+n > uint(len(d.data)) {
+		return 0, 0, 0, errMMDBCorrupt
+	}
+	var v uint
+	for _, b := range d.data[off : off+n] {
+		v = v<<8 | uint(b)
+	}
+	switch n {
+	case 1:
+		size = 29 + v
+	case 2:
+		size = 285 + v
+	default:
+		size = 65821 + v
+	}
+	return typ, size, off + n, nil
+}
+
+// pointer reads the pointer whose control byte had size, returning the offset
+// it points to and the one following it.
+func (d *mmdbDecoder) pointer(size, off uint) (uint, uint, error) {
+	n := (size>>3)&0x3 + 1
+	if off+n > uint(len(d.data)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	var v uint
+	for _, b := range d.data[off : off+n] {
+		v = v<<8 | uint(b)
+	}
+	switch n {
+	case 1:
+		v |= (size & 0x7) << 8
+	case 2:
+		v = (size&0x7)<<16 | v + 2048
+	case 3:
+		v = (size&0x7)<<24 | v + 526336
+	}
+	return v, off + n, nil
+}
+
+func mmdbUint(v interface{}) (uint, bool) {
+	n, ok := v.(uint64)
+	return uint(n), ok
+}
+
+// mmdbCountry returns the ISO code of the country of a GeoIP2 or DB-IP
+// record, the registered country when the country isn't known.
+func mmdbCountry(record interface{}) string {
+	m, _ := record.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := m[key].(map[string]interface{})
+		if code, ok := country["iso_code"].(string); ok && code != "" {
+			return code
+		}
+	}
+	return ""
+}
+
+// parseMMDB returns the ranges of a MaxMind DB file in the countries given.
+func parseMMDB(buf []byte, countries map[string]bool) ([]*ipRange, string, error) {
+	r, err := newMMDBReader(buf)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// networks share the records of their country.
+	known := make(map[uint]string)
+	var ranges []*ipRange
+	err = r.networks(func(network *net.IPNet, off uint) error {
+		country, ok := known[off]
+		if !ok {
+			record, err := r.data(off)
+			if err != nil {
+				return err
+			}
+			country = mmdbCountry(record)
+			known[off] = country
+		}
+		if countries[country] {
+			ranges = append(ranges, &ipRange{value: network.String(), country: country})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return ranges, r.version, nil
+}
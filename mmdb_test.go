@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testMMDBNode is a node of the search tree of a test MaxMind DB, each side
+// either a child or the index of a data record plus one.
+type testMMDBNode struct {
+	children [2]*testMMDBNode
+	data     [2]int
+}
+
+type testMMDB struct {
+	root      *testMMDBNode
+	bits      int
+	data      []byte
+	countries map[string]int
+}
+
+func newTestMMDB(ipVersion int) *testMMDB {
+	bits := 32
+	if ipVersion == 6 {
+		bits = 128
+	}
+	return &testMMDB{root: &testMMDBNode{}, bits: bits, countries: make(map[string]int)}
+}
+
+func (db *testMMDB) bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>uint(7-i%8)) & 1
+}
+
+func (db *testMMDB) ip(s string) net.IP {
+	ip := net.ParseIP(s)
+	if db.bits == 32 {
+		return ip.To4()
+	}
+	if ip4 := ip.To4(); ip4 != nil && s[0] != ':' {
+		// IPv4 networks live in ::/96.
+		return append(make(net.IP, 12), ip4...)
+	}
+	return ip.To16()
+}
+
+// node returns the node at prefix, creating the path to it.
+func (db *testMMDB) node(ip net.IP, prefix int) *testMMDBNode {
+	n := db.root
+	for i := 0; i < prefix; i++ {
+		b := db.bit(ip, i)
+		if n.children[b] == nil {
+			n.children[b] = &testMMDBNode{}
+		}
+		n = n.children[b]
+	}
+	return n
+}
+
+// insert maps network to a record of country, in key when key isn't
+// "country". The country name is written once and pointed to afterwards.
+func (db *testMMDB) insert(network, key, country string) {
+	ip, ipNet, _ := net.ParseCIDR(network)
+	ones, _ := ipNet.Mask.Size()
+	addr := db.ip(ip.String())
+	if len(addr) == net.IPv6len && ip.To4() != nil {
+		ones += 96
+	}
+
+	off := len(db.data)
+	db.data = append(db.data, 7<<5|1)
+	db.data = appendTestMMDBString(db.data, key)
+	db.data = append(db.data, 7<<5|1)
+	db.data = appendTestMMDBString(db.data, "iso_code")
+	if at, ok := db.countries[country]; ok {
+		db.data = append(db.data, 1<<5|byte(at>>8), byte(at))
+	} else {
+		db.countries[country] = len(db.data)
+		db.data = appendTestMMDBString(db.data, country)
+	}
+
+	parent := db.node(addr, ones-1)
+	parent.data[db.bit(addr, ones-1)] = off + 1
+}
+
+// alias makes the network at from lead to the node at to.
+func (db *testMMDB) alias(from, to string, prefix int) {
+	addr := db.ip(from)
+	parent := db.node(addr, prefix-1)
+	parent.children[db.bit(addr, prefix-1)] = db.node(db.ip(to), prefix)
+}
+
+func (db *testMMDB) build(recordSize int) []byte {
+	numbers := map[*testMMDBNode]int{}
+	var nodes []*testMMDBNode
+	queue := []*testMMDBNode{db.root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if _, ok := numbers[n]; ok {
+			continue
+		}
+		numbers[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	nodeCount := len(nodes)
+	var buf []byte
+	for _, n := range nodes {
+		var records [2]uint32
+		for i := range records {
+			switch {
+			case n.children[i] != nil:
+				records[i] = uint32(numbers[n.children[i]])
+			case n.data[i] > 0:
+				records[i] = uint32(nodeCount + mmdbDataSectionSeparator + n.data[i] - 1)
+			default:
+				records[i] = uint32(nodeCount)
+			}
+		}
+		switch recordSize {
+		case 24:
+			l, r := records[0], records[1]
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			l, r := records[0], records[1]
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(r>>24)&0x0f, byte(r>>16), byte(r>>8), byte(r))
+		default:
+			buf = appendUint32(appendUint32(buf, records[0]), records[1])
+		}
+	}
+	buf = append(buf, make([]byte, mmdbDataSectionSeparator)...)
+	buf = append(buf, db.data...)
+
+	ipVersion := uint16(4)
+	if db.bits == 128 {
+		ipVersion = 6
+	}
+	buf = append(buf, mmdbMetadataMarker...)
+	buf = append(buf, 7<<5|5)
+	buf = appendTestMMDBString(buf, "node_count")
+	buf = append(buf, 6<<5|4)
+	buf = appendUint32(buf, uint32(nodeCount))
+	buf = appendTestMMDBString(buf, "record_size")
+	buf = append(buf, 5<<5|2)
+	buf = appendUint16(buf, uint16(recordSize))
+	buf = appendTestMMDBString(buf, "ip_version")
+	buf = append(buf, 5<<5|2)
+	buf = appendUint16(buf, ipVersion)
+	buf = appendTestMMDBString(buf, "database_type")
+	buf = appendTestMMDBString(buf, "Test-Country")
+	buf = appendTestMMDBString(buf, "build_epoch")
+	buf = append(buf, 0<<5|8, mmdbUint64-7)
+	var epoch [8]byte
+	binary.BigEndian.PutUint64(epoch[:], 1600000000)
+	return append(buf, epoch[:]...)
+}
+
+func appendTestMMDBString(b []byte, s string) []byte {
+	return append(append(b, 2<<5|byte(len(s))), s...)
+}
+
+func TestMMDBReader(t *testing.T) {
+	db := newTestMMDB(6)
+	db.insert("1.2.3.0/24", "country", "CN")
+	db.insert("8.8.8.0/24", "country", "US")
+	db.insert("2001:da8::/32", "country", "CN")
+	db.insert("2001:db8::/32", "registered_country", "JP")
+	db.alias("::ffff:0:0", "::", 96)
+	db.alias("2002::", "::", 16)
+
+	for _, recordSize := range []int{24, 28, 32} {
+		r, err := newMMDBReader(db.build(recordSize))
+		require.Nil(t, err)
+		require.Equal(t, "Test-Country-1600000000", r.version)
+
+		networks := map[string]string{}
+		err = r.networks(func(network *net.IPNet, off uint) error {
+			record, err := r.data(off)
+			require.Nil(t, err)
+			networks[network.String()] = mmdbCountry(record)
+			return nil
+		})
+		require.Nil(t, err)
+		require.Equal(t, map[string]string{
+			"1.2.3.0/24":    "CN",
+			"8.8.8.0/24":    "US",
+			"2001:da8::/32": "CN",
+			"2001:db8::/32": "JP",
+		}, networks, recordSize)
+	}
+
+	_, err := newMMDBReader([]byte("not a database"))
+	require.NotNil(t, err)
+	buf := db.build(24)
+	_, err = newMMDBReader(buf[len(buf)-40:])
+	require.NotNil(t, err)
+}
+
+func TestParseMMDB(t *testing.T) {
+	db := newTestMMDB(4)
+	db.insert("1.2.3.0/24", "country", "CN")
+	db.insert("5.6.0.0/16", "country", "HK")
+	db.insert("8.8.8.0/24", "country", "US")
+
+	ranges, version, err := parseMMDB(db.build(24), map[string]bool{"CN": true, "HK": true})
+	require.Nil(t, err)
+	require.Equal(t, "Test-Country-1600000000", version)
+	require.Equal(t, []*ipRange{
+		{value: "1.2.3.0/24", country: "CN"},
+		{value: "5.6.0.0/16", country: "HK"},
+	}, ranges)
+
+	_, _, err = parseMMDB(db.build(24)[:100], nil)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode"
+)
+
+const pacTemplate = `var proxy = "PROXY %[1]s; SOCKS5 %[1]s";
+
+function resolveIPv4(host) {
+	var ip = dnsResolve(host);
+	if (!ip || ip.indexOf(":") >= 0) {
+		return null;
+	}
+	var parts = ip.split(".");
+	return ((+parts[0]) * 16777216) + ((+parts[1]) << 16) + ((+parts[2]) << 8) + (+parts[3]);
+}
+
+function urlPort(url) {
+	var m = url.match(/^([a-z]+):\/\/(\[[^\]]*\]|[^\/:]*)(:(\d+))?/i);
+	if (m && m[4]) {
+		return +m[4];
+	}
+	return m && m[1].toLowerCase() === "https" ? 443 : 80;
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (isPlainHostName(host)) {
+		return "DIRECT";
+	}
+
+	var ip;
+	for (var i = 0; i < rules.length; i++) {
+		var r = rules[i], matched = false;
+		switch (r[0]) {
+		case "DOMAIN":
+			matched = host === r[1];
+			break;
+		case "DOMAIN-SUFFIX":
+			matched = host === r[1] || host.substring(host.length - r[1].length - 1) === "." + r[1];
+			break;
+		case "DOMAIN-KEYWORD":
+			matched = host.indexOf(r[1]) >= 0;
+			break;
+		case "DOMAIN-REGEX":
+			matched = r[1].test(host);
+			break;
+		case "IP-CIDR":
+			if (ip === undefined) {
+				ip = resolveIPv4(host);
+			}
+			matched = ip !== null && ip >= r[1] && ip <= r[2];
+			break;
+		case "DST-PORT":
+			var port = urlPort(url);
+			matched = port >= r[1] && port <= r[2];
+			break;
+		case "FINAL":
+			matched = true;
+			break;
+		}
+		if (matched) {
+			return r[r.length - 1] === "direct" ? "DIRECT" : proxy;
+		}
+	}
+
+	if (ip === undefined) {
+		ip = resolveIPv4(host);
+	}
+	if (ip === null) {
+		return proxy;
+	}
+
+	var lo = 0, hi = directRanges.length / 2 - 1;
+	while (lo <= hi) {
+		var mid = (lo + hi) >> 1;
+		if (ip < directRanges[2 * mid]) {
+			hi = mid - 1;
+		} else if (ip > directRanges[2 * mid + 1]) {
+			lo = mid + 1;
+		} else {
+			return "DIRECT";
+		}
+	}
+	return proxy;
+}
+`
+
+// pacFile renders a proxy auto-config script that lets browsers do the
+// direct/remote split themselves. Browsers only hand IPv4 results of
+// dnsResolve to the script, so only IPv4 ranges and IPv4 CIDR rules are
+// rendered. Rejected destinations are sent to the proxy, which rejects them.
+type pacFile struct {
+	sync.Mutex
+	dbs    []*IPRangeDB
+	direct func(country string) bool
+	rules  *ruleSet
+	data   []byte
+}
+
+// newPACFile renders the ranges of dbs whose country direct reports as
+// reached directly.
+func newPACFile(rules *ruleSet, direct func(country string) bool, dbs ...*IPRangeDB) *pacFile {
+	return &pacFile{
+		dbs:    dbs,
+		direct: direct,
+		rules:  rules,
+	}
+}
+
+// invalidate drops the rendered rules and ranges, they are rendered again on
+// next use.
+func (p *pacFile) invalidate() {
+	p.Lock()
+	p.data = nil
+	p.Unlock()
+}
+
+func (p *pacFile) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	proxyAddr, err := pacProxyAddr(req.Host)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	rw.Write(p.render(proxyAddr))
+}
+
+// pacProxyAddr returns the proxy address for the Host header of a PAC
+// request, it's put in the script as is so only host:port is accepted.
+func pacProxyAddr(hostport string) (string, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", fmt.Errorf("bad host %q", hostport)
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("bad port %q", port)
+	}
+	if net.ParseIP(host) == nil {
+		if host == "" {
+			return "", fmt.Errorf("bad host %q", hostport)
+		}
+		for _, c := range host {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+				return "", fmt.Errorf("bad host %q", hostport)
+			}
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// render returns the PAC script pointing browsers at proxyAddr.
+func (p *pacFile) render(proxyAddr string) []byte {
+	p.Lock()
+	if p.data == nil {
+		p.data = p.renderData()
+	}
+	data := p.data
+	p.Unlock()
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(data)
+	fmt.Fprintf(buf, pacTemplate, proxyAddr)
+	return buf.Bytes()
+}
+
+func (p *pacFile) renderData() []byte {
+	buf := bytes.NewBuffer(nil)
+
+	buf.WriteString("var rules = [")
+	n := 0
+	if p.rules != nil {
+		for _, r := range p.rules.rules {
+			entry := pacRule(r)
+			if entry == "" {
+				continue
+			}
+			if n > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString("\n\t")
+			buf.WriteString(entry)
+			n++
+		}
+	}
+	buf.WriteString("\n];\n")
+
+	buf.WriteString("var directRanges = [")
+	for i, r := range pacRanges(p.direct, p.dbs...) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if i%8 == 0 {
+			buf.WriteString("\n\t")
+		}
+		fmt.Fprintf(buf, "%d,%d", r[0], r[1])
+	}
+	buf.WriteString("\n];\n\n")
+	return buf.Bytes()
+}
+
+// pacRule renders r as a JavaScript array, or returns an empty string if the
+// rule can't be evaluated by a PAC script.
+func pacRule(r *rule) string {
+	action := strconv.Quote(r.action)
+	switch r.typ {
+	case ruleDomain, ruleDomainSuffix, ruleDomainKeyword:
+		return fmt.Sprintf("[%s, %s, %s]", strconv.Quote(r.typ), strconv.Quote(r.value), action)
+	case ruleDomainRegex:
+		return fmt.Sprintf("[%s, /%s/, %s]", strconv.Quote(r.typ), r.jsRegex, action)
+	case ruleIPCIDR:
+		ip := r.ipNet.IP.To4()
+		if ip == nil || len(r.ipNet.Mask) != net.IPv4len {
+			return ""
+		}
+		min := binary.BigEndian.Uint32(ip)
+		max := min | ^binary.BigEndian.Uint32(r.ipNet.Mask)
+		return fmt.Sprintf("[%s, %d, %d, %s]", strconv.Quote(r.typ), min, max, action)
+	case ruleDstPort:
+		return fmt.Sprintf("[%s, %d, %d, %s]", strconv.Quote(r.typ), r.minPort, r.maxPort, action)
+	case ruleFinal:
+		return fmt.Sprintf("[%s, %s]", strconv.Quote(r.typ), action)
+	}
+	return ""
+}
+
+// pacRegex rewrites the Go regexp pattern in JavaScript syntax, so that the
+// PAC script matches host names just as the proxy does. Only the constructs
+// both agree on for host names are accepted.
+func pacRegex(pattern string) (string, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.NewBuffer(nil)
+	if err = writePACRegex(buf, re); err != nil {
+		return "", fmt.Errorf("%s in %q can't be used in the PAC file", err.Error(), pattern)
+	}
+	return buf.String(), nil
+}
+
+func writePACRegex(buf *bytes.Buffer, re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		buf.WriteString(`[^\s\S]`)
+	case syntax.OpEmptyMatch:
+		buf.WriteString("(?:)")
+	case syntax.OpLiteral:
+		for _, c := range re.Rune {
+			if c > 0xffff {
+				return fmt.Errorf("character %q", c)
+			}
+			if re.Flags&syntax.FoldCase != 0 && unicode.SimpleFold(c) != c {
+				buf.WriteByte('[')
+				for f := c; ; {
+					writePACRune(buf, f)
+					if f = unicode.SimpleFold(f); f == c {
+						break
+					}
+				}
+				buf.WriteByte(']')
+				continue
+			}
+			writePACRune(buf, c)
+		}
+	case syntax.OpCharClass:
+		buf.WriteByte('[')
+		n := 0
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			if lo > 0xffff {
+				continue
+			}
+			if hi > 0xffff {
+				hi = 0xffff
+			}
+			writePACRune(buf, lo)
+			buf.WriteByte('-')
+			writePACRune(buf, hi)
+			n++
+		}
+		if n == 0 {
+			buf.WriteString(`^\s\S`)
+		}
+		buf.WriteByte(']')
+	case syntax.OpAnyCharNotNL:
+		buf.WriteString(`[^\n]`)
+	case syntax.OpAnyChar:
+		buf.WriteString(`[\s\S]`)
+	case syntax.OpBeginLine, syntax.OpBeginText:
+		// Host names have no newlines, a line is the whole text.
+		buf.WriteByte('^')
+	case syntax.OpEndLine, syntax.OpEndText:
+		buf.WriteByte('$')
+	case syntax.OpWordBoundary:
+		buf.WriteString(`\b`)
+	case syntax.OpNoWordBoundary:
+		buf.WriteString(`\B`)
+	case syntax.OpCapture:
+		buf.WriteString("(?:")
+		if err := writePACRegex(buf, re.Sub[0]); err != nil {
+			return err
+		}
+		buf.WriteByte(')')
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		buf.WriteString("(?:")
+		if err := writePACRegex(buf, re.Sub[0]); err != nil {
+			return err
+		}
+		buf.WriteByte(')')
+		switch {
+		case re.Op == syntax.OpStar:
+			buf.WriteByte('*')
+		case re.Op == syntax.OpPlus:
+			buf.WriteByte('+')
+		case re.Op == syntax.OpQuest:
+			buf.WriteByte('?')
+		case re.Max < 0:
+			fmt.Fprintf(buf, "{%d,}", re.Min)
+		default:
+			fmt.Fprintf(buf, "{%d,%d}", re.Min, re.Max)
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if err := writePACRegex(buf, sub); err != nil {
+				return err
+			}
+		}
+	case syntax.OpAlternate:
+		buf.WriteString("(?:")
+		for i, sub := range re.Sub {
+			if i > 0 {
+				buf.WriteByte('|')
+			}
+			if err := writePACRegex(buf, sub); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(')')
+	default:
+		return fmt.Errorf("%s", re)
+	}
+	return nil
+}
+
+// writePACRune writes c as an escape, which means c alone anywhere in a
+// JavaScript regular expression.
+func writePACRune(buf *bytes.Buffer, c rune) {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		buf.WriteRune(c)
+		return
+	}
+	fmt.Fprintf(buf, `\u%04x`, c)
+}
+
+// pacRanges returns the IPv4 ranges of dbs in the countries direct accepts
+// as sorted, merged [min, max] pairs.
+func pacRanges(direct func(country string) bool, dbs ...*IPRangeDB) [][2]uint32 {
+	var ranges [][2]uint32
+	for _, db := range dbs {
+		db.RLock()
+		for _, r := range db.db {
+			if len(r.min) != net.IPv4len || !direct(r.country) {
+				continue
+			}
+			ranges = append(ranges, [2]uint32{binary.BigEndian.Uint32(r.min), binary.BigEndian.Uint32(r.max)})
+		}
+		db.RUnlock()
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0] < ranges[j][0]
+	})
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && uint64(r[0]) <= uint64(merged[n-1][1])+1 {
+			if r[1] > merged[n-1][1] {
+				merged[n-1][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPACRanges(t *testing.T) {
+	db := &IPRangeDB{
+		db: []*ipRange{
+			{value: "10.0.0.0/8"},
+			{value: "1.0.1.0/24"},
+			{value: "1.0.2.0/23"},
+			{value: "2001:da8::/32"},
+			{value: "1.0.4.0/24", country: "CN"},
+			{value: "1.0.8.0/24", country: "HK"},
+		},
+	}
+	db.init()
+
+	local := &localProxy{}
+	ranges := pacRanges(local.isDirectCountry, db)
+	require.Equal(t, [][2]uint32{
+		{0x01000100, 0x010004ff},
+		{0x0a000000, 0x0affffff},
+	}, ranges)
+
+	local.directCountries = map[string]bool{"HK": true}
+	ranges = pacRanges(local.isDirectCountry, db)
+	require.Equal(t, [][2]uint32{
+		{0x01000100, 0x010003ff},
+		{0x01000800, 0x010008ff},
+		{0x0a000000, 0x0affffff},
+	}, ranges)
+}
+
+func TestPACFile(t *testing.T) {
+	rules, err := parseRules(strings.NewReader("DOMAIN-SUFFIX,qq.com,direct\nIP-CIDR,8.8.8.0/24,remote\nIP-CIDR,2001:4860::/32,remote\n"))
+	require.Nil(t, err)
+
+	local := &localProxy{}
+	local.pac = newPACFile(rules, local.isDirectCountry, privateIPRange)
+	req := httptest.NewRequest(http.MethodGet, "/wpad.dat", nil)
+	req.Host = "192.168.1.2:2286"
+	rw := httptest.NewRecorder()
+	local.ServeHTTP(rw, req)
+	require.Equal(t, "application/x-ns-proxy-autoconfig", rw.Header().Get("Content-Type"))
+
+	script := rw.Body.String()
+	require.True(t, strings.Contains(script, `"PROXY 192.168.1.2:2286; SOCKS5 192.168.1.2:2286"`))
+	require.True(t, strings.Contains(script, `["DOMAIN-SUFFIX", "qq.com", "direct"]`))
+	require.True(t, strings.Contains(script, `["IP-CIDR", 134744064, 134744319, "remote"]`))
+	require.False(t, strings.Contains(script, "2001:4860"))
+	require.True(t, strings.Contains(script, "3232235520,3232301055"))
+
+	rw = httptest.NewRecorder()
+	local.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusNotFound, rw.Code)
+
+	for _, host := range []string{`x";alert(1);"`, "192.168.1.2", "a b:2286", "192.168.1.2:http"} {
+		req = httptest.NewRequest(http.MethodGet, "/proxy.pac", nil)
+		req.Host = host
+		rw = httptest.NewRecorder()
+		local.ServeHTTP(rw, req)
+		require.Equal(t, http.StatusBadRequest, rw.Code, host)
+	}
+}
+
+func TestPACRegex(t *testing.T) {
+	cases := []struct {
+		pattern string
+		js      string
+	}{
+		{`^cdn[0-9]+\.qq\.com$`, `^cdn(?:[0-9])+\u002eqq\u002ecom$`},
+		{`(?i)Ab|c{2,}`, `(?:[Aa][Bb]|(?:[Cc]){2,})`},
+		{`[[:alpha:]]\b.`, `[A-Za-z]\b[^\n]`},
+	}
+	for _, c := range cases {
+		js, err := pacRegex(c.pattern)
+		require.Nil(t, err, c.pattern)
+		require.Equal(t, c.js, js, c.pattern)
+	}
+
+	_, err := pacRegex("\U0001F600")
+	require.NotNil(t, err)
+}
+
+func TestPACProxyAddr(t *testing.T) {
+	addr, err := pacProxyAddr("proxy.lan:2286")
+	require.Nil(t, err)
+	require.Equal(t, "proxy.lan:2286", addr)
+
+	addr, err = pacProxyAddr("[fe80::1]:2286")
+	require.Nil(t, err)
+	require.Equal(t, "[fe80::1]:2286", addr)
+
+	_, err = pacProxyAddr(`proxy";x=":2286`)
+	require.NotNil(t, err)
+}
@@ -8,17 +8,26 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 
 	"github.com/juju/ratelimit"
 )
 
 type remoteProxy struct {
-	secretKey       string
+	sync.RWMutex
+	auth            *authenticator
 	reversedWebsite string
+	lookup          resolveFunc
+}
+
+func (s *remoteProxy) setReversedWebsite(reversedWebsite string) {
+	s.Lock()
+	s.reversedWebsite = reversedWebsite
+	s.Unlock()
 }
 
 func (s *remoteProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if req.Header.Get(headerSecret) == s.secretKey {
+	if s.auth.verify(req) {
 		s.crossWall(rw, req)
 		return
 	}
@@ -28,30 +37,64 @@ func (s *remoteProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 func (s *remoteProxy) crossWall(rw http.ResponseWriter, req *http.Request) {
 	req.Header.Del(headerSecret)
+	req.Header.Del(headerToken)
+	if req.Method == http.MethodConnect && req.Header.Get(headerResolve) != "" {
+		s.resolve(rw, req)
+		return
+	}
 	targetAddr := appendPort(req.Host, req.URL.Scheme)
 
-	target, err := net.Dial("tcp", targetAddr)
+	network := "tcp"
+	if req.Method == http.MethodConnect && req.Header.Get(headerNetwork) == "udp" {
+		network = "udp"
+	}
+
+	conn, err := net.Dial(network, targetAddr)
 	if err != nil {
+		connStats.failed(routeCrossWall)
 		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
-
-	localProxy, _, _ := rw.(http.Hijacker).Hijack()
-
-	if req.Method == http.MethodConnect {
-		localProxy.Write([]byte(fmt.Sprintf("%s 200 OK\r\n\r\n", req.Proto)))
+	target := connStats.track(conn, req.RemoteAddr, targetAddr, remoteIP(conn), routeCrossWall)
+
+	var localProxy net.Conn
+	if req.ProtoMajor == 2 {
+		// HTTP/2 streams can't be hijacked, the tunnel is carried by the
+		// request and response bodies instead.
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		localProxy = newStreamConn(req.Body, flushWriter{rw: rw}, req.Body)
 	} else {
-		req.Write(target)
+		localProxy, _, _ = rw.(http.Hijacker).Hijack()
+		if req.Method == http.MethodConnect {
+			localProxy.Write([]byte(fmt.Sprintf("%s 200 OK\r\n\r\n", req.Proto)))
+		} else {
+			req.Write(target)
+		}
+	}
+
+	if network == "udp" {
+		relayUDP(newDatagramConn(localProxy), target)
+		return
 	}
 
-	go transfer(localProxy, target)
+	// the handler must not return while the response is still being written.
+	done := make(chan struct{})
+	go func() {
+		transfer(localProxy, target)
+		close(done)
+	}()
 	transfer(target, localProxy)
+	<-done
 }
 
 func (s *remoteProxy) reverseProxy(rw http.ResponseWriter, req *http.Request) {
 	var u *url.URL
 	var err error
-	if u, err = url.Parse(s.reversedWebsite); err != nil {
+	s.RLock()
+	reversedWebsite := s.reversedWebsite
+	s.RUnlock()
+	if u, err = url.Parse(reversedWebsite); err != nil {
 		log.Fatalf("error: %s", err.Error())
 	}
 
@@ -91,8 +134,17 @@ func (r *rateLimitResponseWriter) WriteHeader(statusCode int) {
 	r.rw.WriteHeader(statusCode)
 }
 
+// transfer copies src to dst and closes both. When either is a trackedConn
+// the bytes are counted on it.
 func transfer(dst io.WriteCloser, src io.ReadCloser) {
 	defer dst.Close()
 	defer src.Close()
-	io.Copy(dst, src)
+
+	var w io.Writer = dst
+	if c, ok := dst.(*trackedConn); ok {
+		w = countingWriter{w: dst, conn: &c.sent, route: &c.counters.sent}
+	} else if c, ok := src.(*trackedConn); ok {
+		w = countingWriter{w: dst, conn: &c.received, route: &c.counters.received}
+	}
+	io.Copy(w, src)
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	headerResolve = "Misha-Resolve"
+)
+
+// remote DNS modes, in which hosts that aren't domestic domains are never
+// resolved locally. With remoteDNSList they are reached through the remote
+// proxy unresolved, with remoteDNSResolve the remote proxy resolves them and
+// the addresses decide the route as usual.
+const (
+	remoteDNSList    = "list"
+	remoteDNSResolve = "resolve"
+)
+
+const (
+	maxRemoteAnswerSize = 64 * 1024
+)
+
+// remoteAnswer is how the remote proxy tells the addresses of a host, A
+// records first. No address is a negative answer, holding for TTL seconds,
+// NXDomain when the host doesn't exist.
+type remoteAnswer struct {
+	IPs      []net.IP `json:"ips"`
+	TTL      int      `json:"ttl"`
+	NXDomain bool     `json:"nxdomain,omitempty"`
+}
+
+// resolve answers a CONNECT request asking for the addresses of its host
+// rather than a tunnel. The answer follows the 200 status line like tunnelled
+// bytes would, and the connection is closed after it.
+func (s *remoteProxy) resolve(rw http.ResponseWriter, req *http.Request) {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), defaultDNSTimeout)
+	defer cancel()
+	records, err := s.lookup(ctx, host)
+	var answer remoteAnswer
+	switch {
+	case isNegative(err):
+		answer.TTL = int(err.(*negativeAnswer).ttl / time.Second)
+		answer.NXDomain = err.(*negativeAnswer).nameError
+	case err != nil:
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		answer.TTL = int(minTTL(records) / time.Second)
+		for _, r := range records {
+			answer.IPs = append(answer.IPs, r.ip)
+		}
+	}
+	buf, _ := json.Marshal(&answer)
+
+	if req.ProtoMajor == 2 {
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(buf)
+		return
+	}
+	conn, _, err := rw.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(fmt.Sprintf("%s 200 OK\r\n\r\n", req.Proto)))
+	conn.Write(buf)
+}
+
+// lookupRemote returns every address of host as the remote proxy resolves
+// it, from the cache when it has them.
+func (l *localProxy) lookupRemote(ctx context.Context, host string) []net.IP {
+	ips, _, _ := l.resolveCached(ctx, host, l.resolveRemote)
+	return ips
+}
+
+// resolveRemote asks the remote proxy for the addresses of host, so that the
+// lookup neither leaks to the local network nor gets poisoned on its way.
+func (l *localProxy) resolveRemote(ctx context.Context, host string) ([]dnsRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultDNSTimeout)
+	defer cancel()
+
+	header := make(http.Header)
+	header.Set(headerResolve, "1")
+	conn, err := l.dialRemote(ctx, net.JoinHostPort(host, "0"), header)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+			conn.Close()
+		}
+	}()
+
+	buf, err := ioutil.ReadAll(io.LimitReader(conn, maxRemoteAnswerSize))
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	var answer remoteAnswer
+	if err = json.Unmarshal(buf, &answer); err != nil {
+		return nil, fmt.Errorf("resolve %s on the remote proxy: %s", host, err.Error())
+	}
+
+	ttl := time.Duration(answer.TTL) * time.Second
+	if len(answer.IPs) == 0 {
+		return nil, &negativeAnswer{ttl: ttl, nameError: answer.NXDomain}
+	}
+	records := make([]dnsRecord, len(answer.IPs))
+	for i, ip := range answer.IPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		records[i] = dnsRecord{ip: ip, ttl: ttl}
+	}
+	return records, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteDNSH2(t *testing.T) {
+	testRemoteDNS(t, true)
+}
+
+func TestRemoteDNSH1(t *testing.T) {
+	testRemoteDNS(t, false)
+}
+
+func testRemoteDNS(t *testing.T, h2 bool) {
+	var remoteLookups int32
+	remote := httptest.NewUnstartedServer(&remoteProxy{
+		auth: newAuthenticator("secret", defaultTokenSkew, time.Time{}),
+		lookup: func(ctx context.Context, host string) ([]dnsRecord, error) {
+			atomic.AddInt32(&remoteLookups, 1)
+			switch host {
+			case "foreign.example.com":
+				return []dnsRecord{
+					{ip: net.ParseIP("8.8.8.8").To4(), ttl: time.Minute},
+					{ip: net.ParseIP("2001:4860::8888"), ttl: time.Minute},
+				}, nil
+			case "private.example.com":
+				return []dnsRecord{{ip: net.ParseIP("192.168.1.1").To4(), ttl: time.Minute}}, nil
+			}
+			return nil, &negativeAnswer{ttl: time.Minute}
+		},
+	})
+	remote.EnableHTTP2 = h2
+	remote.StartTLS()
+	defer remote.Close()
+
+	var localLookups int32
+	remotes := newRemoteSet(policyLatency, "", 0)
+	remotes.add(remote.URL, newTestRemoteDialer(t, remote, "secret"))
+	domestic, _ := parseDomainList(strings.NewReader("example.cn"))
+	local := &localProxy{
+		remotes:           remotes,
+		ipRangeDB:         newChinaIPRangeDB(),
+		dnsCache:          newHostCache(8),
+		autoCrossFirewall: true,
+		remoteDNS:         remoteDNSResolve,
+		domesticDomains:   domestic,
+		dns: newSmartDNS(dnsResolver{name: "test", lookup: func(ctx context.Context, host string) ([]dnsRecord, error) {
+			atomic.AddInt32(&localLookups, 1)
+			return []dnsRecord{{ip: net.ParseIP("10.0.0.1").To4(), ttl: time.Minute}}, nil
+		}}),
+	}
+
+	ips, action, err := local.route(context.Background(), "foreign.example.com", "443")
+	require.Nil(t, err)
+	require.Equal(t, actionRemote, action)
+	require.Equal(t, []net.IP{net.ParseIP("8.8.8.8").To4(), net.ParseIP("2001:4860::8888")}, ips)
+
+	ips, action, err = local.route(context.Background(), "private.example.com", "443")
+	require.Nil(t, err)
+	require.Equal(t, actionDirect, action)
+	require.Equal(t, []net.IP{net.ParseIP("192.168.1.1").To4()}, ips)
+
+	// the remote proxy knows better, the host goes there unresolved.
+	ips, action, err = local.route(context.Background(), "nonexistent.example.com", "443")
+	require.Nil(t, err)
+	require.Equal(t, actionRemote, action)
+	require.Empty(t, ips)
+	require.Equal(t, int32(0), atomic.LoadInt32(&localLookups))
+
+	// answers are cached.
+	local.route(context.Background(), "foreign.example.com", "443")
+	require.Equal(t, int32(3), atomic.LoadInt32(&remoteLookups))
+
+	ips, action, err = local.route(context.Background(), "www.example.cn", "443")
+	require.Nil(t, err)
+	require.Equal(t, actionDirect, action)
+	require.Equal(t, []net.IP{net.ParseIP("10.0.0.1").To4()}, ips)
+	require.Equal(t, int32(1), atomic.LoadInt32(&localLookups))
+
+	local.setRemoteDNS(remoteDNSList, domestic)
+	local.dnsCache.Clear()
+	ips, action, err = local.route(context.Background(), "private.example.com", "443")
+	require.Nil(t, err)
+	require.Equal(t, actionRemote, action)
+	require.Empty(t, ips)
+	require.Equal(t, int32(3), atomic.LoadInt32(&remoteLookups))
+	require.Equal(t, int32(1), atomic.LoadInt32(&localLookups))
+}
+
+func TestRemoteDNSListHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	hostsFile := writeTestFile(t, dir, "hosts", "192.168.1.2 nas.lan\n")
+
+	var localLookups int32
+	domestic, _ := parseDomainList(strings.NewReader("example.cn"))
+	dns := newSmartDNS(
+		dnsResolver{name: resolverHosts, lookup: newDNSOverHostsFile(hostsFile).lookup},
+		dnsResolver{name: "test", lookup: func(ctx context.Context, host string) ([]dnsRecord, error) {
+			atomic.AddInt32(&localLookups, 1)
+			return []dnsRecord{{ip: net.ParseIP("10.0.0.1").To4(), ttl: time.Minute}}, nil
+		}},
+	)
+	dns.static, err = newStaticHosts(map[string]hostAddrs{"router.lan": {"192.168.1.1"}})
+	require.Nil(t, err)
+	local := &localProxy{
+		remotes:           newRemoteSet(policyLatency, "", 0),
+		ipRangeDB:         newChinaIPRangeDB(),
+		dnsCache:          newHostCache(8),
+		autoCrossFirewall: true,
+		remoteDNS:         remoteDNSList,
+		domesticDomains:   domestic,
+		dns:               dns,
+	}
+
+	ips, action, err := local.route(context.Background(), "router.lan", "80")
+	require.Nil(t, err)
+	require.Equal(t, actionDirect, action)
+	require.Equal(t, []net.IP{net.ParseIP("192.168.1.1").To4()}, ips)
+
+	ips, action, err = local.route(context.Background(), "nas.lan", "80")
+	require.Nil(t, err)
+	require.Equal(t, actionDirect, action)
+	require.Equal(t, []net.IP{net.ParseIP("192.168.1.2").To4()}, ips)
+
+	ips, action, err = local.route(context.Background(), "foreign.example.com", "443")
+	require.Nil(t, err)
+	require.Equal(t, actionRemote, action)
+	require.Empty(t, ips)
+	require.Equal(t, int32(0), atomic.LoadInt32(&localLookups))
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	policyLatency    = "latency"
+	policyRoundRobin = "round-robin"
+	policyHash       = "hash"
+)
+
+const (
+	defaultHealthCheckTarget   = "www.google.com:443"
+	defaultHealthCheckInterval = time.Minute
+	healthCheckTimeout         = 10 * time.Second
+)
+
+var errNoRemoteProxy = errors.New("no remote proxy configured")
+
+// upstream is one remote proxy along with what its last health check found.
+type upstream struct {
+	sync.Mutex
+	dialer    *remoteDialer
+	name      string
+	healthy   bool
+	latency   time.Duration
+	checkedAt time.Time
+	lastErr   error
+}
+
+func (u *upstream) status() (healthy bool, latency time.Duration) {
+	u.Lock()
+	defer u.Unlock()
+	return u.healthy, u.latency
+}
+
+func (u *upstream) report(latency time.Duration, err error) {
+	u.Lock()
+	defer u.Unlock()
+	u.healthy = err == nil
+	u.lastErr = err
+	u.checkedAt = time.Now()
+	if err == nil {
+		u.latency = latency
+	}
+}
+
+// remoteStatus is an upstream as reported by the admin API.
+type remoteStatus struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Latency   string    `json:"latency"`
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+	latency   time.Duration
+}
+
+func (u *upstream) remoteStatus() remoteStatus {
+	u.Lock()
+	defer u.Unlock()
+	s := remoteStatus{
+		Name:      u.name,
+		Healthy:   u.healthy,
+		Latency:   u.latency.String(),
+		CheckedAt: u.checkedAt,
+		latency:   u.latency,
+	}
+	if u.lastErr != nil {
+		s.Error = u.lastErr.Error()
+	}
+	return s
+}
+
+// remoteSet spreads tunnels over several remote proxies according to a
+// policy, and fails over to the next one when dialing a remote fails.
+// Remotes are health checked periodically; unhealthy ones are only tried
+// after all healthy ones have failed.
+type remoteSet struct {
+	upstreams     []*upstream
+	policy        string
+	checkTarget   string
+	checkInterval time.Duration
+	next          uint32
+	cancel        context.CancelFunc
+}
+
+func newRemoteSet(policy, checkTarget string, checkInterval time.Duration) *remoteSet {
+	return &remoteSet{
+		policy:        policy,
+		checkTarget:   checkTarget,
+		checkInterval: checkInterval,
+	}
+}
+
+// add appends a remote, it is considered healthy until checked.
+func (s *remoteSet) add(name string, d *remoteDialer) {
+	s.upstreams = append(s.upstreams, &upstream{
+		dialer:  d,
+		name:    name,
+		healthy: true,
+	})
+}
+
+// start warms up the remotes and health checks them until stop is called.
+func (s *remoteSet) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	for _, u := range s.upstreams {
+		go u.dialer.fill()
+	}
+	go s.healthCheck(ctx)
+}
+
+// stop ends the health checks and drops idle connections, tunnels still open
+// are left alone.
+func (s *remoteSet) stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	for _, u := range s.upstreams {
+		u.dialer.close()
+	}
+}
+
+func (s *remoteSet) statuses() []remoteStatus {
+	statuses := make([]remoteStatus, len(s.upstreams))
+	for i, u := range s.upstreams {
+		statuses[i] = u.remoteStatus()
+	}
+	return statuses
+}
+
+// dial opens a tunnel to targetAddr through the first remote, in policy
+// order, that accepts it.
+func (s *remoteSet) dial(ctx context.Context, targetAddr string, header http.Header) (net.Conn, error) {
+	err := errNoRemoteProxy
+	for _, u := range s.pick(targetAddr) {
+		var conn net.Conn
+		if conn, err = u.dialer.dial(ctx, targetAddr, header); err == nil {
+			return conn, nil
+		}
+		if _, ok := err.(*tunnelStatusError); ok {
+			// the remote is fine, the target isn't.
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			// given up on by the caller, not failed by the remote.
+			return nil, err
+		}
+		log.Printf("remote %s: %s", u.name, err.Error())
+		u.report(0, err)
+	}
+	return nil, err
+}
+
+// pick returns the remotes in the order they should be tried for targetAddr.
+func (s *remoteSet) pick(targetAddr string) []*upstream {
+	var healthy, unhealthy []*upstream
+	for _, u := range s.upstreams {
+		if ok, _ := u.status(); ok {
+			healthy = append(healthy, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+
+	switch s.policy {
+	case policyRoundRobin:
+		if n := len(healthy); n > 0 {
+			i := int(atomic.AddUint32(&s.next, 1) % uint32(n))
+			healthy = append(healthy[i:], healthy[:i]...)
+		}
+	case policyHash:
+		host, _, err := net.SplitHostPort(targetAddr)
+		if err != nil {
+			host = targetAddr
+		}
+		sortByRendezvousHash(healthy, host)
+		sortByRendezvousHash(unhealthy, host)
+	default:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			_, a := healthy[i].status()
+			_, b := healthy[j].status()
+			return a < b
+		})
+	}
+	return append(healthy, unhealthy...)
+}
+
+// sortByRendezvousHash orders upstreams by their highest random weight for
+// key, so a destination keeps using the same remote, and only the
+// destinations of a remote that goes away move elsewhere.
+func sortByRendezvousHash(upstreams []*upstream, key string) {
+	weight := func(u *upstream) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(u.name))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		return h.Sum64()
+	}
+	sort.Slice(upstreams, func(i, j int) bool {
+		return weight(upstreams[i]) > weight(upstreams[j])
+	})
+}
+
+// check probes every remote once.
+func (s *remoteSet) check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, u := range s.upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			latency, err := u.dialer.probe(ctx, s.checkTarget)
+			if err != nil {
+				log.Printf("remote %s: health check: %s", u.name, err.Error())
+			}
+			u.report(latency, err)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// healthCheck probes the remotes every checkInterval until ctx is done.
+func (s *remoteSet) healthCheck(ctx context.Context) {
+	ticker := time.NewTicker(s.checkInterval)
+	defer ticker.Stop()
+	for {
+		s.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
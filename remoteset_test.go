@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteSetPick(t *testing.T) {
+	s := newRemoteSet(policyLatency, "", 0)
+	for _, name := range []string{"a", "b", "c"} {
+		s.add(name, nil)
+	}
+	s.upstreams[0].report(30*time.Millisecond, nil)
+	s.upstreams[1].report(0, io.EOF)
+	s.upstreams[2].report(10*time.Millisecond, nil)
+
+	require.Equal(t, []string{"c", "a", "b"}, upstreamNames(s.pick("www.google.com:443")))
+
+	s.policy = policyRoundRobin
+	first := upstreamNames(s.pick("www.google.com:443"))
+	second := upstreamNames(s.pick("www.google.com:443"))
+	require.NotEqual(t, first, second)
+	require.Equal(t, "b", first[2])
+	require.Equal(t, "b", second[2])
+
+	s.policy = policyHash
+	s.upstreams[1].report(0, nil)
+	picked := upstreamNames(s.pick("www.google.com:443"))
+	require.Equal(t, picked, upstreamNames(s.pick("www.google.com:80")))
+
+	// only destinations of the remote that went down move.
+	for _, u := range s.upstreams {
+		if u.name == picked[0] {
+			u.report(0, io.EOF)
+		}
+	}
+	require.Equal(t, append(picked[1:], picked[0]), upstreamNames(s.pick("www.google.com:443")))
+}
+
+func TestRemoteSetFailover(t *testing.T) {
+	echo := startTestEcho(t)
+	defer echo.Close()
+
+	remote := httptest.NewUnstartedServer(&remoteProxy{auth: newAuthenticator("secret", defaultTokenSkew, time.Time{})})
+	remote.EnableHTTP2 = true
+	remote.StartTLS()
+	defer remote.Close()
+
+	dead := httptest.NewTLSServer(nil)
+	dead.Close()
+	deadURL, _ := url.Parse(dead.URL)
+
+	s := newRemoteSet(policyLatency, echo.Addr().String(), time.Minute)
+	s.add(dead.URL, newRemoteDialer(deadURL, newAuthenticator("secret", defaultTokenSkew, time.Time{}), remotePoolSize))
+	s.add(remote.URL, newTestRemoteDialer(t, remote, "secret"))
+
+	conn, err := s.dial(context.Background(), echo.Addr().String(), nil)
+	require.Nil(t, err)
+	conn.Close()
+
+	healthy, _ := s.upstreams[0].status()
+	require.False(t, healthy)
+	require.Equal(t, []string{remote.URL, dead.URL}, upstreamNames(s.pick(echo.Addr().String())))
+
+	s.check(context.Background())
+	healthy, latency := s.upstreams[1].status()
+	require.True(t, healthy)
+	require.NotZero(t, latency)
+
+	// the target being unreachable doesn't make the remote unhealthy.
+	_, err = s.dial(context.Background(), "127.0.0.1:1", nil)
+	require.NotNil(t, err)
+	healthy, _ = s.upstreams[1].status()
+	require.True(t, healthy)
+
+	// nor does the client giving up.
+	s.upstreams[0].report(time.Millisecond, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.dial(ctx, echo.Addr().String(), nil)
+	require.NotNil(t, err)
+	for _, u := range s.upstreams {
+		healthy, _ = u.status()
+		require.True(t, healthy, u.name)
+	}
+}
+
+func upstreamNames(upstreams []*upstream) []string {
+	var names []string
+	for _, u := range upstreams {
+		names = append(names, u.name)
+	}
+	return names
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	actionDirect = "direct"
+	actionRemote = "remote"
+	actionReject = "reject"
+)
+
+const (
+	ruleDomain        = "DOMAIN"
+	ruleDomainSuffix  = "DOMAIN-SUFFIX"
+	ruleDomainKeyword = "DOMAIN-KEYWORD"
+	ruleDomainRegex   = "DOMAIN-REGEX"
+	ruleIPCIDR        = "IP-CIDR"
+	ruleDstPort       = "DST-PORT"
+	ruleFinal         = "FINAL"
+)
+
+var errRejected = errors.New("rejected by rules")
+
+// rule is one line of a rules file, in the form "TYPE,value,action", or
+// "FINAL,action" for the rule that matches everything.
+type rule struct {
+	typ     string
+	value   string
+	action  string
+	regexp  *regexp.Regexp
+	jsRegex string
+	ipNet   *net.IPNet
+	minPort int
+	maxPort int
+}
+
+func parseRule(line string) (*rule, error) {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	r := &rule{typ: strings.ToUpper(fields[0])}
+	if r.typ == ruleFinal {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid rule %q", line)
+		}
+		r.action = strings.ToLower(fields[1])
+	} else {
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid rule %q", line)
+		}
+		r.value, r.action = fields[1], strings.ToLower(fields[2])
+	}
+
+	switch r.action {
+	case actionDirect, actionRemote, actionReject:
+	default:
+		return nil, fmt.Errorf("invalid action %q in rule %q", r.action, line)
+	}
+
+	var err error
+	switch r.typ {
+	case ruleDomain, ruleDomainSuffix, ruleDomainKeyword:
+		r.value = strings.ToLower(strings.Trim(r.value, "."))
+	case ruleDomainRegex:
+		if r.regexp, err = regexp.Compile(r.value); err == nil {
+			r.jsRegex, err = pacRegex(r.value)
+		}
+	case ruleIPCIDR:
+		_, r.ipNet, err = net.ParseCIDR(r.value)
+	case ruleDstPort:
+		r.minPort, r.maxPort, err = parsePortRange(r.value)
+	case ruleFinal:
+	default:
+		err = fmt.Errorf("unknown rule type %q", r.typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func parsePortRange(s string) (min, max int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if min, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, err
+	}
+	max = min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if min < 0 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return min, max, nil
+}
+
+// match reports whether the rule matches. resolve is only called by rules
+// that need the address of host.
+func (r *rule) match(host string, port int, resolve func() []net.IP) bool {
+	switch r.typ {
+	case ruleDomain:
+		return host == r.value
+	case ruleDomainSuffix:
+		return host == r.value || strings.HasSuffix(host, "."+r.value)
+	case ruleDomainKeyword:
+		return strings.Contains(host, r.value)
+	case ruleDomainRegex:
+		return r.regexp.MatchString(host)
+	case ruleIPCIDR:
+		for _, ip := range resolve() {
+			if r.ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	case ruleDstPort:
+		return port >= r.minPort && port <= r.maxPort
+	case ruleFinal:
+		return true
+	}
+	return false
+}
+
+// ruleSet is an ordered list of rules, the first matching rule wins.
+type ruleSet struct {
+	rules []*rule
+}
+
+func readRules(path string) (*ruleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s, err := parseRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return s, nil
+}
+
+// readPACOverrides reads a file of "direct <domain>" or "remote <domain>"
+// lines, each the DOMAIN-SUFFIX rule of the domain.
+func readPACOverrides(path string) (*ruleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &ruleSet{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || (fields[0] != actionDirect && fields[0] != actionRemote) {
+			return nil, fmt.Errorf("%s:%d: invalid override %q", path, n, line)
+		}
+		s.rules = append(s.rules, &rule{
+			typ:    ruleDomainSuffix,
+			value:  strings.ToLower(strings.Trim(fields[1], ".")),
+			action: fields[0],
+		})
+	}
+	return s, scanner.Err()
+}
+
+// parseRules reads one rule per line, blank lines and lines starting with #
+// are ignored.
+func parseRules(reader io.Reader) (*ruleSet, error) {
+	s := &ruleSet{}
+	scanner := bufio.NewScanner(reader)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err.Error())
+		}
+		s.rules = append(s.rules, r)
+	}
+	return s, scanner.Err()
+}
+
+// match returns the action of the first rule matching host and port. resolve
+// is called lazily, so hosts decided by domain rules are never resolved.
+func (s *ruleSet) match(host, port string, resolve func() []net.IP) (action string, ok bool) {
+	if s == nil {
+		return "", false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	portNum, _ := strconv.Atoi(port)
+
+	var ips []net.IP
+	var resolved bool
+	lazyResolve := func() []net.IP {
+		if !resolved {
+			ips, resolved = resolve(), true
+		}
+		return ips
+	}
+
+	for _, r := range s.rules {
+		if r.match(host, portNum, lazyResolve) {
+			return r.action, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `
+# comments and blank lines are ignored
+DOMAIN,www.example.com,reject
+DOMAIN-SUFFIX,baidu.com,remote
+DOMAIN-KEYWORD,google,remote
+DOMAIN-REGEX,^cdn[0-9]+\.qq\.com$,direct
+IP-CIDR,17.0.0.0/8,direct
+DST-PORT,6881-6889,reject
+FINAL,remote
+`
+
+func TestParseRules(t *testing.T) {
+	s, err := parseRules(strings.NewReader(testRules))
+	require.Nil(t, err)
+	require.Len(t, s.rules, 7)
+
+	for _, line := range []string{
+		"DOMAIN,example.com",
+		"DOMAIN,example.com,proxy",
+		"HOST,example.com,direct",
+		"IP-CIDR,17.0.0.0,direct",
+		"DST-PORT,70000,direct",
+		"DOMAIN-REGEX,(,direct",
+		"DOMAIN-REGEX,\U0001F600,direct",
+	} {
+		_, err := parseRules(strings.NewReader(line))
+		require.NotNil(t, err, line)
+	}
+}
+
+func TestReadPACOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeTestFile(t, dir, "overrides", "# overrides\ndirect .QQ.com\nremote google.com\n")
+	s, err := readPACOverrides(path)
+	require.Nil(t, err)
+	action, ok := s.match("www.qq.com", "443", nil)
+	require.True(t, ok)
+	require.Equal(t, actionDirect, action)
+	action, ok = s.match("google.com", "443", nil)
+	require.True(t, ok)
+	require.Equal(t, actionRemote, action)
+
+	path = writeTestFile(t, dir, "bad", "reject qq.com\n")
+	_, err = readPACOverrides(path)
+	require.NotNil(t, err)
+
+	rules, err := newRules(options{pacOverridesFile: writeTestFile(t, dir, "o", "remote qq.com\n")}, &fileConfig{Rules: []string{"DOMAIN-SUFFIX,qq.com,direct"}})
+	require.Nil(t, err)
+	action, _ = rules.match("qq.com", "443", nil)
+	require.Equal(t, actionRemote, action)
+}
+
+func TestRuleSetMatch(t *testing.T) {
+	s, err := parseRules(strings.NewReader(testRules))
+	require.Nil(t, err)
+
+	resolved := 0
+	resolveTo := func(ip string) func() []net.IP {
+		return func() []net.IP {
+			resolved++
+			return []net.IP{net.ParseIP(ip)}
+		}
+	}
+
+	cases := []struct {
+		host   string
+		port   string
+		ip     string
+		action string
+	}{
+		{"www.example.com", "443", "", actionReject},
+		{"WWW.Baidu.com.", "443", "", actionRemote},
+		{"baidu.com", "443", "", actionRemote},
+		{"notbaidu.com", "443", "17.1.1.1", actionDirect},
+		{"mail.google.com", "443", "", actionRemote},
+		{"cdn12.qq.com", "443", "", actionDirect},
+		{"example.org", "6885", "1.1.1.1", actionReject},
+		{"example.org", "443", "1.1.1.1", actionRemote},
+	}
+	for _, c := range cases {
+		action, ok := s.match(c.host, c.port, resolveTo(c.ip))
+		require.True(t, ok, c.host)
+		require.Equal(t, c.action, action, c.host)
+	}
+	// only the hosts that reached the IP-CIDR rule were resolved, and only once.
+	require.Equal(t, 3, resolved)
+
+	// any address of the host matches IP-CIDR rules.
+	action, ok := s.match("notbaidu.com", "443", func() []net.IP {
+		return []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("17.1.1.1")}
+	})
+	require.True(t, ok)
+	require.Equal(t, actionDirect, action)
+
+	var empty *ruleSet
+	_, ok = empty.match("example.org", "443", resolveTo("1.1.1.1"))
+	require.False(t, ok)
+}
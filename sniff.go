@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+const (
+	tlsRecordTypeHandshake  = 0x16
+	tlsHandshakeClientHello = 0x01
+	tlsExtensionServerName  = 0x0000
+	tlsServerNameTypeHost   = 0x00
+
+	maxTLSRecordSize = 16384 + 5
+	maxSniffSize     = maxTLSRecordSize
+)
+
+// sniffHost peeks at the first bytes a client sent without consuming them and
+// returns the hostname carried by a TLS ClientHello SNI or an HTTP Host header.
+// It returns an empty string when no hostname could be found.
+func sniffHost(reader *bufio.Reader) string {
+	b, err := reader.Peek(1)
+	if err != nil {
+		return ""
+	}
+	if b[0] == tlsRecordTypeHandshake {
+		return sniffSNI(reader)
+	}
+	return sniffHTTPHost(reader)
+}
+
+func sniffSNI(reader *bufio.Reader) string {
+	header, err := reader.Peek(5)
+	if err != nil {
+		return ""
+	}
+	size := 5 + int(binary.BigEndian.Uint16(header[3:5]))
+	if size > maxTLSRecordSize {
+		return ""
+	}
+	record, err := reader.Peek(size)
+	if err != nil {
+		return ""
+	}
+	return parseSNI(record[5:])
+}
+
+// parseSNI extracts the server name from a ClientHello handshake message.
+func parseSNI(b []byte) string {
+	if len(b) < 4 || b[0] != tlsHandshakeClientHello {
+		return ""
+	}
+	b = b[4:]
+
+	// client version and random.
+	if len(b) < 34 {
+		return ""
+	}
+	b = b[34:]
+
+	// session id, cipher suites and compression methods.
+	var ok bool
+	if b, ok = skipVector(b, 1); !ok {
+		return ""
+	}
+	if b, ok = skipVector(b, 2); !ok {
+		return ""
+	}
+	if b, ok = skipVector(b, 1); !ok {
+		return ""
+	}
+
+	if len(b) < 2 {
+		return ""
+	}
+	extensions := b[2:]
+	if n := int(binary.BigEndian.Uint16(b)); n < len(extensions) {
+		extensions = extensions[:n]
+	}
+
+	for len(extensions) >= 4 {
+		typ := binary.BigEndian.Uint16(extensions)
+		n := int(binary.BigEndian.Uint16(extensions[2:]))
+		extensions = extensions[4:]
+		if n > len(extensions) {
+			return ""
+		}
+		data := extensions[:n]
+		extensions = extensions[n:]
+		if typ != tlsExtensionServerName || len(data) < 2 {
+			continue
+		}
+
+		names := data[2:]
+		for len(names) >= 3 {
+			nameType := names[0]
+			size := int(binary.BigEndian.Uint16(names[1:]))
+			names = names[3:]
+			if size > len(names) {
+				return ""
+			}
+			if nameType == tlsServerNameTypeHost {
+				return string(names[:size])
+			}
+			names = names[size:]
+		}
+	}
+	return ""
+}
+
+func skipVector(b []byte, lenSize int) ([]byte, bool) {
+	if len(b) < lenSize {
+		return nil, false
+	}
+	n := 0
+	for _, c := range b[:lenSize] {
+		n = n<<8 | int(c)
+	}
+	b = b[lenSize:]
+	if n > len(b) {
+		return nil, false
+	}
+	return b[n:], true
+}
+
+func sniffHTTPHost(reader *bufio.Reader) string {
+	buffered := reader.Buffered()
+	for {
+		b, err := reader.Peek(buffered)
+		if err != nil {
+			return ""
+		}
+		if end := bytes.Index(b, []byte("\r\n\r\n")); end >= 0 {
+			return parseHTTPHost(b[:end])
+		}
+		if buffered >= maxSniffSize || buffered >= reader.Size() {
+			return ""
+		}
+		buffered = reader.Buffered() + 1
+	}
+}
+
+// parseHTTPHost returns the host of the Host header in an HTTP request head,
+// without the port.
+func parseHTTPHost(head []byte) string {
+	lines := strings.Split(string(head), "\r\n")
+	if len(lines) == 0 || !strings.Contains(lines[0], " HTTP/") {
+		return ""
+	}
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(line[:i]), "Host") {
+			continue
+		}
+		host := strings.TrimSpace(line[i+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.Trim(host, "[]")
+	}
+	return ""
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniffSNI(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: "www.google.com"}).Handshake()
+		client.Close()
+	}()
+
+	host := sniffHost(bufio.NewReaderSize(server, maxSniffSize))
+	require.Equal(t, "www.google.com", host)
+}
+
+func TestSniffHTTPHost(t *testing.T) {
+	req := "GET / HTTP/1.1\r\nUser-Agent: curl\r\nhost: www.baidu.com:8080\r\n\r\n"
+	reader := bufio.NewReaderSize(strings.NewReader(req), maxSniffSize)
+	require.Equal(t, "www.baidu.com", sniffHost(reader))
+
+	// sniffing must not consume anything.
+	require.Equal(t, len(req), reader.Buffered())
+
+	reader = bufio.NewReaderSize(strings.NewReader("SSH-2.0-OpenSSH_8.1\r\n\r\n"), maxSniffSize)
+	require.Equal(t, "", sniffHost(reader))
+}
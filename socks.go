@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	socks5Version = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect      = 0x01
+	socksCmdBind         = 0x02
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded           = 0x00
+	socksRepGeneralFailure      = 0x01
+	socksRepNotAllowed          = 0x02
+	socksRepHostUnreachable     = 0x04
+	socksRepCommandNotSupported = 0x07
+	socksRepAddrNotSupported    = 0x08
+)
+
+const (
+	socksHandshakeTimeout = 10 * time.Second
+	maxAcceptDelay        = time.Second
+	udpIdleTimeout        = 2 * time.Minute
+	maxUDPPacketSize      = 64 * 1024
+)
+
+var (
+	errSOCKSAddrType          = errors.New("socks: unsupported address type")
+	errSOCKSAssociationClosed = errors.New("socks: udp association closed")
+)
+
+// mixedListener serves SOCKS5 and HTTP proxy clients on one port. Connections
+// whose first byte is the SOCKS5 version are handed to socks, everything else
+// is returned from Accept for http.Serve to handle.
+type mixedListener struct {
+	net.Listener
+	socks func(conn net.Conn)
+	conns chan net.Conn
+	done  chan struct{}
+	err   error
+	once  sync.Once
+}
+
+func newMixedListener(listener net.Listener, socks func(conn net.Conn)) *mixedListener {
+	return &mixedListener{
+		Listener: listener,
+		socks:    socks,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+}
+
+func (m *mixedListener) Accept() (net.Conn, error) {
+	m.once.Do(func() {
+		go m.serve()
+	})
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case <-m.done:
+		return nil, m.err
+	}
+}
+
+// serve accepts connections until the listener fails. Temporary errors, like
+// running out of file descriptors, are retried after a delay growing up to
+// maxAcceptDelay, as http.Server does.
+func (m *mixedListener) serve() {
+	var delay time.Duration
+	for {
+		conn, err := m.Listener.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+			if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			log.Printf("error: accept: %s, retrying in %s", err.Error(), delay)
+			time.Sleep(delay)
+			continue
+		}
+		if err != nil {
+			m.err = err
+			close(m.done)
+			return
+		}
+		delay = 0
+		go m.dispatch(conn)
+	}
+}
+
+func (m *mixedListener) dispatch(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(socksHandshakeTimeout))
+	b, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	conn = &bufferedConn{Conn: conn, reader: reader}
+	if b[0] == socks5Version {
+		m.socks(conn)
+		return
+	}
+	select {
+	case m.conns <- conn:
+	case <-m.done:
+		// nothing accepts it any more.
+		conn.Close()
+	}
+}
+
+// serveSOCKS handles a single SOCKS5 client connection.
+func (l *localProxy) serveSOCKS(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	if err := socksNegotiate(conn); err != nil {
+		return
+	}
+
+	cmd, targetAddr, err := socksReadRequest(conn)
+	if err != nil {
+		if err == errSOCKSAddrType {
+			socksWriteReply(conn, socksRepAddrNotSupported, nil)
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch cmd {
+	case socksCmdConnect:
+		l.socksConnect(conn, targetAddr)
+	case socksCmdUDPAssociate:
+		l.socksUDPAssociate(conn)
+	default:
+		socksWriteReply(conn, socksRepCommandNotSupported, nil)
+	}
+}
+
+func (l *localProxy) socksConnect(conn net.Conn, targetAddr string) {
+	target, err := l.dial(conn.RemoteAddr().String(), targetAddr, nil)
+	if err != nil {
+		if err == errRejected {
+			socksWriteReply(conn, socksRepNotAllowed, nil)
+			return
+		}
+		log.Printf("socks: connect %s: %s", targetAddr, err.Error())
+		socksWriteReply(conn, socksRepHostUnreachable, nil)
+		return
+	}
+
+	if err = socksWriteReply(conn, socksRepSucceeded, conn.LocalAddr()); err != nil {
+		target.Close()
+		return
+	}
+
+	go transfer(conn, target)
+	transfer(target, conn)
+}
+
+// dial connects to targetAddr either directly or through the remote proxy,
+// depending on the routing decision for its host. TCP connections are
+// tracked on behalf of client, datagram ones are returned as they are since
+// their type matters to the caller.
+func (l *localProxy) dial(client, targetAddr string, header http.Header) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	targetIPs, action, err := l.route(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	network := "tcp"
+	if header.Get(headerNetwork) == "udp" {
+		network = "udp"
+	}
+
+	var conn net.Conn
+	var targetIP net.IP
+	switch action {
+	case actionDirect:
+		if network == "udp" {
+			// datagrams can't be raced, the preferred address is used.
+			addr := targetAddr
+			if ips := sortAddrs(targetIPs, l.preferFamily); len(ips) > 0 {
+				addr = net.JoinHostPort(ips[0].String(), port)
+			}
+			conn, err = net.Dial(network, addr)
+		} else {
+			conn, err = l.dialDirect(ctx, targetAddr, targetIPs)
+		}
+		if err == nil {
+			targetIP = remoteIP(conn)
+		}
+	case actionReject:
+		connStats.rejected()
+		return nil, errRejected
+	default:
+		targetIP = firstIP(targetIPs)
+		conn, err = l.dialRemote(ctx, targetAddr, header)
+	}
+	if err != nil {
+		connStats.failed(action)
+		return nil, err
+	}
+	if network == "udp" {
+		return conn, nil
+	}
+	return connStats.track(conn, client, targetAddr, targetIP, action), nil
+}
+
+func (l *localProxy) socksUDPAssociate(conn net.Conn) {
+	localAddr := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP, Zone: localAddr.Zone})
+	if err != nil {
+		socksWriteReply(conn, socksRepGeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+
+	if err = socksWriteReply(conn, socksRepSucceeded, relay.LocalAddr()); err != nil {
+		return
+	}
+
+	association := &udpAssociation{
+		local:    l,
+		relay:    relay,
+		clientIP: conn.RemoteAddr().(*net.TCPAddr).IP,
+		targets:  make(map[string]net.Conn),
+	}
+	go association.serve()
+	defer association.close()
+
+	// the association lives as long as the control connection stays open.
+	io.Copy(ioutil.Discard, conn)
+}
+
+// udpAssociation relays datagrams between one SOCKS5 client and its targets.
+// Every target gets its own connection, dialed directly or tunnelled through
+// the remote proxy.
+type udpAssociation struct {
+	sync.Mutex
+	local      *localProxy
+	relay      *net.UDPConn
+	clientIP   net.IP
+	clientAddr *net.UDPAddr
+	targets    map[string]net.Conn
+	closed     bool
+}
+
+func (u *udpAssociation) serve() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, addr, err := u.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(u.clientIP) {
+			continue
+		}
+
+		// byte 2 is FRAG, fragmentation is not supported.
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		targetAddr, headerLen, err := socksParseAddr(buf[3:n])
+		if err != nil {
+			continue
+		}
+
+		u.Lock()
+		u.clientAddr = addr
+		u.Unlock()
+
+		target, err := u.target(targetAddr)
+		if err != nil {
+			log.Printf("socks: udp associate %s: %s", targetAddr, err.Error())
+			continue
+		}
+		target.Write(buf[3+headerLen : n])
+	}
+}
+
+func (u *udpAssociation) target(targetAddr string) (net.Conn, error) {
+	u.Lock()
+	target, ok := u.targets[targetAddr]
+	u.Unlock()
+	if ok {
+		return target, nil
+	}
+
+	header := make(http.Header)
+	header.Set(headerNetwork, "udp")
+	target, err := u.local.dial(u.clientIP.String(), targetAddr, header)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := target.(*net.UDPConn); !ok {
+		target = newDatagramConn(target)
+	}
+
+	u.Lock()
+	if u.closed {
+		u.Unlock()
+		target.Close()
+		return nil, errSOCKSAssociationClosed
+	}
+	u.targets[targetAddr] = target
+	u.Unlock()
+
+	go u.reply(targetAddr, target)
+	return target, nil
+}
+
+func (u *udpAssociation) reply(targetAddr string, target net.Conn) {
+	defer func() {
+		u.Lock()
+		delete(u.targets, targetAddr)
+		u.Unlock()
+		target.Close()
+	}()
+
+	header, err := socksAppendAddr([]byte{0, 0, 0}, targetAddr)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		target.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := target.Read(buf)
+		if err != nil {
+			return
+		}
+
+		u.Lock()
+		clientAddr := u.clientAddr
+		u.Unlock()
+		u.relay.WriteToUDP(append(header, buf[:n]...), clientAddr)
+	}
+}
+
+func (u *udpAssociation) close() {
+	u.Lock()
+	defer u.Unlock()
+	u.closed = true
+	for _, target := range u.targets {
+		target.Close()
+	}
+}
+
+func socksNegotiate(rw io.ReadWriter) error {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("socks: unsupported version %d", buf[0])
+	}
+
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return err
+	}
+	for _, method := range methods {
+		if method == socksMethodNoAuth {
+			_, err := rw.Write([]byte{socks5Version, socksMethodNoAuth})
+			return err
+		}
+	}
+
+	rw.Write([]byte{socks5Version, socksMethodNoAcceptable})
+	return errors.New("socks: no acceptable authentication method")
+}
+
+func socksReadRequest(r io.Reader) (cmd byte, targetAddr string, err error) {
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return 0, "", err
+	}
+	if buf[0] != socks5Version {
+		return 0, "", fmt.Errorf("socks: unsupported version %d", buf[0])
+	}
+	cmd = buf[1]
+
+	var host string
+	switch buf[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if buf[3] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(r, ip); err != nil {
+			return 0, "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		if _, err = io.ReadFull(r, buf[:1]); err != nil {
+			return 0, "", err
+		}
+		domain := make([]byte, buf[0])
+		if _, err = io.ReadFull(r, domain); err != nil {
+			return 0, "", err
+		}
+		host = string(domain)
+	default:
+		return 0, "", errSOCKSAddrType
+	}
+
+	if _, err = io.ReadFull(r, buf[:2]); err != nil {
+		return 0, "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return cmd, net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// socksParseAddr parses a SOCKS5 ATYP-prefixed address and returns it along
+// with the number of bytes it occupied.
+func socksParseAddr(b []byte) (addr string, n int, err error) {
+	if len(b) < 1 {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+
+	var host string
+	switch b[0] {
+	case socksAtypIPv4:
+		n = 1 + net.IPv4len
+	case socksAtypIPv6:
+		n = 1 + net.IPv6len
+	case socksAtypDomain:
+		if len(b) < 2 {
+			return "", 0, io.ErrUnexpectedEOF
+		}
+		n = 2 + int(b[1])
+	default:
+		return "", 0, errSOCKSAddrType
+	}
+	if len(b) < n+2 {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+
+	if b[0] == socksAtypDomain {
+		host = string(b[2:n])
+	} else {
+		host = net.IP(b[1:n]).String()
+	}
+	port := binary.BigEndian.Uint16(b[n : n+2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), n + 2, nil
+}
+
+// socksAppendAddr appends addr to b in SOCKS5 ATYP-prefixed form.
+func socksAppendAddr(b []byte, addr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socksAtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socksAtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errSOCKSAddrType
+		}
+		b = append(b, socksAtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(portNum>>8), byte(portNum)), nil
+}
+
+func socksWriteReply(w io.Writer, rep byte, bindAddr net.Addr) error {
+	reply := []byte{socks5Version, rep, 0}
+	addr := "0.0.0.0:0"
+	if bindAddr != nil {
+		addr = bindAddr.String()
+	}
+	reply, err := socksAppendAddr(reply, addr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(reply)
+	return err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSOCKSAddr(t *testing.T) {
+	for _, addr := range []string{"1.2.3.4:80", "[2001:da8::1]:443", "www.google.com:8080"} {
+		b, err := socksAppendAddr(nil, addr)
+		require.Nil(t, err)
+
+		parsed, n, err := socksParseAddr(b)
+		require.Nil(t, err)
+		require.Equal(t, addr, parsed)
+		require.Equal(t, len(b), n)
+	}
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	conn := dialTestSOCKS(t)
+	defer conn.Close()
+
+	req, _ := socksAppendAddr([]byte{socks5Version, socksCmdConnect, 0}, echo.Addr().String())
+	conn.Write(req)
+	_, err = readTestSOCKSReply(conn)
+	require.Nil(t, err)
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, "ping", string(buf))
+}
+
+func TestSOCKSUDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conn := dialTestSOCKS(t)
+	defer conn.Close()
+
+	conn.Write([]byte{socks5Version, socksCmdUDPAssociate, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	relayAddr, err := readTestSOCKSReply(conn)
+	require.Nil(t, err)
+
+	relay, err := net.Dial("udp", relayAddr)
+	require.Nil(t, err)
+	defer relay.Close()
+
+	packet, _ := socksAppendAddr([]byte{0, 0, 0}, echo.LocalAddr().String())
+	relay.Write(append(packet, "ping"...))
+
+	buf := make([]byte, 1024)
+	n, err := relay.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, append(packet, "ping"...), buf[:n])
+}
+
+func dialTestSOCKS(t *testing.T) net.Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	local := &localProxy{
+		ipRangeDB:         newChinaIPRangeDB(),
+		dnsCache:          newHostCache(10),
+		autoCrossFirewall: true,
+	}
+	go http.Serve(newMixedListener(listener, local.serveSOCKS), local)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+
+	conn.Write([]byte{socks5Version, 1, socksMethodNoAuth})
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, []byte{socks5Version, socksMethodNoAuth}, buf)
+	return conn
+}
+
+func readTestSOCKSReply(conn net.Conn) (string, error) {
+	buf := make([]byte, 4+net.IPv4len+2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	if buf[1] != socksRepSucceeded {
+		return "", io.ErrUnexpectedEOF
+	}
+	ip := net.IP(buf[4 : 4+net.IPv4len])
+	port := binary.BigEndian.Uint16(buf[4+net.IPv4len:])
+	return (&net.TCPAddr{IP: ip, Port: int(port)}).String(), nil
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails its first accepts with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestMixedListenerRetriesTemporaryErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	mixed := newMixedListener(&flakyListener{Listener: listener, failures: 3}, func(conn net.Conn) {
+		conn.Close()
+	})
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		}
+	}()
+	conn, err := mixed.Accept()
+	require.Nil(t, err)
+	conn.Close()
+
+	listener.Close()
+	_, err = mixed.Accept()
+	require.NotNil(t, err)
+	_, err = mixed.Accept()
+	require.NotNil(t, err)
+}
+
+func TestMixedListenerClosed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	mixed := newMixedListener(listener, nil)
+	listener.Close()
+	_, err = mixed.Accept()
+	require.NotNil(t, err)
+
+	// a connection dispatched after Accept stopped being called is closed.
+	client, server := net.Pipe()
+	go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	dispatched := make(chan struct{})
+	go func() {
+		mixed.dispatch(server)
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch blocked")
+	}
+	_, err = client.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// sysProxy points the system proxy settings at the local proxy and puts the
+// previous settings back.
+type sysProxy interface {
+	set(listenAddr string) error
+	unset() error
+}
+
+// commandRunner runs external commands. It is replaced in tests, so system
+// proxy settings can be exercised without a desktop.
+type commandRunner interface {
+	run(name string, args ...string) (string, error)
+}
+
+type execRunner struct {
+}
+
+func (execRunner) run(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return string(out), errors.New(string(out) + err.Error())
+	}
+	return string(out), nil
+}
+
+var systemProxy = newSysProxy()
+
+func setSysProxy(listenAddr string) error {
+	return systemProxy.set(listenAddr)
+}
+
+func unsetSysProxy() error {
+	return systemProxy.unset()
+}
+
+// proxyHostPort returns the address other programs reach the local proxy at.
+func proxyHostPort(listenAddr string) (host, port string, err error) {
+	host, port, err = net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", "", err
+	}
+	if strings.Trim(host, " ") == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return host, port, nil
+}
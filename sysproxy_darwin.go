@@ -3,59 +3,111 @@
 package main
 
 import (
-	"errors"
-	"fmt"
-	"net"
-	"os/exec"
 	"strings"
+	"sync"
 )
 
-func setSysProxy(listenAddr string) error {
-	host, port, err := net.SplitHostPort(listenAddr)
+// networkSetupProxy sets the web and secure web proxies of the network
+// service of the default route. The previous proxies of the service are
+// saved by set and put back by unset.
+type networkSetupProxy struct {
+	sync.Mutex
+	runner   commandRunner
+	restores []func() error
+}
+
+// networkSetupProxyKinds are the proxies set, named as in the options of
+// networksetup, e.g. -getwebproxy and -setwebproxystate.
+var networkSetupProxyKinds = []string{"securewebproxy", "webproxy"}
+
+func newSysProxy() sysProxy {
+	return &networkSetupProxy{runner: execRunner{}}
+}
+
+func (p *networkSetupProxy) set(listenAddr string) error {
+	host, port, err := proxyHostPort(listenAddr)
 	if err != nil {
 		return err
 	}
-	if strings.Trim(host, " ") == "" {
-		host = "127.0.0.1"
-	}
 
-	networkservice := getNetworkInterface()
+	p.Lock()
+	defer p.Unlock()
 
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("networksetup -setsecurewebproxy %s %s %s", networkservice, host, port))
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return errors.New(string(out) + err.Error())
-	}
+	networkservice := networkInterface(p.runner)
+	for _, kind := range networkSetupProxyKinds {
+		restore, err := p.saveProxy(networkservice, kind)
+		if err != nil {
+			return err
+		}
+		p.restores = append(p.restores, restore)
 
-	cmd = exec.Command("sh", "-c", fmt.Sprintf("networksetup -setwebproxy %s %s %s", networkservice, host, port))
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return errors.New(string(out) + err.Error())
+		if _, err := p.runner.run("networksetup", "-set"+kind, networkservice, host, port); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
-func unsetSysProxy() error {
-	networkservice := getNetworkInterface()
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("networksetup -setsecurewebproxystate %s %s", networkservice, "off"))
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return errors.New(string(out) + err.Error())
+// unset restores the proxies saved by set, in reverse order.
+func (p *networkSetupProxy) unset() error {
+	p.Lock()
+	defer p.Unlock()
+
+	var firstErr error
+	for i := len(p.restores) - 1; i >= 0; i-- {
+		if err := p.restores[i](); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
+	p.restores = nil
+	return firstErr
+}
 
-	cmd = exec.Command("sh", "-c", fmt.Sprintf("networksetup -setwebproxystate %s %s", networkservice, "off"))
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return errors.New(string(out) + err.Error())
+// saveProxy reads the proxy of kind of networkservice and returns a function
+// putting it back. networksetup prints it as
+//
+//	Enabled: Yes
+//	Server: 10.0.0.1
+//	Port: 3128
+//	Authenticated Proxy Enabled: 0
+func (p *networkSetupProxy) saveProxy(networkservice, kind string) (func() error, error) {
+	out, err := p.runner.run("networksetup", "-get"+kind, networkservice)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	saved := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if i := strings.Index(line, ":"); i > 0 {
+			saved[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+
+	return func() error {
+		if server := saved["Server"]; server != "" {
+			if _, err := p.runner.run("networksetup", "-set"+kind, networkservice, server, saved["Port"]); err != nil {
+				return err
+			}
+		}
+		state := "off"
+		if saved["Enabled"] == "Yes" {
+			state = "on"
+		}
+		_, err := p.runner.run("networksetup", "-set"+kind+"state", networkservice, state)
+		return err
+	}, nil
 }
 
 func getNetworkInterface() string {
-	c := exec.Command("sh", "-c", "networksetup -listnetworkserviceorder | grep -B 1 $(route -n get default | grep interface | awk '{print $2}') | head -n 1 | sed 's/.*) //'")
-	out, err := c.CombinedOutput()
+	return networkInterface(execRunner{})
+}
+
+func networkInterface(runner commandRunner) string {
+	out, err := runner.run("sh", "-c", "networksetup -listnetworkserviceorder | grep -B 1 $(route -n get default | grep interface | awk '{print $2}') | head -n 1 | sed 's/.*) //'")
 	if err != nil {
-		return string(out)
+		return out
 	}
-	output := strings.TrimSpace(string(out))
+	output := strings.TrimSpace(out)
 	if strings.Contains(output, "usage") {
 		return "Wi-Fi"
 	}
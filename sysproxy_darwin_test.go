@@ -3,6 +3,8 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -23,3 +25,45 @@ func TestGetNetworkInterface(t *testing.T) {
 	i := getNetworkInterface()
 	t.Log(i)
 }
+
+// fakeNetworkSetup keeps the proxies of one network service in memory the
+// way networksetup would.
+type fakeNetworkSetup struct {
+	proxies map[string][3]string
+}
+
+func (r *fakeNetworkSetup) run(name string, args ...string) (string, error) {
+	if name == "sh" {
+		return "Wi-Fi\n", nil
+	}
+	option := strings.TrimPrefix(args[0], "-")
+	switch {
+	case strings.HasPrefix(option, "get"):
+		proxy := r.proxies[strings.TrimPrefix(option, "get")]
+		return fmt.Sprintf("Enabled: %s\nServer: %s\nPort: %s\nAuthenticated Proxy Enabled: 0\n", proxy[0], proxy[1], proxy[2]), nil
+	case strings.HasSuffix(option, "state"):
+		kind := strings.TrimSuffix(strings.TrimPrefix(option, "set"), "state")
+		proxy := r.proxies[kind]
+		proxy[0] = map[string]string{"on": "Yes", "off": "No"}[args[2]]
+		r.proxies[kind] = proxy
+	default:
+		r.proxies[strings.TrimPrefix(option, "set")] = [3]string{"Yes", args[2], args[3]}
+	}
+	return "", nil
+}
+
+func TestNetworkSetupProxyRestore(t *testing.T) {
+	runner := &fakeNetworkSetup{proxies: map[string][3]string{
+		"webproxy":       {"Yes", "10.0.0.1", "3128"},
+		"securewebproxy": {"No", "", "0"},
+	}}
+	p := &networkSetupProxy{runner: runner}
+
+	require.Nil(t, p.set(":2286"))
+	require.Equal(t, [3]string{"Yes", "127.0.0.1", "2286"}, runner.proxies["webproxy"])
+	require.Equal(t, [3]string{"Yes", "127.0.0.1", "2286"}, runner.proxies["securewebproxy"])
+
+	require.Nil(t, p.unset())
+	require.Equal(t, [3]string{"Yes", "10.0.0.1", "3128"}, runner.proxies["webproxy"])
+	require.Equal(t, "No", runner.proxies["securewebproxy"][0])
+}
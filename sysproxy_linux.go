@@ -0,0 +1,220 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	gnomeProxySchema = "org.gnome.system.proxy"
+	kdeProxyFile     = "kioslaverc"
+	kdeProxyGroup    = "Proxy Settings"
+)
+
+// linuxSysProxy sets the proxy of GNOME and KDE desktops when they are
+// around, and always writes a file of proxy environment variables for
+// shells to source. Whatever was configured before is saved by set and put
+// back by unset.
+type linuxSysProxy struct {
+	sync.Mutex
+	runner   commandRunner
+	desktop  string
+	envFile  string
+	restores []func() error
+}
+
+func newSysProxy() sysProxy {
+	return newLinuxSysProxy(
+		execRunner{},
+		os.Getenv("XDG_CURRENT_DESKTOP"),
+		filepath.Join(os.Getenv("HOME"), ".sandwich", "proxy.env"),
+	)
+}
+
+func newLinuxSysProxy(runner commandRunner, desktop, envFile string) *linuxSysProxy {
+	return &linuxSysProxy{
+		runner:  runner,
+		desktop: desktop,
+		envFile: envFile,
+	}
+}
+
+func (p *linuxSysProxy) set(listenAddr string) error {
+	host, port, err := proxyHostPort(listenAddr)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	var firstErr error
+	for _, set := range []func(host, port string) (func() error, error){
+		p.setGNOME,
+		p.setKDE,
+		p.setEnvFile,
+	} {
+		restore, err := set(host, port)
+		if restore != nil {
+			p.restores = append(p.restores, restore)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// unset restores the settings saved by set, in reverse order.
+func (p *linuxSysProxy) unset() error {
+	p.Lock()
+	defer p.Unlock()
+
+	var firstErr error
+	for i := len(p.restores) - 1; i >= 0; i-- {
+		if err := p.restores[i](); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.restores = nil
+	return firstErr
+}
+
+// setGNOME is skipped when gsettings or its proxy schema is missing.
+func (p *linuxSysProxy) setGNOME(host, port string) (func() error, error) {
+	keys := []struct {
+		schema string
+		key    string
+		value  string
+	}{
+		{gnomeProxySchema + ".http", "host", host},
+		{gnomeProxySchema + ".http", "port", port},
+		{gnomeProxySchema + ".https", "host", host},
+		{gnomeProxySchema + ".https", "port", port},
+		{gnomeProxySchema + ".socks", "host", host},
+		{gnomeProxySchema + ".socks", "port", port},
+		{gnomeProxySchema, "mode", "manual"},
+	}
+
+	saved := make([]string, len(keys))
+	for i, k := range keys {
+		out, err := p.runner.run("gsettings", "get", k.schema, k.key)
+		if err != nil {
+			return nil, nil
+		}
+		saved[i] = strings.TrimSpace(out)
+	}
+
+	restore := func() error {
+		for i := len(keys) - 1; i >= 0; i-- {
+			if _, err := p.runner.run("gsettings", "set", keys[i].schema, keys[i].key, saved[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, k := range keys {
+		if _, err := p.runner.run("gsettings", "set", k.schema, k.key, k.value); err != nil {
+			return restore, err
+		}
+	}
+	return restore, nil
+}
+
+// setKDE only runs on KDE Plasma, kwriteconfig5 may be installed elsewhere.
+func (p *linuxSysProxy) setKDE(host, port string) (func() error, error) {
+	if !strings.Contains(strings.ToUpper(p.desktop), "KDE") {
+		return nil, nil
+	}
+
+	keys := []struct {
+		key   string
+		value string
+	}{
+		{"httpProxy", fmt.Sprintf("http://%s %s", host, port)},
+		{"httpsProxy", fmt.Sprintf("http://%s %s", host, port)},
+		{"socksProxy", fmt.Sprintf("socks://%s %s", host, port)},
+		{"ProxyType", "1"},
+	}
+
+	saved := make([]string, len(keys))
+	for i, k := range keys {
+		out, err := p.runner.run("kreadconfig5", "--file", kdeProxyFile, "--group", kdeProxyGroup, "--key", k.key)
+		if err != nil {
+			return nil, err
+		}
+		saved[i] = strings.TrimSpace(out)
+	}
+
+	restore := func() error {
+		for i := len(keys) - 1; i >= 0; i-- {
+			args := []string{"--file", kdeProxyFile, "--group", kdeProxyGroup, "--key", keys[i].key}
+			if saved[i] == "" {
+				args = append(args, "--delete")
+			} else {
+				args = append(args, saved[i])
+			}
+			if _, err := p.runner.run("kwriteconfig5", args...); err != nil {
+				return err
+			}
+		}
+		return p.reloadKDE()
+	}
+
+	for _, k := range keys {
+		if _, err := p.runner.run("kwriteconfig5", "--file", kdeProxyFile, "--group", kdeProxyGroup, "--key", k.key, k.value); err != nil {
+			return restore, err
+		}
+	}
+	return restore, p.reloadKDE()
+}
+
+// reloadKDE tells running KDE applications to read the proxy settings again.
+func (p *linuxSysProxy) reloadKDE() error {
+	_, err := p.runner.run("dbus-send", "--type=signal", "/KIO/Scheduler", "org.kde.KIO.Scheduler.reparseSlaveConfiguration", "string:")
+	return err
+}
+
+func (p *linuxSysProxy) setEnvFile(host, port string) (func() error, error) {
+	previous, err := ioutil.ReadFile(p.envFile)
+	existed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	restore := func() error {
+		if existed {
+			return ioutil.WriteFile(p.envFile, previous, 0644)
+		}
+		return os.Remove(p.envFile)
+	}
+
+	httpProxy := fmt.Sprintf("http://%s:%s", host, port)
+	socksProxy := fmt.Sprintf("socks5://%s:%s", host, port)
+	b := &strings.Builder{}
+	b.WriteString("# written by sandwich, source it in your shell profile.\n")
+	for _, v := range []struct {
+		name  string
+		value string
+	}{
+		{"http_proxy", httpProxy},
+		{"https_proxy", httpProxy},
+		{"all_proxy", socksProxy},
+		{"no_proxy", "localhost,127.0.0.1,::1"},
+	} {
+		fmt.Fprintf(b, "export %s=%s\n", v.name, v.value)
+		fmt.Fprintf(b, "export %s=%s\n", strings.ToUpper(v.name), v.value)
+	}
+
+	if err = ioutil.WriteFile(p.envFile, []byte(b.String()), 0644); err != nil {
+		return nil, err
+	}
+	return restore, nil
+}
@@ -0,0 +1,102 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRunner keeps settings in memory the way gsettings and kreadconfig5 would.
+type fakeRunner struct {
+	settings map[string]string
+	missing  map[string]bool
+}
+
+func (r *fakeRunner) run(name string, args ...string) (string, error) {
+	if r.missing[name] {
+		return "", errors.New(name + ": not found")
+	}
+	switch name {
+	case "gsettings":
+		key := args[1] + " " + args[2]
+		if args[0] == "get" {
+			return r.settings[key] + "\n", nil
+		}
+		r.settings[key] = args[3]
+	case "kreadconfig5":
+		return r.settings[args[5]] + "\n", nil
+	case "kwriteconfig5":
+		if args[6] == "--delete" {
+			delete(r.settings, args[5])
+		} else {
+			r.settings[args[5]] = args[6]
+		}
+	}
+	return "", nil
+}
+
+func TestLinuxSysProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	envFile := filepath.Join(dir, "proxy.env")
+
+	runner := &fakeRunner{settings: map[string]string{
+		"org.gnome.system.proxy mode":      "'auto'",
+		"org.gnome.system.proxy.http host": "'10.0.0.1'",
+		"org.gnome.system.proxy.http port": "3128",
+		"ProxyType":                        "0",
+	}}
+	before := make(map[string]string)
+	for k, v := range runner.settings {
+		before[k] = v
+	}
+
+	p := newLinuxSysProxy(runner, "KDE", envFile)
+	require.Nil(t, p.set(":2286"))
+	require.Equal(t, "manual", runner.settings["org.gnome.system.proxy mode"])
+	require.Equal(t, "127.0.0.1", runner.settings["org.gnome.system.proxy.https host"])
+	require.Equal(t, "2286", runner.settings["org.gnome.system.proxy.socks port"])
+	require.Equal(t, "1", runner.settings["ProxyType"])
+	require.Equal(t, "http://127.0.0.1 2286", runner.settings["httpsProxy"])
+
+	env, err := ioutil.ReadFile(envFile)
+	require.Nil(t, err)
+	require.True(t, strings.Contains(string(env), "export https_proxy=http://127.0.0.1:2286\n"))
+	require.True(t, strings.Contains(string(env), "export ALL_PROXY=socks5://127.0.0.1:2286\n"))
+
+	require.Nil(t, p.unset())
+	for k, v := range before {
+		require.Equal(t, v, runner.settings[k], k)
+	}
+	require.Equal(t, "", runner.settings["httpsProxy"])
+	_, err = os.Stat(envFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestLinuxSysProxyWithoutDesktop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandwich")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	envFile := filepath.Join(dir, "proxy.env")
+	ioutil.WriteFile(envFile, []byte("export http_proxy=http://10.0.0.1:3128\n"), 0644)
+
+	runner := &fakeRunner{
+		settings: map[string]string{},
+		missing:  map[string]bool{"gsettings": true, "kreadconfig5": true},
+	}
+	p := newLinuxSysProxy(runner, "", envFile)
+	require.Nil(t, p.set("192.168.1.2:2286"))
+	require.Len(t, runner.settings, 0)
+
+	require.Nil(t, p.unset())
+	env, _ := ioutil.ReadFile(envFile)
+	require.Equal(t, "export http_proxy=http://10.0.0.1:3128\n", string(env))
+}
@@ -0,0 +1,18 @@
+// +build !darwin,!linux
+
+package main
+
+type noSysProxy struct {
+}
+
+func newSysProxy() sysProxy {
+	return noSysProxy{}
+}
+
+func (noSysProxy) set(listenAddr string) error {
+	return nil
+}
+
+func (noSysProxy) unset() error {
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	sniffTimeout = 500 * time.Millisecond
+)
+
+// serveTransparent accepts connections redirected to listener by iptables or
+// nftables and proxies each of them to its original destination.
+func serveTransparent(listener net.Listener, local *localProxy, tproxy bool) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go local.serveTransparent(conn, tproxy)
+	}
+}
+
+func (l *localProxy) serveTransparent(conn net.Conn, tproxy bool) {
+	defer conn.Close()
+
+	var dst *net.TCPAddr
+	var err error
+	if tproxy {
+		dst = conn.LocalAddr().(*net.TCPAddr)
+	} else if dst, err = originalDst(conn); err != nil {
+		log.Printf("transparent: %s", err.Error())
+		return
+	}
+
+	reader := bufio.NewReaderSize(conn, maxSniffSize)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	host := sniffHost(reader)
+	conn.SetReadDeadline(time.Time{})
+	client := &bufferedConn{Conn: conn, reader: reader}
+
+	target, err := l.dialTransparent(conn.RemoteAddr().String(), dst, host)
+	if err != nil {
+		log.Printf("transparent: connect %s (%s): %s", dst.String(), host, err.Error())
+		return
+	}
+
+	go transfer(client, target)
+	transfer(target, client)
+}
+
+// dialTransparent routes by the sniffed host when there is one, since the
+// client may have resolved it through a polluted resolver, and by the original
+// destination address otherwise. Direct connections always go to the original
+// destination, tunnelled ones carry the hostname so the remote resolves it.
+func (l *localProxy) dialTransparent(client string, dst *net.TCPAddr, host string) (net.Conn, error) {
+	port := strconv.Itoa(dst.Port)
+	if host == "" {
+		host = dst.IP.String()
+	}
+
+	_, action, err := l.route(context.Background(), host, port)
+	if err != nil {
+		_, action, err = l.route(context.Background(), dst.IP.String(), port)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	switch action {
+	case actionDirect:
+		conn, err = net.Dial("tcp", dst.String())
+	case actionReject:
+		connStats.rejected()
+		return nil, errRejected
+	default:
+		conn, err = l.dialRemote(context.Background(), net.JoinHostPort(host, port), nil)
+	}
+	if err != nil {
+		connStats.failed(action)
+		return nil, err
+	}
+	return connStats.track(conn, client, net.JoinHostPort(host, port), dst.IP, action), nil
+}
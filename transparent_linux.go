@@ -0,0 +1,93 @@
+// +build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	ipv6Transparent = 75 // IPV6_TRANSPARENT
+)
+
+// listenTransparent listens on addr for redirected connections. TPROXY needs
+// IP_TRANSPARENT on the listening socket to accept connections addressed to
+// foreign IPs, which requires CAP_NET_ADMIN.
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	lc := &net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+					return
+				}
+				if network == "tcp6" {
+					// best effort, fails on IPv4-only sockets.
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			return err
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst recovers the destination of a connection redirected by an
+// iptables/nftables REDIRECT rule.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("original destination: not a tcp connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var sockErr error
+	ipv4 := tc.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	err = raw.Control(func(fd uintptr) {
+		if ipv4 {
+			// struct sockaddr_in fits in the 16 bytes of an ipv6_mreq.
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			addr := mreq.Multiaddr
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(addr[4], addr[5], addr[6], addr[7]),
+				Port: int(addr[2])<<8 | int(addr[3]),
+			}
+			return
+		}
+
+		// struct sockaddr_in6 is the first member of an ip6_mtuinfo.
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, info.Addr.Addr[:])
+		dst = &net.TCPAddr{
+			IP:   ip,
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	return dst, nil
+}
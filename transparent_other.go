@@ -0,0 +1,18 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxy is only supported on linux")
+
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
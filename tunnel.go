@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	remotePoolSize    = 2
+	remoteDialTimeout = 10 * time.Second
+	remoteIdleTimeout = time.Minute
+	h2RetryInterval   = 10 * time.Minute
+)
+
+var errH2Unsupported = errors.New("remote proxy does not support http/2")
+
+// HTTP/2 error codes of RFC 7540 section 7.
+const (
+	h2ErrCodeProtocol       = 0x1
+	h2ErrCodeInternal       = 0x2
+	h2ErrCodeHTTP11Required = 0xd
+)
+
+// h2StreamError mirrors the stream error of the HTTP/2 transport of
+// net/http, which converts itself to any struct of the same fields.
+type h2StreamError struct {
+	StreamID uint32
+	Code     uint32
+	Cause    error
+}
+
+func (e h2StreamError) Error() string {
+	return fmt.Sprintf("stream error: stream ID %d; code %d", e.StreamID, e.Code)
+}
+
+// isH2Unsupported reports whether err is a remote refusing a CONNECT stream,
+// as remotes that predate HTTP/2 tunnels do, rather than a network failure,
+// a timeout or a canceled request.
+func isH2Unsupported(err error) bool {
+	var streamErr h2StreamError
+	if !errors.As(err, &streamErr) {
+		return false
+	}
+	switch streamErr.Code {
+	case h2ErrCodeProtocol, h2ErrCodeInternal, h2ErrCodeHTTP11Required:
+		return true
+	}
+	return false
+}
+
+// tunnelStatusError is returned when the remote proxy answered a CONNECT
+// request with anything but 200, typically because it couldn't reach the
+// target.
+type tunnelStatusError struct {
+	targetAddr string
+	status     string
+}
+
+func (e *tunnelStatusError) Error() string {
+	return fmt.Sprintf("connect %s: %s", e.targetAddr, e.status)
+}
+
+// pooledConn is a connection to the remote proxy. reused is set when it was
+// taken from the pool rather than freshly dialed.
+type pooledConn struct {
+	net.Conn
+	proto    string
+	dialedAt time.Time
+	reused   bool
+}
+
+// remoteDialer opens tunnels to targets through one remote proxy.
+//
+// When the remote negotiates HTTP/2, every tunnel is a CONNECT stream
+// multiplexed over a shared connection. Otherwise, or when the remote turns out
+// to be too old to serve CONNECT over HTTP/2, every tunnel takes a connection
+// of its own and issues an HTTP/1.1 CONNECT. Either way a few handshaken
+// connections are kept warm so new tunnels don't pay a TCP and TLS round trip.
+type remoteDialer struct {
+	sync.Mutex
+	addr      string
+	scheme    string
+	auth      *authenticator
+	tlsConfig *tls.Config
+	transport *http.Transport
+	poolSize  int
+	idle      []*pooledConn
+	filling   bool
+	closed    bool
+	h1Until   time.Time
+}
+
+func newRemoteDialer(u *url.URL, auth *authenticator, poolSize int) *remoteDialer {
+	d := &remoteDialer{
+		addr:   appendPort(u.Host, u.Scheme),
+		scheme: u.Scheme,
+		auth:   auth,
+		tlsConfig: &tls.Config{
+			ServerName:         u.Hostname(),
+			ClientSessionCache: tls.NewLRUClientSessionCache(32),
+		},
+		poolSize: poolSize,
+	}
+	d.transport = &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := d.take(ctx, true)
+			if err != nil {
+				return nil, err
+			}
+			// the transport only speaks HTTP/2 over a bare *tls.Conn.
+			return conn.Conn, nil
+		},
+		ForceAttemptHTTP2: true,
+	}
+	return d
+}
+
+// dial opens a tunnel to targetAddr. Extra headers are sent along with the
+// CONNECT request.
+func (d *remoteDialer) dial(ctx context.Context, targetAddr string, header http.Header) (net.Conn, error) {
+	if d.useH2() {
+		conn, err := d.dialH2(ctx, targetAddr, header)
+		if err == nil || d.useH2() {
+			return conn, err
+		}
+	}
+	return d.dialH1(ctx, targetAddr, header)
+}
+
+func (d *remoteDialer) useH2() bool {
+	if d.scheme != "https" {
+		return false
+	}
+	d.Lock()
+	defer d.Unlock()
+	return time.Now().After(d.h1Until)
+}
+
+// disableH2 makes tunnels use HTTP/1.1 for a while, so a remote that has
+// been upgraded in the meantime is eventually used over HTTP/2 again.
+func (d *remoteDialer) disableH2() {
+	d.Lock()
+	d.h1Until = time.Now().Add(h2RetryInterval)
+	d.Unlock()
+}
+
+func (d *remoteDialer) dialH2(ctx context.Context, targetAddr string, header http.Header) (net.Conn, error) {
+	reader, writer := io.Pipe()
+	req := &http.Request{
+		Method:        http.MethodConnect,
+		URL:           &url.URL{Scheme: "https", Host: d.addr},
+		Host:          targetAddr,
+		Header:        d.header(targetAddr, header),
+		Body:          reader,
+		ContentLength: -1,
+	}
+
+	res, err := d.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		writer.Close()
+		if isH2Unsupported(err) {
+			d.disableH2()
+		}
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		writer.Close()
+		res.Body.Close()
+		return nil, &tunnelStatusError{targetAddr: targetAddr, status: res.Status}
+	}
+
+	return newStreamConn(res.Body, writer, writer, res.Body), nil
+}
+
+func (d *remoteDialer) dialH1(ctx context.Context, targetAddr string, header http.Header) (net.Conn, error) {
+	conn, err := d.take(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel, err := d.connect(conn, targetAddr, header)
+	if _, refused := err.(*tunnelStatusError); err != nil && !refused && conn.reused {
+		// the remote may have dropped the connection while it sat in the pool.
+		if conn, err = d.dialConn(ctx, false); err != nil {
+			return nil, err
+		}
+		tunnel, err = d.connect(conn, targetAddr, header)
+	}
+	return tunnel, err
+}
+
+func (d *remoteDialer) connect(conn net.Conn, targetAddr string, header http.Header) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: targetAddr},
+		Host:   targetAddr,
+		Header: d.header(targetAddr, header),
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &tunnelStatusError{targetAddr: targetAddr, status: res.Status}
+	}
+
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// probe opens a tunnel to targetAddr over a new connection and reports how
+// long the TCP and TLS handshakes plus the CONNECT round trip took.
+func (d *remoteDialer) probe(ctx context.Context, targetAddr string) (time.Duration, error) {
+	start := time.Now()
+	conn, err := d.dialConn(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tunnel, err := d.connect(conn, targetAddr, nil)
+	if err != nil {
+		return 0, err
+	}
+	tunnel.Close()
+	return time.Since(start), nil
+}
+
+func (d *remoteDialer) header(targetAddr string, extra http.Header) http.Header {
+	h := make(http.Header)
+	for k, v := range extra {
+		h[k] = v
+	}
+	h.Set(headerToken, d.auth.token(targetAddr))
+	return h
+}
+
+// take returns a warm connection if there is one, or dials a new one.
+func (d *remoteDialer) take(ctx context.Context, h2 bool) (*pooledConn, error) {
+	var conn *pooledConn
+	d.Lock()
+	for len(d.idle) > 0 && conn == nil {
+		c := d.idle[0]
+		d.idle = d.idle[1:]
+		if time.Since(c.dialedAt) > remoteIdleTimeout || (c.proto == "h2") != h2 {
+			c.Close()
+			continue
+		}
+		conn = c
+		conn.reused = true
+	}
+	d.Unlock()
+
+	go d.fill()
+
+	if conn != nil {
+		return conn, nil
+	}
+	return d.dialConn(ctx, h2)
+}
+
+// fill dials connections until the pool is full.
+func (d *remoteDialer) fill() {
+	d.Lock()
+	if d.filling || d.closed {
+		d.Unlock()
+		return
+	}
+	d.filling = true
+	d.Unlock()
+
+	defer func() {
+		d.Lock()
+		d.filling = false
+		d.Unlock()
+	}()
+
+	for {
+		d.Lock()
+		full := len(d.idle) >= d.poolSize
+		d.Unlock()
+		if full {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), remoteDialTimeout)
+		conn, err := d.dialConn(ctx, d.useH2())
+		cancel()
+		if err == errH2Unsupported {
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		d.Lock()
+		if d.closed {
+			conn.Close()
+		} else {
+			d.idle = append(d.idle, conn)
+		}
+		d.Unlock()
+	}
+}
+
+// close drops the idle connections and stops refilling the pool.
+func (d *remoteDialer) close() {
+	d.Lock()
+	d.closed = true
+	idle := d.idle
+	d.idle = nil
+	d.Unlock()
+
+	for _, conn := range idle {
+		conn.Close()
+	}
+	d.transport.CloseIdleConnections()
+}
+
+// dialConn dials the remote proxy. When h2 is requested but the remote
+// doesn't negotiate it, HTTP/2 is disabled and the connection is put into
+// the pool for HTTP/1.1 tunnels.
+func (d *remoteDialer) dialConn(ctx context.Context, h2 bool) (*pooledConn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.scheme != "https" {
+		return &pooledConn{Conn: conn, proto: "http/1.1", dialedAt: time.Now()}, nil
+	}
+
+	config := d.tlsConfig.Clone()
+	config.NextProtos = []string{"http/1.1"}
+	if h2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	pooled := &pooledConn{
+		Conn:     tlsConn,
+		proto:    tlsConn.ConnectionState().NegotiatedProtocol,
+		dialedAt: time.Now(),
+	}
+	if h2 && pooled.proto != "h2" {
+		d.disableH2()
+		d.Lock()
+		if d.closed {
+			pooled.Close()
+		} else {
+			d.idle = append(d.idle, pooled)
+		}
+		d.Unlock()
+		return nil, errH2Unsupported
+	}
+	return pooled, nil
+}
+
+// streamConn adapts the two bodies of an HTTP/2 stream to a net.Conn. The
+// bodies can't be interrupted, so a deadline closes the stream when it
+// expires and can't be extended afterwards.
+type streamConn struct {
+	reader     io.Reader
+	writer     io.Writer
+	closers    []io.Closer
+	once       sync.Once
+	mu         sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+	expired    bool
+}
+
+func newStreamConn(reader io.Reader, writer io.Writer, closers ...io.Closer) *streamConn {
+	return &streamConn{
+		reader:  reader,
+		writer:  writer,
+		closers: closers,
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	return n, c.deadlineError(err)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	return n, c.deadlineError(err)
+}
+
+// deadlineError returns os.ErrDeadlineExceeded for the errors caused by a
+// deadline closing the stream.
+func (c *streamConn) deadlineError(err error) error {
+	if err == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	stopTimer(&c.readTimer)
+	stopTimer(&c.writeTimer)
+	c.mu.Unlock()
+
+	c.once.Do(func() {
+		for _, closer := range c.closers {
+			closer.Close()
+		}
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.setDeadline(&c.readTimer, t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.setDeadline(&c.writeTimer, t)
+}
+
+func (c *streamConn) setDeadline(timer **time.Timer, t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired {
+		return os.ErrDeadlineExceeded
+	}
+	stopTimer(timer)
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), c.expire)
+	}
+	return nil
+}
+
+func (c *streamConn) expire() {
+	c.mu.Lock()
+	c.expired = true
+	c.mu.Unlock()
+	c.Close()
+}
+
+func stopTimer(timer **time.Timer) {
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+}
+
+// flushWriter flushes every write, so tunnelled bytes aren't held back in the
+// buffers of an http.ResponseWriter.
+type flushWriter struct {
+	rw http.ResponseWriter
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.rw.Write(p)
+	if f, ok := w.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
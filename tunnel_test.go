@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteDialerH2(t *testing.T) {
+	testRemoteDialer(t, true)
+}
+
+func TestRemoteDialerH1(t *testing.T) {
+	testRemoteDialer(t, false)
+}
+
+func testRemoteDialer(t *testing.T, h2 bool) {
+	echo := startTestEcho(t)
+	defer echo.Close()
+
+	remote := httptest.NewUnstartedServer(&remoteProxy{auth: newAuthenticator("secret", defaultTokenSkew, time.Time{})})
+	remote.EnableHTTP2 = h2
+	remote.StartTLS()
+	defer remote.Close()
+
+	d := newTestRemoteDialer(t, remote, "secret")
+	for i := 0; i < 3; i++ {
+		conn, err := d.dial(context.Background(), echo.Addr().String(), nil)
+		require.Nil(t, err)
+
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		require.Nil(t, err)
+		require.Equal(t, "ping", string(buf))
+		conn.Close()
+	}
+	require.Equal(t, h2, d.useH2())
+
+	_, err := d.dial(context.Background(), "127.0.0.1:1", nil)
+	require.NotNil(t, err)
+	require.Equal(t, h2, d.useH2())
+}
+
+func TestRemoteDialerH1Refused(t *testing.T) {
+	var refused int32
+	proxy := &remoteProxy{auth: newAuthenticator("secret", defaultTokenSkew, time.Time{})}
+	remote := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Host == "127.0.0.1:1" {
+			atomic.AddInt32(&refused, 1)
+		}
+		proxy.ServeHTTP(rw, req)
+	}))
+	defer remote.Close()
+
+	d := newTestRemoteDialer(t, remote, "secret")
+	defer d.close()
+	d.fill()
+	d.Lock()
+	require.NotEmpty(t, d.idle)
+	d.Unlock()
+
+	// the remote answered, a new connection wouldn't change its mind.
+	_, err := d.dial(context.Background(), "127.0.0.1:1", nil)
+	require.IsType(t, &tunnelStatusError{}, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&refused))
+}
+
+func TestRemoteDialerH2Unsupported(t *testing.T) {
+	remote := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// remotes that predate HTTP/2 tunnels fail to hijack the stream.
+		panic(http.ErrAbortHandler)
+	}))
+	remote.EnableHTTP2 = true
+	remote.StartTLS()
+	defer remote.Close()
+
+	d := newTestRemoteDialer(t, remote, "secret")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := d.dialH2(ctx, "example.com:443", nil)
+	require.NotNil(t, err)
+	require.True(t, d.useH2())
+
+	_, err = d.dialH2(context.Background(), "example.com:443", nil)
+	require.NotNil(t, err)
+	require.False(t, d.useH2())
+}
+
+func TestStreamConnDeadline(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	conn := newStreamConn(reader, ioutil.Discard, reader)
+
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Hour)))
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	_, err := conn.Read(make([]byte, 1))
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr) && netErr.Timeout())
+	require.NotNil(t, conn.SetReadDeadline(time.Now().Add(time.Hour)))
+}
+
+func TestRemoteUDPOverH2(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	remote := httptest.NewUnstartedServer(&remoteProxy{auth: newAuthenticator("secret", defaultTokenSkew, time.Time{})})
+	remote.EnableHTTP2 = true
+	remote.StartTLS()
+	defer remote.Close()
+
+	rules, _ := parseRules(strings.NewReader("FINAL,remote"))
+	remotes := newRemoteSet(policyLatency, "", 0)
+	remotes.add(remote.URL, newTestRemoteDialer(t, remote, "secret"))
+	local := &localProxy{
+		remotes: remotes,
+		rules:   rules,
+	}
+
+	header := make(http.Header)
+	header.Set(headerNetwork, "udp")
+	conn, err := local.dial("", echo.LocalAddr().String(), header)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	tunnel := newDatagramConn(conn)
+	tunnel.Write([]byte("ping"))
+	tunnel.Write([]byte("pong"))
+	buf := make([]byte, 1024)
+	for _, want := range []string{"ping", "pong"} {
+		n, err := tunnel.Read(buf)
+		require.Nil(t, err)
+		require.Equal(t, want, string(buf[:n]))
+	}
+}
+
+func newTestRemoteDialer(t *testing.T, remote *httptest.Server, secretKey string) *remoteDialer {
+	u, err := url.Parse(remote.URL)
+	require.Nil(t, err)
+
+	d := newRemoteDialer(u, newAuthenticator(secretKey, defaultTokenSkew, time.Time{}), remotePoolSize)
+	d.tlsConfig.RootCAs = x509.NewCertPool()
+	d.tlsConfig.RootCAs.AddCert(remote.Certificate())
+	d.tlsConfig.ServerName = "example.com"
+	return d
+}
+
+func startTestEcho(t *testing.T) net.Listener {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return echo
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	headerNetwork = "Misha-Network"
+)
+
+// datagramConn carries datagrams over a stream connection, each one prefixed
+// with its length as a big-endian uint16. It lets UDP traffic travel through
+// a CONNECT tunnel to the remote proxy.
+type datagramConn struct {
+	net.Conn
+	wmu sync.Mutex
+	rmu sync.Mutex
+}
+
+func newDatagramConn(conn net.Conn) *datagramConn {
+	return &datagramConn{Conn: conn}
+}
+
+func (c *datagramConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	var size [2]byte
+	if _, err := io.ReadFull(c.Conn, size[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > len(p) {
+		if _, err := io.CopyN(ioutil.Discard, c.Conn, int64(n)); err != nil {
+			return 0, err
+		}
+		return 0, io.ErrShortBuffer
+	}
+	return io.ReadFull(c.Conn, p[:n])
+}
+
+func (c *datagramConn) Write(p []byte) (int, error) {
+	if len(p) > 0xffff {
+		return 0, io.ErrShortWrite
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// relayUDP copies datagrams between a tunnelled datagramConn and a UDP target
+// until either side fails or the target stays idle for udpIdleTimeout.
+func relayUDP(tunnel *datagramConn, target net.Conn) {
+	defer tunnel.Close()
+	defer target.Close()
+	tracked, _ := target.(*trackedConn)
+
+	go func() {
+		defer target.Close()
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, err := tunnel.Read(buf)
+			if err != nil {
+				return
+			}
+			n, _ = target.Write(buf[:n])
+			tracked.addSent(n)
+		}
+	}()
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		target.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := target.Read(buf)
+		if err != nil {
+			return
+		}
+		tracked.addReceived(n)
+		if _, err = tunnel.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}